@@ -0,0 +1,619 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+// CacheEvictPolicy policy to choose which item to evict when cache is full
+type CacheEvictPolicy int
+
+const (
+	// CacheEvictLRU evict least recently used item
+	CacheEvictLRU CacheEvictPolicy = iota
+	// CacheEvictLFU evict least frequently used item,
+	// items with the same frequency are evicted by LRU
+	CacheEvictLFU
+)
+
+// CacheEvictReason why item is removed from cache
+type CacheEvictReason int
+
+const (
+	// CacheEvictReasonCapacity evicted because cache is full
+	CacheEvictReasonCapacity CacheEvictReason = iota
+	// CacheEvictReasonExpired removed because ttl expired
+	CacheEvictReasonExpired
+	// CacheEvictReasonDeleted removed by `Delete` or overwritten by `Set`
+	CacheEvictReasonDeleted
+)
+
+// CacheStats statistics of cache
+type CacheStats struct {
+	Hits, Misses, Evictions, Expirations int64
+}
+
+// HitRate return hits / (hits + misses)
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CacheEvictCallback called after item removed from cache
+type CacheEvictCallback func(key, val interface{}, reason CacheEvictReason)
+
+type cacheEntry struct {
+	key, val interface{}
+	// expireAt zero means never expire
+	expireAt time.Time
+	elem     *list.Element
+	freq     int
+}
+
+func (e *cacheEntry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// cacheEvictor maintain the order of eviction
+type cacheEvictor interface {
+	add(e *cacheEntry)
+	touch(e *cacheEntry)
+	remove(e *cacheEntry)
+	// victim return the item should be evicted next
+	victim() *cacheEntry
+}
+
+type lruEvictor struct {
+	l *list.List
+}
+
+func newLRUEvictor() *lruEvictor {
+	return &lruEvictor{l: list.New()}
+}
+
+func (p *lruEvictor) add(e *cacheEntry) {
+	e.elem = p.l.PushFront(e)
+}
+
+func (p *lruEvictor) touch(e *cacheEntry) {
+	p.l.MoveToFront(e.elem)
+}
+
+func (p *lruEvictor) remove(e *cacheEntry) {
+	p.l.Remove(e.elem)
+}
+
+func (p *lruEvictor) victim() *cacheEntry {
+	if elem := p.l.Back(); elem != nil {
+		return elem.Value.(*cacheEntry)
+	}
+
+	return nil
+}
+
+// lfuEvictor O(1) LFU, items with the same frequency are in the same LRU list
+type lfuEvictor struct {
+	freqs   map[int]*list.List
+	minFreq int
+}
+
+func newLFUEvictor() *lfuEvictor {
+	return &lfuEvictor{freqs: map[int]*list.List{}}
+}
+
+func (p *lfuEvictor) push(e *cacheEntry) {
+	l, ok := p.freqs[e.freq]
+	if !ok {
+		l = list.New()
+		p.freqs[e.freq] = l
+	}
+
+	e.elem = l.PushFront(e)
+}
+
+// pop remove e from its frequency list
+func (p *lfuEvictor) pop(e *cacheEntry) {
+	l := p.freqs[e.freq]
+	l.Remove(e.elem)
+	if l.Len() == 0 {
+		delete(p.freqs, e.freq)
+	}
+}
+
+func (p *lfuEvictor) add(e *cacheEntry) {
+	e.freq = 1
+	p.minFreq = 1
+	p.push(e)
+}
+
+func (p *lfuEvictor) touch(e *cacheEntry) {
+	p.pop(e)
+	if _, ok := p.freqs[e.freq]; !ok && p.minFreq == e.freq {
+		p.minFreq++
+	}
+
+	e.freq++
+	p.push(e)
+}
+
+func (p *lfuEvictor) remove(e *cacheEntry) {
+	p.pop(e)
+	if _, ok := p.freqs[p.minFreq]; !ok {
+		// rare path, find new min frequency
+		p.minFreq = 0
+		for freq := range p.freqs {
+			if p.minFreq == 0 || freq < p.minFreq {
+				p.minFreq = freq
+			}
+		}
+	}
+}
+
+func (p *lfuEvictor) victim() *cacheEntry {
+	if l, ok := p.freqs[p.minFreq]; ok {
+		return l.Back().Value.(*cacheEntry)
+	}
+
+	return nil
+}
+
+// BoundedCache size-bounded cache with per-entry ttl,
+// evict items by LRU or LFU when full.
+//
+// expired items are removed lazily when accessed or evicted.
+type BoundedCache struct {
+	*boundedCacheOption
+	mu      sync.Mutex
+	size    int
+	items   map[interface{}]*cacheEntry
+	evictor cacheEvictor
+	stats   CacheStats
+}
+
+type boundedCacheOption struct {
+	policy  CacheEvictPolicy
+	ttl     time.Duration
+	onEvict CacheEvictCallback
+}
+
+// BoundedCacheOptFunc options for BoundedCache
+type BoundedCacheOptFunc func(*boundedCacheOption) error
+
+// WithBoundedCachePolicy set eviction policy, default is LRU
+func WithBoundedCachePolicy(policy CacheEvictPolicy) BoundedCacheOptFunc {
+	return func(opt *boundedCacheOption) error {
+		switch policy {
+		case CacheEvictLRU, CacheEvictLFU:
+		default:
+			return errors.Errorf("unknown evict policy %d", policy)
+		}
+
+		opt.policy = policy
+		return nil
+	}
+}
+
+// WithBoundedCacheTTL set default ttl of items, 0 means never expire
+func WithBoundedCacheTTL(ttl time.Duration) BoundedCacheOptFunc {
+	return func(opt *boundedCacheOption) error {
+		if ttl < 0 {
+			return errors.Errorf("ttl must >= 0")
+		}
+
+		opt.ttl = ttl
+		return nil
+	}
+}
+
+// WithBoundedCacheOnEvict set callback called after item removed from cache.
+//
+// callback is called outside of cache's lock.
+func WithBoundedCacheOnEvict(onEvict CacheEvictCallback) BoundedCacheOptFunc {
+	return func(opt *boundedCacheOption) error {
+		opt.onEvict = onEvict
+		return nil
+	}
+}
+
+// NewBoundedCache new cache contains at most size items
+func NewBoundedCache(size int, opts ...BoundedCacheOptFunc) (c *BoundedCache, err error) {
+	if size <= 0 {
+		return nil, errors.Errorf("size must > 0")
+	}
+
+	opt := &boundedCacheOption{
+		policy: CacheEvictLRU,
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	c = &BoundedCache{
+		boundedCacheOption: opt,
+		size:               size,
+		items:              make(map[interface{}]*cacheEntry, size),
+	}
+	switch opt.policy {
+	case CacheEvictLFU:
+		c.evictor = newLFUEvictor()
+	default:
+		c.evictor = newLRUEvictor()
+	}
+
+	return c, nil
+}
+
+type evictedCacheEntry struct {
+	*cacheEntry
+	reason CacheEvictReason
+}
+
+// notify run callback for evicted items
+func (c *BoundedCache) notify(evicted []evictedCacheEntry) {
+	if c.onEvict == nil {
+		return
+	}
+
+	for _, e := range evicted {
+		c.onEvict(e.key, e.val, e.reason)
+	}
+}
+
+// removeLocked remove entry from cache, should hold lock
+func (c *BoundedCache) removeLocked(e *cacheEntry, reason CacheEvictReason, evicted []evictedCacheEntry) []evictedCacheEntry {
+	c.evictor.remove(e)
+	delete(c.items, e.key)
+	switch reason {
+	case CacheEvictReasonCapacity:
+		c.stats.Evictions++
+	case CacheEvictReasonExpired:
+		c.stats.Expirations++
+	}
+
+	return append(evicted, evictedCacheEntry{e, reason})
+}
+
+// Get load val from cache
+func (c *BoundedCache) Get(key interface{}) (val interface{}, ok bool) {
+	var evicted []evictedCacheEntry
+	c.mu.Lock()
+	e, ok := c.items[key]
+	switch {
+	case !ok:
+		c.stats.Misses++
+	case e.expired(Clock.GetUTCNow()):
+		evicted = c.removeLocked(e, CacheEvictReasonExpired, evicted)
+		c.stats.Misses++
+		ok = false
+	default:
+		c.evictor.touch(e)
+		c.stats.Hits++
+		val = e.val
+	}
+	c.mu.Unlock()
+
+	c.notify(evicted)
+	return val, ok
+}
+
+// Set store val with default ttl
+func (c *BoundedCache) Set(key, val interface{}) {
+	c.SetWithTTL(key, val, c.ttl)
+}
+
+// SetWithTTL store val with ttl, 0 means never expire
+func (c *BoundedCache) SetWithTTL(key, val interface{}, ttl time.Duration) {
+	e := &cacheEntry{
+		key: key,
+		val: val,
+	}
+	now := Clock.GetUTCNow()
+	if ttl > 0 {
+		e.expireAt = now.Add(ttl)
+	}
+
+	var evicted []evictedCacheEntry
+	c.mu.Lock()
+	if old, ok := c.items[key]; ok {
+		evicted = c.removeLocked(old, CacheEvictReasonDeleted, evicted)
+	}
+
+	for len(c.items) >= c.size {
+		victim := c.evictor.victim()
+		reason := CacheEvictReasonCapacity
+		if victim.expired(now) {
+			reason = CacheEvictReasonExpired
+		}
+
+		evicted = c.removeLocked(victim, reason, evicted)
+	}
+
+	c.items[key] = e
+	c.evictor.add(e)
+	c.mu.Unlock()
+
+	c.notify(evicted)
+}
+
+// Delete remove key from cache
+func (c *BoundedCache) Delete(key interface{}) {
+	var evicted []evictedCacheEntry
+	c.mu.Lock()
+	if e, ok := c.items[key]; ok {
+		evicted = c.removeLocked(e, CacheEvictReasonDeleted, evicted)
+	}
+	c.mu.Unlock()
+
+	c.notify(evicted)
+}
+
+// Len return the number of items in cache, including expired items not removed yet
+func (c *BoundedCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// Stats return statistics of cache
+func (c *BoundedCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// CacheLoader load value of key when cache missed
+type CacheLoader func(ctx context.Context, key interface{}) (val interface{}, err error)
+
+type loadingCacheItem struct {
+	val interface{}
+	// err not nil means negative cached
+	err       error
+	refreshAt time.Time
+	// refreshing 1 means there is a background refresh running
+	refreshing int32
+}
+
+type loadingCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// LoadingCache cache load missing values by loader.
+//
+// concurrent loads for the same key are deduplicated,
+// entries are refreshed in background after `refreshAfter`
+// while the stale value is still served,
+// errors of loader can be cached for `negativeTTL`.
+type LoadingCache struct {
+	*loadingCacheOption
+	ctx    context.Context
+	cache  *BoundedCache
+	loader CacheLoader
+
+	mu    sync.Mutex
+	calls map[interface{}]*loadingCall
+}
+
+type loadingCacheOption struct {
+	policy       CacheEvictPolicy
+	ttl          time.Duration
+	refreshAfter time.Duration
+	negativeTTL  time.Duration
+	logger       *LoggerType
+}
+
+// LoadingCacheOptFunc options for LoadingCache
+type LoadingCacheOptFunc func(*loadingCacheOption) error
+
+// WithLoadingCachePolicy set eviction policy, default is LRU
+func WithLoadingCachePolicy(policy CacheEvictPolicy) LoadingCacheOptFunc {
+	return func(opt *loadingCacheOption) error {
+		switch policy {
+		case CacheEvictLRU, CacheEvictLFU:
+		default:
+			return errors.Errorf("unknown evict policy %d", policy)
+		}
+
+		opt.policy = policy
+		return nil
+	}
+}
+
+// WithLoadingCacheTTL set ttl of loaded values, 0 means never expire
+func WithLoadingCacheTTL(ttl time.Duration) LoadingCacheOptFunc {
+	return func(opt *loadingCacheOption) error {
+		if ttl < 0 {
+			return errors.Errorf("ttl must >= 0")
+		}
+
+		opt.ttl = ttl
+		return nil
+	}
+}
+
+// WithLoadingCacheRefreshAfter refresh value in background
+// when it has been loaded for longer than refreshAfter,
+// 0 means disable background refresh
+func WithLoadingCacheRefreshAfter(refreshAfter time.Duration) LoadingCacheOptFunc {
+	return func(opt *loadingCacheOption) error {
+		if refreshAfter < 0 {
+			return errors.Errorf("refreshAfter must >= 0")
+		}
+
+		opt.refreshAfter = refreshAfter
+		return nil
+	}
+}
+
+// WithLoadingCacheNegativeTTL cache errors returned by loader for ttl,
+// 0 means do not cache errors
+func WithLoadingCacheNegativeTTL(ttl time.Duration) LoadingCacheOptFunc {
+	return func(opt *loadingCacheOption) error {
+		if ttl < 0 {
+			return errors.Errorf("ttl must >= 0")
+		}
+
+		opt.negativeTTL = ttl
+		return nil
+	}
+}
+
+// WithLoadingCacheLogger set logger
+func WithLoadingCacheLogger(logger *LoggerType) LoadingCacheOptFunc {
+	return func(opt *loadingCacheOption) error {
+		if logger == nil {
+			return errors.Errorf("logger is nil")
+		}
+
+		opt.logger = logger
+		return nil
+	}
+}
+
+// NewLoadingCache new cache contains at most size items, load missing values by loader.
+//
+// loader is invoked with ctx, so loading is not interrupted by
+// the cancel of any single caller.
+func NewLoadingCache(ctx context.Context, size int, loader CacheLoader, opts ...LoadingCacheOptFunc) (c *LoadingCache, err error) {
+	if loader == nil {
+		return nil, errors.Errorf("loader is nil")
+	}
+
+	opt := &loadingCacheOption{
+		policy: CacheEvictLRU,
+		logger: Logger.Named("loading_cache"),
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, err
+		}
+	}
+	if opt.ttl > 0 && opt.refreshAfter >= opt.ttl {
+		return nil, errors.Errorf("refreshAfter must < ttl")
+	}
+
+	c = &LoadingCache{
+		loadingCacheOption: opt,
+		ctx:                ctx,
+		loader:             loader,
+		calls:              map[interface{}]*loadingCall{},
+	}
+	if c.cache, err = NewBoundedCache(size, WithBoundedCachePolicy(opt.policy)); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Get load value from cache, or load by loader if missed
+func (c *LoadingCache) Get(ctx context.Context, key interface{}) (val interface{}, err error) {
+	if v, ok := c.cache.Get(key); ok {
+		item := v.(*loadingCacheItem)
+		if item.err != nil {
+			return nil, item.err
+		}
+
+		if c.refreshAfter > 0 &&
+			Clock.GetUTCNow().After(item.refreshAt) &&
+			atomic.CompareAndSwapInt32(&item.refreshing, 0, 1) {
+			go c.refresh(key, item)
+		}
+
+		return item.val, nil
+	}
+
+	return c.load(ctx, key, nil)
+}
+
+// refresh reload value in background, keep the stale value if failed
+func (c *LoadingCache) refresh(key interface{}, stale *loadingCacheItem) {
+	if _, err := c.load(c.ctx, key, stale); err != nil {
+		c.logger.Warn("refresh cache", zap.Any("key", key), zap.Error(err))
+		atomic.StoreInt32(&stale.refreshing, 0)
+	}
+}
+
+// load run loader, concurrent loads for the same key share one call
+func (c *LoadingCache) load(ctx context.Context, key interface{}, stale *loadingCacheItem) (val interface{}, err error) {
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		call = &loadingCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.mu.Unlock()
+		go c.doLoad(key, call, stale)
+	} else {
+		c.mu.Unlock()
+	}
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *LoadingCache) doLoad(key interface{}, call *loadingCall, stale *loadingCacheItem) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.val, call.err = c.loadWithoutPanic(key)
+	switch {
+	case call.err == nil:
+		c.Set(key, call.val)
+	case stale != nil:
+		// keep serving stale value
+	case c.negativeTTL > 0:
+		c.cache.SetWithTTL(key, &loadingCacheItem{err: call.err}, c.negativeTTL)
+	}
+}
+
+func (c *LoadingCache) loadWithoutPanic(key interface{}) (val interface{}, err error) {
+	defer func() {
+		if erri := recover(); erri != nil {
+			err = errors.Errorf("load key `%v`: %+v", key, erri)
+		}
+	}()
+
+	return c.loader(c.ctx, key)
+}
+
+// Set store value into cache
+func (c *LoadingCache) Set(key, val interface{}) {
+	c.cache.SetWithTTL(key, &loadingCacheItem{
+		val:       val,
+		refreshAt: Clock.GetUTCNow().Add(c.refreshAfter),
+	}, c.ttl)
+}
+
+// Invalidate remove key from cache
+func (c *LoadingCache) Invalidate(key interface{}) {
+	c.cache.Delete(key)
+}
+
+// Len return the number of items in cache
+func (c *LoadingCache) Len() int {
+	return c.cache.Len()
+}
+
+// Stats return statistics of cache
+func (c *LoadingCache) Stats() CacheStats {
+	return c.cache.Stats()
+}
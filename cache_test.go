@@ -0,0 +1,361 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBoundedCacheLRU(t *testing.T) {
+	var evicted []interface{}
+	c, err := NewBoundedCache(3, WithBoundedCacheOnEvict(func(key, val interface{}, reason CacheEvictReason) {
+		if reason == CacheEvictReasonCapacity {
+			evicted = append(evicted, key)
+		}
+	}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	if v, ok := c.Get("a"); !ok || v.(int) != 1 {
+		t.Fatalf("got %v, %v", v, ok)
+	}
+
+	c.Set("d", 4) // evict b
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b should be evicted")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("%s should exists", k)
+		}
+	}
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("got %v", evicted)
+	}
+
+	c.Set("a", 10) // overwrite should not evict
+	if c.Len() != 3 {
+		t.Fatalf("got %d", c.Len())
+	}
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("a should be deleted")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 4 || stats.Misses != 2 || stats.Evictions != 1 {
+		t.Fatalf("got %+v", stats)
+	}
+	if stats.HitRate() < 0.66 || stats.HitRate() > 0.67 {
+		t.Fatalf("got %v", stats.HitRate())
+	}
+}
+
+func TestBoundedCacheLFU(t *testing.T) {
+	c, err := NewBoundedCache(3, WithBoundedCachePolicy(CacheEvictLFU))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	for i := 0; i < 3; i++ {
+		c.Get("a")
+		c.Get("c")
+	}
+	c.Get("b")
+
+	c.Set("d", 4) // evict b, freq 2
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b should be evicted")
+	}
+
+	c.Set("e", 5) // evict d, freq 1
+	if _, ok := c.Get("d"); ok {
+		t.Fatal("d should be evicted")
+	}
+	for _, k := range []string{"a", "c", "e"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("%s should exists", k)
+		}
+	}
+
+	c.Delete("e")
+	c.Set("f", 6)
+	c.Set("g", 7) // evict f
+	if _, ok := c.Get("f"); ok {
+		t.Fatal("f should be evicted")
+	}
+}
+
+func TestBoundedCacheTTL(t *testing.T) {
+	var expired int
+	c, err := NewBoundedCache(10,
+		WithBoundedCacheTTL(50*time.Millisecond),
+		WithBoundedCacheOnEvict(func(key, val interface{}, reason CacheEvictReason) {
+			if reason == CacheEvictReasonExpired {
+				expired++
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	c.Set("a", 1)
+	c.SetWithTTL("b", 2, 0)
+	c.SetWithTTL("c", 3, time.Hour)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a should exists")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("a should expired")
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("%s should exists", k)
+		}
+	}
+	if expired != 1 || c.Stats().Expirations != 1 {
+		t.Fatalf("got %d, %+v", expired, c.Stats())
+	}
+
+	if _, err = NewBoundedCache(0); err == nil {
+		t.Fatal("should error")
+	}
+	if _, err = NewBoundedCache(1, WithBoundedCachePolicy(100)); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestBoundedCacheParallel(t *testing.T) {
+	for _, policy := range []CacheEvictPolicy{CacheEvictLRU, CacheEvictLFU} {
+		c, err := NewBoundedCache(100, WithBoundedCachePolicy(policy))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					k := fmt.Sprint((i * j) % 300)
+					if _, ok := c.Get(k); !ok {
+						c.Set(k, j)
+					}
+					if j%7 == 0 {
+						c.Delete(k)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if c.Len() > 100 {
+			t.Fatalf("got %d", c.Len())
+		}
+	}
+}
+
+func TestLoadingCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var nLoad int32
+	blocker := make(chan struct{})
+	c, err := NewLoadingCache(ctx, 10, func(ctx context.Context, key interface{}) (interface{}, error) {
+		atomic.AddInt32(&nLoad, 1)
+		<-blocker
+		return key.(int) * 2, nil
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// concurrent loads should be deduplicated
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get(ctx, 1)
+			if err != nil || v.(int) != 2 {
+				t.Errorf("got %v, %+v", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(blocker)
+	wg.Wait()
+	if n := atomic.LoadInt32(&nLoad); n != 1 {
+		t.Fatalf("got %d", n)
+	}
+
+	if v, err := c.Get(ctx, 1); err != nil || v.(int) != 2 || atomic.LoadInt32(&nLoad) != 1 {
+		t.Fatalf("got %v, %+v", v, err)
+	}
+
+	c.Invalidate(1)
+	if _, err := c.Get(ctx, 1); err != nil || atomic.LoadInt32(&nLoad) != 2 {
+		t.Fatalf("got %d, %+v", atomic.LoadInt32(&nLoad), err)
+	}
+
+	// caller cancel should not wait for loading
+	c2, err := NewLoadingCache(ctx, 10, func(ctx context.Context, key interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	cctx, ccancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer ccancel()
+	if _, err = c2.Get(cctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("got %+v", err)
+	}
+
+	if _, err = NewLoadingCache(ctx, 10, nil); err == nil {
+		t.Fatal("should error")
+	}
+	if _, err = NewLoadingCache(ctx, 10, func(ctx context.Context, key interface{}) (interface{}, error) {
+		return nil, nil
+	}, WithLoadingCacheTTL(time.Second), WithLoadingCacheRefreshAfter(time.Second)); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestLoadingCacheRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		nLoad int32
+		fail  int32
+	)
+	c, err := NewLoadingCache(ctx, 10, func(ctx context.Context, key interface{}) (interface{}, error) {
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, fmt.Errorf("failed")
+		}
+
+		return atomic.AddInt32(&nLoad, 1), nil
+	},
+		WithLoadingCacheTTL(time.Hour),
+		WithLoadingCacheRefreshAfter(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if v, err := c.Get(ctx, "k"); err != nil || v.(int32) != 1 {
+		t.Fatalf("got %v, %+v", v, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// stale value is served while refreshing
+	if v, err := c.Get(ctx, "k"); err != nil || v.(int32) != 1 {
+		t.Fatalf("got %v, %+v", v, err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&nLoad) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, err := c.Get(ctx, "k"); err != nil || v.(int32) != 2 {
+		t.Fatalf("got %v, %+v", v, err)
+	}
+
+	// failed refresh keeps stale value
+	atomic.StoreInt32(&fail, 1)
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if v, err := c.Get(ctx, "k"); err != nil || v.(int32) != 2 {
+			t.Fatalf("got %v, %+v", v, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoadingCacheNegative(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var nLoad int32
+	c, err := NewLoadingCache(ctx, 10, func(ctx context.Context, key interface{}) (interface{}, error) {
+		atomic.AddInt32(&nLoad, 1)
+		return nil, fmt.Errorf("not found")
+	}, WithLoadingCacheNegativeTTL(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err = c.Get(ctx, "k"); err == nil {
+			t.Fatal("should error")
+		}
+	}
+	if n := atomic.LoadInt32(&nLoad); n != 1 {
+		t.Fatalf("got %d", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err = c.Get(ctx, "k"); err == nil {
+		t.Fatal("should error")
+	}
+	if n := atomic.LoadInt32(&nLoad); n != 2 {
+		t.Fatalf("got %d", n)
+	}
+}
+
+func TestLoadingCachePanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, err := NewLoadingCache(ctx, 10, func(ctx context.Context, key interface{}) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		panic("boom")
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get(ctx, "k"); err == nil || !strings.Contains(err.Error(), "boom") {
+				t.Errorf("got %+v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkBoundedCache(b *testing.B) {
+	for _, policy := range []CacheEvictPolicy{CacheEvictLRU, CacheEvictLFU} {
+		c, err := NewBoundedCache(1000, WithBoundedCachePolicy(policy))
+		if err != nil {
+			b.Fatalf("%+v", err)
+		}
+
+		b.Run(fmt.Sprintf("policy %d", policy), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				k := i % 2000
+				if _, ok := c.Get(k); !ok {
+					c.Set(k, i)
+				}
+			}
+		})
+	}
+}
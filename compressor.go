@@ -3,16 +3,23 @@ package utils
 import (
 	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 
 	"github.com/Laisky/zap"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
 	"github.com/pkg/errors"
 )
 
@@ -22,6 +29,23 @@ const (
 	defaultCompressBufSizeByte  = 4 * 1024 * 1024
 	defaultPgzCompressNBlock    = 16
 	defaultPgzCompressBlockSize = 250000
+	defaultZstdCompressLevel    = 3
+	defaultS2CompressLevel      = 1
+	defaultLZ4CompressLevel     = 0
+	// defaultDecompressMaxSizeByte default max decompressed size
+	defaultDecompressMaxSizeByte = 1024 * 1024 * 1024
+)
+
+var (
+	// ErrDecompressSizeExceeded decompressed data exceeds the max size
+	ErrDecompressSizeExceeded = errors.New("decompressed size exceeded")
+	// ErrUnknownCompressFormat can not detect format of compressed data
+	ErrUnknownCompressFormat = errors.New("unknown compress format")
+)
+
+var (
+	zipMagic   = []byte("PK\x03\x04")
+	bzip2Magic = []byte("BZh")
 )
 
 // CompressorItf interface of compressor
@@ -218,60 +242,27 @@ func (c *PGZCompressor) WriteFooter() (err error) {
 // Unzip will decompress a zip archive, moving all files and folders
 // within the zip file (parameter 1) to an output directory (parameter 2).
 //
+// files are extracted in parallel, see `ExtractZip`.
+//
 // https://golangcode.com/unzip-files-in-go/
 func Unzip(src string, dest string) (filenames []string, err error) {
-	var r *zip.ReadCloser
-	if r, err = zip.OpenReader(src); err != nil {
+	return UnzipFS(OSFS{}, src, dest)
+}
+
+// UnzipFS decompress zip archive src into dest, both in fsys
+func UnzipFS(fsys FS, src string, dest string, opts ...ZipOptFunc) (filenames []string, err error) {
+	fp, err := fsys.Open(src)
+	if err != nil {
 		return nil, errors.Wrap(err, "open src")
 	}
-	defer r.Close()
-
-	for _, f := range r.File {
-		// Store filename/path for returning and using later on
-		fpath := filepath.Join(dest, f.Name)
-
-		// Check for ZipSlip. More Info: https://snyk.io/research/zip-slip-vulnerability#go
-		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return filenames, fmt.Errorf("illegal file path: %s", fpath)
-		}
-
-		filenames = append(filenames, fpath)
-
-		if f.FileInfo().IsDir() {
-			// Make Folder
-			if err = os.MkdirAll(fpath, os.ModePerm); err != nil {
-				return nil, errors.Wrapf(err, "create basedir: %s", fpath)
-			}
-
-			Logger.Debug("create basedir", zap.String("path", fpath))
-			continue
-		}
+	defer fp.Close()
 
-		// Make File
-		if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
-			return nil, errors.Wrapf(err, "mkdir: %s", fpath)
-		}
-		Logger.Debug("create basedir", zap.String("path", filepath.Dir(fpath)))
-
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return nil, errors.Wrapf(err, "open file to write: %s", fpath)
-		}
-		Logger.Debug("create file", zap.String("path", filepath.Dir(fpath)))
-		defer outFile.Close()
-
-		rc, err := f.Open()
-		if err != nil {
-			return nil, errors.Wrapf(err, "read src file to write: %s", f.Name)
-		}
-		defer rc.Close()
-
-		if _, err = io.Copy(outFile, rc); err != nil {
-			return nil, errors.Wrap(err, "copy src to dest")
-		}
+	st, err := fp.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "get src stat")
 	}
 
-	return filenames, nil
+	return ExtractZipFS(fsys, fp, st.Size(), dest, opts...)
 }
 
 // ZipFiles compresses one or many files into a single zip archive file.
@@ -281,25 +272,26 @@ func Unzip(src string, dest string) (filenames []string, err error) {
 //   * files: is a list of files to add to the zip.
 //            files can be directory.
 //
+// files are compressed in parallel, see `WriteZip`.
+//
 // https://golangcode.com/create-zip-files-in-go/
 func ZipFiles(output string, files []string) (err error) {
-	var newZipFile *os.File
-	if newZipFile, err = os.Create(output); err != nil {
-		return err
+	return ZipFilesFS(OSFS{}, output, files)
+}
+
+// ZipFilesFS compresses files in fsys into zip archive output in fsys
+func ZipFilesFS(fsys FS, output string, files []string, opts ...ZipOptFunc) (err error) {
+	newZipFile, err := fsys.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "create file `%s`", output)
 	}
 	defer newZipFile.Close()
 
-	zipWriter := zip.NewWriter(newZipFile)
-	defer zipWriter.Close()
-
-	// Add files to zip
-	for _, file := range files {
-		if err = AddFileToZip(zipWriter, file, ""); err != nil {
-			return errors.Wrapf(err, "AddFileToZip: %s", file)
-		}
+	if err = WriteZipFS(fsys, newZipFile, files, opts...); err != nil {
+		return err
 	}
 
-	return nil
+	return newZipFile.Close()
 }
 
 // AddFileToZip add file tp zip.Writer
@@ -360,3 +352,529 @@ func AddFileToZip(zipWriter *zip.Writer, filename, basedir string) error {
 	Logger.Debug("add file to zip", zap.String("file", filename))
 	return nil
 }
+
+// resetWriteCloser writer can be closed and reused
+type resetWriteCloser interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// streamCompressor compressor wraps stream encoder with buf
+type streamCompressor struct {
+	*compressOption
+	buf     *bufio.Writer
+	encoder resetWriteCloser
+	writer  io.Writer
+}
+
+func newStreamCompressor(writer io.Writer, opt *compressOption, opts []CompressOptFunc, newEncoder func(w io.Writer, opt *compressOption) (resetWriteCloser, error)) (c *streamCompressor, err error) {
+	for _, of := range opts {
+		if err = of(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	c = &streamCompressor{
+		writer:         writer,
+		compressOption: opt,
+	}
+	c.buf = bufio.NewWriterSize(c.writer, c.bufSizeByte)
+	if c.encoder, err = newEncoder(c.buf, opt); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Write write bytes via compressor
+func (c *streamCompressor) Write(d []byte) (int, error) {
+	return c.encoder.Write(d)
+}
+
+// WriteString write string via compressor
+func (c *streamCompressor) WriteString(d string) (int, error) {
+	return c.encoder.Write([]byte(d))
+}
+
+// Flush flush buffer bytes into bottom writer with footer
+func (c *streamCompressor) Flush() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	if err = c.buf.Flush(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// WriteFooter write footer
+func (c *streamCompressor) WriteFooter() (err error) {
+	if err = c.encoder.Close(); err != nil {
+		return err
+	}
+	c.encoder.Reset(c.buf)
+	return nil
+}
+
+// ZstdCompressor compress by zstd with buf
+//
+// level is the zstd level (1~22), default is 3
+type ZstdCompressor struct {
+	*streamCompressor
+}
+
+// NewZstdCompressor create new ZstdCompressor
+func NewZstdCompressor(writer io.Writer, opts ...CompressOptFunc) (c *ZstdCompressor, err error) {
+	opt := &compressOption{
+		level:       defaultZstdCompressLevel,
+		bufSizeByte: defaultCompressBufSizeByte,
+	}
+	sc, err := newStreamCompressor(writer, opt, opts, func(w io.Writer, opt *compressOption) (resetWriteCloser, error) {
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opt.level)))
+		return enc, errors.Wrap(err, "new zstd")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZstdCompressor{sc}, nil
+}
+
+// S2Compressor compress by s2 with buf
+//
+// level > 1 enable better compression
+type S2Compressor struct {
+	*streamCompressor
+}
+
+// NewS2Compressor create new S2Compressor
+func NewS2Compressor(writer io.Writer, opts ...CompressOptFunc) (c *S2Compressor, err error) {
+	opt := &compressOption{
+		level:       defaultS2CompressLevel,
+		bufSizeByte: defaultCompressBufSizeByte,
+	}
+	sc, err := newStreamCompressor(writer, opt, opts, func(w io.Writer, opt *compressOption) (resetWriteCloser, error) {
+		var wopts []s2.WriterOption
+		if opt.level > 1 {
+			wopts = append(wopts, s2.WriterBetterCompression())
+		}
+
+		return s2.NewWriter(w, wopts...), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S2Compressor{sc}, nil
+}
+
+// SnappyCompressor compress by snappy framing format with buf
+type SnappyCompressor struct {
+	*streamCompressor
+}
+
+// NewSnappyCompressor create new SnappyCompressor
+func NewSnappyCompressor(writer io.Writer, opts ...CompressOptFunc) (c *SnappyCompressor, err error) {
+	opt := &compressOption{
+		bufSizeByte: defaultCompressBufSizeByte,
+	}
+	sc, err := newStreamCompressor(writer, opt, opts, func(w io.Writer, opt *compressOption) (resetWriteCloser, error) {
+		return snappy.NewBufferedWriter(w), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnappyCompressor{sc}, nil
+}
+
+// LZ4Compressor compress by lz4 frame format with buf
+//
+// level is 0 (fast) or 1~9
+type LZ4Compressor struct {
+	*streamCompressor
+}
+
+// NewLZ4Compressor create new LZ4Compressor
+func NewLZ4Compressor(writer io.Writer, opts ...CompressOptFunc) (c *LZ4Compressor, err error) {
+	opt := &compressOption{
+		level:       defaultLZ4CompressLevel,
+		bufSizeByte: defaultCompressBufSizeByte,
+	}
+	sc, err := newStreamCompressor(writer, opt, opts, func(w io.Writer, opt *compressOption) (resetWriteCloser, error) {
+		if opt.level < 0 || opt.level > 9 {
+			return nil, errors.Errorf("lz4 level should in [0, 9], got %d", opt.level)
+		}
+
+		level := lz4.Fast
+		if opt.level > 0 {
+			level = lz4.CompressionLevel(1 << uint(8+opt.level))
+		}
+
+		enc := lz4.NewWriter(w)
+		if err := enc.Apply(lz4.CompressionLevelOption(level)); err != nil {
+			return nil, errors.Wrap(err, "set lz4 level")
+		}
+
+		return enc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &LZ4Compressor{sc}, nil
+}
+
+// lz4MultiFrameReader read concatenated lz4 frames
+type lz4MultiFrameReader struct {
+	src *bufio.Reader
+	zr  *lz4.Reader
+}
+
+func newLZ4MultiFrameReader(r io.Reader) *lz4MultiFrameReader {
+	src := bufio.NewReader(r)
+	return &lz4MultiFrameReader{
+		src: src,
+		zr:  lz4.NewReader(src),
+	}
+}
+
+func (r *lz4MultiFrameReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = r.zr.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		if _, perr := r.src.Peek(1); perr != nil {
+			// no more frame
+			return n, err
+		}
+
+		r.zr.Reset(r.src)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *lz4MultiFrameReader) Close() error {
+	return nil
+}
+
+// CompressCodec compression codec with its compressor and decompressor
+type CompressCodec struct {
+	// Name unique name of codec, like `gzip`
+	Name string
+	// Magic magic bytes at the beginning of compressed stream,
+	// empty means codec can not be detected
+	Magic []byte
+	// NewCompressor create compressor write into w
+	NewCompressor func(w io.Writer, opts ...CompressOptFunc) (CompressorItf, error)
+	// NewDecompressor create reader read decompressed data from r
+	NewDecompressor func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	compressCodecsMu sync.RWMutex
+	compressCodecs   []*CompressCodec
+)
+
+// RegisterCompressCodec register codec, codec with the same name will be replaced
+func RegisterCompressCodec(codec *CompressCodec) error {
+	if codec == nil || codec.Name == "" {
+		return errors.Errorf("codec name should not be empty")
+	}
+	if codec.NewCompressor == nil || codec.NewDecompressor == nil {
+		return errors.Errorf("codec `%s` should have compressor and decompressor", codec.Name)
+	}
+
+	compressCodecsMu.Lock()
+	defer compressCodecsMu.Unlock()
+	for i, c := range compressCodecs {
+		if c.Name == codec.Name {
+			compressCodecs[i] = codec
+			return nil
+		}
+	}
+
+	compressCodecs = append(compressCodecs, codec)
+	return nil
+}
+
+// GetCompressCodec get codec by name
+func GetCompressCodec(name string) (codec *CompressCodec, ok bool) {
+	compressCodecsMu.RLock()
+	defer compressCodecsMu.RUnlock()
+	for _, c := range compressCodecs {
+		if c.Name == name {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// DetectCompressCodec detect codec by the magic bytes at the beginning of head
+func DetectCompressCodec(head []byte) (codec *CompressCodec, ok bool) {
+	compressCodecsMu.RLock()
+	defer compressCodecsMu.RUnlock()
+	for _, c := range compressCodecs {
+		if len(c.Magic) != 0 && bytes.HasPrefix(head, c.Magic) {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+func init() {
+	for _, codec := range []*CompressCodec{
+		{
+			Name:  "gzip",
+			Magic: []byte{0x1f, 0x8b},
+			NewCompressor: func(w io.Writer, opts ...CompressOptFunc) (CompressorItf, error) {
+				return NewGZCompressor(w, opts...)
+			},
+			NewDecompressor: func(r io.Reader) (io.ReadCloser, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		{
+			// pgzip output is gzip, detected as `gzip`
+			Name: "pgzip",
+			NewCompressor: func(w io.Writer, opts ...CompressOptFunc) (CompressorItf, error) {
+				return NewPGZCompressor(w, opts...)
+			},
+			NewDecompressor: func(r io.Reader) (io.ReadCloser, error) {
+				return pgzip.NewReader(r)
+			},
+		},
+		{
+			Name:  "zstd",
+			Magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+			NewCompressor: func(w io.Writer, opts ...CompressOptFunc) (CompressorItf, error) {
+				return NewZstdCompressor(w, opts...)
+			},
+			NewDecompressor: func(r io.Reader) (io.ReadCloser, error) {
+				dec, err := zstd.NewReader(r)
+				if err != nil {
+					return nil, errors.Wrap(err, "new zstd reader")
+				}
+
+				return dec.IOReadCloser(), nil
+			},
+		},
+		{
+			Name:  "s2",
+			Magic: []byte("\xff\x06\x00\x00S2sTwO"),
+			NewCompressor: func(w io.Writer, opts ...CompressOptFunc) (CompressorItf, error) {
+				return NewS2Compressor(w, opts...)
+			},
+			NewDecompressor: func(r io.Reader) (io.ReadCloser, error) {
+				return ioutil.NopCloser(s2.NewReader(r)), nil
+			},
+		},
+		{
+			Name:  "snappy",
+			Magic: []byte("\xff\x06\x00\x00sNaPpY"),
+			NewCompressor: func(w io.Writer, opts ...CompressOptFunc) (CompressorItf, error) {
+				return NewSnappyCompressor(w, opts...)
+			},
+			NewDecompressor: func(r io.Reader) (io.ReadCloser, error) {
+				return ioutil.NopCloser(snappy.NewReader(r)), nil
+			},
+		},
+		{
+			Name:  "lz4",
+			Magic: []byte{0x04, 0x22, 0x4d, 0x18},
+			NewCompressor: func(w io.Writer, opts ...CompressOptFunc) (CompressorItf, error) {
+				return NewLZ4Compressor(w, opts...)
+			},
+			NewDecompressor: func(r io.Reader) (io.ReadCloser, error) {
+				return newLZ4MultiFrameReader(r), nil
+			},
+		},
+	} {
+		if err := RegisterCompressCodec(codec); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type decompressOption struct {
+	maxSizeByte int64
+	passthrough bool
+}
+
+// DecompressOptFunc options for decompressor
+type DecompressOptFunc func(*decompressOption) error
+
+// WithDecompressMaxSizeByte set max size of decompressed data,
+// reader returns ErrDecompressSizeExceeded if exceeded.
+//
+// default is 1GB
+func WithDecompressMaxSizeByte(n int64) DecompressOptFunc {
+	return func(opt *decompressOption) error {
+		if n <= 0 {
+			return errors.Errorf("max size must > 0")
+		}
+
+		opt.maxSizeByte = n
+		return nil
+	}
+}
+
+// WithDecompressPassthrough return the raw data if format can not be detected,
+// otherwise return ErrUnknownCompressFormat
+func WithDecompressPassthrough() DecompressOptFunc {
+	return func(opt *decompressOption) error {
+		opt.passthrough = true
+		return nil
+	}
+}
+
+// NewDecompressReader detect format by magic bytes and return reader of decompressed data.
+//
+// supports all registered codecs, bzip2 and zip.
+// concatenated streams (like multiple gzip members) are read as one.
+// zip need random access, so the whole archive is loaded into memory,
+// and contents of all files are read in order.
+func NewDecompressReader(r io.Reader, opts ...DecompressOptFunc) (rc io.ReadCloser, err error) {
+	opt := &decompressOption{
+		maxSizeByte: defaultDecompressMaxSizeByte,
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	br := bufio.NewReader(r)
+	// input may be shorter than 16 bytes
+	head, err := br.Peek(16)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "read magic")
+	}
+	err = nil
+
+	switch {
+	case bytes.HasPrefix(head, zipMagic):
+		rc, err = newZipContentReader(br, opt.maxSizeByte)
+	case bytes.HasPrefix(head, bzip2Magic):
+		rc = ioutil.NopCloser(bzip2.NewReader(br))
+	default:
+		codec, ok := DetectCompressCodec(head)
+		switch {
+		case ok:
+			rc, err = codec.NewDecompressor(br)
+		case opt.passthrough:
+			rc = ioutil.NopCloser(br)
+		default:
+			return nil, ErrUnknownCompressFormat
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "new decompressor")
+	}
+
+	return &sizeLimitedReadCloser{
+		ReadCloser: rc,
+		remain:     opt.maxSizeByte,
+	}, nil
+}
+
+// sizeLimitedReadCloser return ErrDecompressSizeExceeded if read more than remain bytes
+type sizeLimitedReadCloser struct {
+	io.ReadCloser
+	remain int64
+}
+
+func (r *sizeLimitedReadCloser) Read(p []byte) (n int, err error) {
+	if r.remain < 0 {
+		return 0, ErrDecompressSizeExceeded
+	}
+
+	// read one more byte to detect exceeding
+	if r.remain < int64(len(p)) {
+		p = p[:r.remain+1]
+	}
+
+	n, err = r.ReadCloser.Read(p)
+	r.remain -= int64(n)
+	if r.remain < 0 {
+		return n + int(r.remain), ErrDecompressSizeExceeded
+	}
+
+	return n, err
+}
+
+// newZipContentReader load zip archive into memory,
+// return reader of all files' content
+func newZipContentReader(r io.Reader, maxSizeByte int64) (io.ReadCloser, error) {
+	limit := maxSizeByte
+	if limit < math.MaxInt64 {
+		// read one more byte to detect exceeding
+		limit++
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return nil, errors.Wrap(err, "read zip")
+	}
+	if int64(len(data)) > maxSizeByte {
+		return nil, ErrDecompressSizeExceeded
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "open zip")
+	}
+
+	return &zipContentReader{files: zr.File}, nil
+}
+
+type zipContentReader struct {
+	files []*zip.File
+	cur   io.ReadCloser
+}
+
+func (r *zipContentReader) Read(p []byte) (n int, err error) {
+	for {
+		if r.cur == nil {
+			for len(r.files) > 0 && r.files[0].FileInfo().IsDir() {
+				r.files = r.files[1:]
+			}
+			if len(r.files) == 0 {
+				return 0, io.EOF
+			}
+
+			if r.cur, err = r.files[0].Open(); err != nil {
+				return 0, errors.Wrapf(err, "open `%s`", r.files[0].Name)
+			}
+			r.files = r.files[1:]
+		}
+
+		n, err = r.cur.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		if err = r.cur.Close(); err != nil {
+			return n, err
+		}
+		r.cur = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *zipContentReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+
+	return nil
+}
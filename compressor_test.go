@@ -1,16 +1,20 @@
 package utils
 
 import (
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"encoding/hex"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
 )
 
 // func TestZipDir(t *testing.T) {
@@ -184,6 +188,215 @@ func ExampleGZCompressor() {
 	}
 }
 
+func TestCompressCodecs(t *testing.T) {
+	raw := strings.Repeat(testCompressraw, 100)
+	for _, name := range []string{"gzip", "pgzip", "zstd", "s2", "snappy", "lz4"} {
+		codec, ok := GetCompressCodec(name)
+		if !ok {
+			t.Fatalf("codec %s not found", name)
+		}
+
+		writer := &bytes.Buffer{}
+		c, err := codec.NewCompressor(writer)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+
+		// concatenated streams
+		for i := 0; i < 2; i++ {
+			if _, err = c.WriteString(raw); err != nil {
+				t.Fatalf("%s: %+v", name, err)
+			}
+			if err = c.Flush(); err != nil {
+				t.Fatalf("%s: %+v", name, err)
+			}
+		}
+		if writer.Len() >= 2*len(raw) {
+			t.Fatalf("%s: not compressed, got %d", name, writer.Len())
+		}
+
+		detected, ok := DetectCompressCodec(writer.Bytes())
+		if !ok {
+			t.Fatalf("%s: can not detect", name)
+		}
+		if name != "pgzip" && detected.Name != name {
+			t.Fatalf("%s: detected %s", name, detected.Name)
+		} else if name == "pgzip" && detected.Name != "gzip" {
+			t.Fatalf("%s: detected %s", name, detected.Name)
+		}
+
+		r, err := codec.NewDecompressor(writer)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if err = r.Close(); err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if string(got) != raw+raw {
+			t.Fatalf("%s: got %d bytes", name, len(got))
+		}
+	}
+
+	if _, ok := DetectCompressCodec([]byte("plain text")); ok {
+		t.Fatal("should not detect")
+	}
+	if _, err := NewLZ4Compressor(&bytes.Buffer{}, WithCompressLevel(10)); err == nil {
+		t.Fatal("should error")
+	}
+	if err := RegisterCompressCodec(&CompressCodec{Name: "nop"}); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestNewDecompressReader(t *testing.T) {
+	raw := strings.Repeat(testCompressraw, 100)
+
+	// concatenated gzip members
+	buf := &bytes.Buffer{}
+	c, err := NewGZCompressor(buf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = c.WriteString(raw); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = c.Flush(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	gzData := buf.Bytes()
+
+	buf = &bytes.Buffer{}
+	zc, err := NewZstdCompressor(buf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = zc.WriteString(raw); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = zc.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	zstdData := buf.Bytes()
+
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	for _, name := range []string{"a", "b"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err = w.Write([]byte(raw)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	bz2Data, err := hex.DecodeString("425a6839314159265359555a44f70000021980400010001264c0102000220069ea100305d3b62183c5dc914e14241556913dc0")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		data   []byte
+		expect string
+	}{
+		"gzip":  {gzData, raw + raw},
+		"zstd":  {zstdData, raw},
+		"zip":   {zipBuf.Bytes(), raw + raw},
+		"bzip2": {bz2Data, "hello bzip2"},
+	} {
+		r, err := NewDecompressReader(bytes.NewReader(tc.data))
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if string(got) != tc.expect {
+			t.Fatalf("%s: got %d bytes", name, len(got))
+		}
+		if err = r.Close(); err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+
+		// decompression bomb
+		r, err = NewDecompressReader(bytes.NewReader(tc.data), WithDecompressMaxSizeByte(int64(len(tc.expect)-1)))
+		if err == nil {
+			got, err = ioutil.ReadAll(r)
+			if len(got) != len(tc.expect)-1 {
+				t.Fatalf("%s: got %d bytes", name, len(got))
+			}
+		}
+		if errors.Cause(err) != ErrDecompressSizeExceeded {
+			t.Fatalf("%s: got %+v", name, err)
+		}
+	}
+
+	if _, err = NewDecompressReader(strings.NewReader("plain")); err != ErrUnknownCompressFormat {
+		t.Fatalf("got %+v", err)
+	}
+	r, err := NewDecompressReader(strings.NewReader("plain"), WithDecompressPassthrough())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || string(got) != "plain" {
+		t.Fatalf("got %s, %+v", got, err)
+	}
+}
+
+func TestNewDecompressReaderMaxInt64(t *testing.T) {
+	raw := strings.Repeat(testCompressraw, 100)
+
+	buf := &bytes.Buffer{}
+	c, err := NewGZCompressor(buf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = c.WriteString(raw); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = c.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	gzData := buf.Bytes()
+
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	w, err := zw.Create("a")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = w.Write([]byte(raw)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for name, data := range map[string][]byte{
+		"gzip": gzData,
+		"zip":  zipBuf.Bytes(),
+	} {
+		r, err := NewDecompressReader(bytes.NewReader(data), WithDecompressMaxSizeByte(math.MaxInt64))
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil || string(got) != raw {
+			t.Fatalf("%s: got %d bytes, %+v", name, len(got), err)
+		}
+	}
+}
+
 func TestPGZCompressor(t *testing.T) {
 	originText := testCompressraw
 	writer := &bytes.Buffer{}
@@ -7,6 +7,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/Laisky/zap"
 )
@@ -226,10 +227,16 @@ type ParallelCounter struct {
 }
 
 // ChildParallelCounter child of ParallelCounter
+//
+// child hold a quote from parent, count inside the quote is lock-free.
+// when the quote exhausted, child will request new quote from parent.
 type ChildParallelCounter struct {
-	sync.RWMutex
-	lockID  int64
-	p       *ParallelCounter
+	p *ParallelCounter
+	q unsafe.Pointer // *childQuote
+}
+
+// childQuote numbers in (n, maxN] are available
+type childQuote struct {
 	n, maxN int64
 }
 
@@ -300,54 +307,111 @@ func (c *ParallelCounter) GetQuote(step int64) (from, to int64) {
 	return
 }
 
+// getRange reserve n continuous numbers from parent,
+// the range may span the rotate point, in which case `to` will be less than `from`.
+func (c *ParallelCounter) getRange(n int64) (from, to int64) {
+	size := c.rotatePoint + 1
+	if n > size {
+		// numbers in the whole round will all be reused,
+		// only the last round matters
+		n = (n-1)%size + 1
+	}
+
+	c.Lock()
+	from = atomic.LoadInt64(&c.n)
+	to = from + n - 1
+	if to > c.rotatePoint {
+		to -= size
+	}
+	if to+1 > c.rotatePoint {
+		atomic.StoreInt64(&c.n, 0)
+	} else {
+		atomic.StoreInt64(&c.n, to+1)
+	}
+	c.Unlock()
+
+	Logger.Debug("get range",
+		zap.Int64("n", n),
+		zap.Int64("from", from),
+		zap.Int64("to", to))
+	return
+}
+
 // GetChild create new child
 func (c *ParallelCounter) GetChild() *ChildParallelCounter {
 	cc := &ChildParallelCounter{
-		lockID: rand.Int63(),
-		p:      c,
+		p: c,
 	}
-	cc.n, cc.maxN = c.GetQuote(c.quoteStep)
+	q := &childQuote{}
+	q.n, q.maxN = c.GetQuote(c.quoteStep)
+	cc.q = unsafe.Pointer(q)
 	return cc
 }
 
+func (c *ChildParallelCounter) loadQuote() *childQuote {
+	return (*childQuote)(atomic.LoadPointer(&c.q))
+}
+
+// refill replace exhausted quote with new quote from parent.
+// only the first caller who find `old` exhausted will succeed.
+func (c *ChildParallelCounter) refill(old *childQuote) {
+	if c.loadQuote() != old {
+		return
+	}
+
+	q := &childQuote{}
+	q.n, q.maxN = c.p.GetQuote(0)
+	atomic.CompareAndSwapPointer(&c.q, unsafe.Pointer(old), unsafe.Pointer(q))
+}
+
 // Get get current count
 func (c *ChildParallelCounter) Get() int64 {
-	return atomic.LoadInt64(&c.n)
+	q := c.loadQuote()
+	if n := atomic.LoadInt64(&q.n); n < q.maxN {
+		return n
+	}
+
+	return q.maxN
 }
 
 // Count count 1
 func (c *ChildParallelCounter) Count() (r int64) {
-	c.RLock()
-	r = atomic.AddInt64(&c.n, 1)
-	cmax := atomic.LoadInt64(&c.maxN)
-	c.RUnlock()
-	if r > cmax {
-		// Logger.Info("try acquire child lock", zap.Int64("r", r), zap.Int64("lid", c.lockID))
-		c.Lock()
-		// Logger.Info("acquired child lock", zap.Int64("r", r), zap.Int64("lid", c.lockID))
-
-		// double check
-		r = atomic.AddInt64(&c.n, 1) % c.p.rotatePoint
-		cmax = atomic.LoadInt64(&c.maxN)
-		if r > cmax {
-			r, cmax = c.p.GetQuote(0)
-		}
-		atomic.StoreInt64(&c.n, r)
-		atomic.StoreInt64(&c.maxN, cmax)
-
-		// fmt.Println(">>", r, cmax)
-		// Logger.Info("release child lock", zap.Int64("r", r), zap.Int64("lid", c.lockID), zap.Int64("to", cmax))
-		c.Unlock()
-	}
-
+	_, r = c.CountNRange(1)
 	return r
 }
 
 // CountN count n
 func (c *ChildParallelCounter) CountN(n int64) (r int64) {
-	for i := int64(0); i < n-1; i++ {
-		c.Count()
+	_, r = c.CountNRange(n)
+	return r
+}
+
+// CountNRange count n and return the allocated range [from, to].
+//
+// cost of CountNRange not depends on n. if current quote can not satisfy n,
+// the rest of the quote will be abandoned, and small n will be counted
+// in new quote, big n will be reserved from parent directly.
+// if the range span the rotate point of parent, `to` will be less than `from`.
+func (c *ChildParallelCounter) CountNRange(n int64) (from, to int64) {
+	if n <= 0 {
+		to = c.Get()
+		return to, to
 	}
 
-	return c.Count()
+	for {
+		q := c.loadQuote()
+		to = atomic.AddInt64(&q.n, n)
+		from = to - n + 1
+		if to <= q.maxN {
+			return from, to
+		}
+
+		if n >= c.p.quoteStep {
+			from, to = c.p.getRange(n)
+			c.refill(q)
+			return from, to
+		}
+
+		c.refill(q)
+	}
 }
@@ -291,6 +291,73 @@ func TestParallelRotateCounter(t *testing.T) {
 	}
 }
 
+func TestChildParallelCounterCountNRange(t *testing.T) {
+	var err error
+	if err = Logger.ChangeLevel("info"); err != nil {
+		t.Fatalf("set level: %+v", err)
+	}
+	pcounter, err := NewParallelCounter(10, 100)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	counter := pcounter.GetChild()
+
+	from, to := counter.CountNRange(5)
+	if to-from != 4 {
+		t.Fatalf("got range [%v, %v]", from, to)
+	}
+	if got := counter.Get(); got != to {
+		t.Fatalf("want %v, got %v", to, got)
+	}
+
+	// bigger than quote step
+	from, to = counter.CountNRange(30)
+	if to-from != 29 {
+		t.Fatalf("got range [%v, %v]", from, to)
+	}
+
+	// span rotate point
+	from, to = counter.CountNRange(90)
+	if to >= from || to-from+101 != 89 {
+		t.Fatalf("got range [%v, %v]", from, to)
+	}
+
+	// much bigger than rotate point
+	from, to = counter.CountNRange(1000000)
+	if from < 0 || from > 100 || to < 0 || to > 100 {
+		t.Fatalf("got range [%v, %v]", from, to)
+	}
+
+	// ranges should not overlap
+	if pcounter, err = NewParallelCounter(10, 100000000); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		seen = map[int64]struct{}{}
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cc := pcounter.GetChild()
+			for j := 0; j < 1000; j++ {
+				from, to := cc.CountNRange(int64(j%20 + 1))
+				mu.Lock()
+				for n := from; n <= to; n++ {
+					if _, ok := seen[n]; ok {
+						t.Errorf("duplicate number %v", n)
+					}
+					seen[n] = struct{}{}
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
 func TestRotateCounterFromN(t *testing.T) {
 	counter, err := NewRotateCounterFromN(2, 10)
 	if err != nil {
@@ -617,3 +684,37 @@ func BenchmarkAllCounter(b *testing.B) {
 	})
 
 }
+
+/*BenchmarkChildCounterCountN
+
+cost of ChildParallelCounter.CountN should not grow with n
+*/
+func BenchmarkChildCounterCountN(b *testing.B) {
+	b.ReportAllocs()
+	var err error
+	if err = Logger.ChangeLevel("info"); err != nil {
+		b.Fatalf("set level: %+v", err)
+	}
+	parallelCounter, err := NewParallelCounter(1000, 100000000)
+	if err != nil {
+		b.Fatalf("got error: %+v", err)
+	}
+
+	for _, n := range []int64{1, 500, 10000, 1000000} {
+		n := n
+		b.Run(fmt.Sprintf("count %d", n), func(b *testing.B) {
+			cc := parallelCounter.GetChild()
+			for i := 0; i < b.N; i++ {
+				cc.CountN(n)
+			}
+		})
+		b.Run(fmt.Sprintf("parallel count %d", n), func(b *testing.B) {
+			cc := parallelCounter.GetChild()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					cc.CountN(n)
+				}
+			})
+		})
+	}
+}
@@ -1,6 +1,13 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"io"
+	"path/filepath"
+	"text/template"
+
 	zap "github.com/Laisky/zap"
 	"github.com/pkg/errors"
 	gomail "gopkg.in/gomail.v2"
@@ -30,35 +37,373 @@ func (m *Mail) Login(username, password string) {
 }
 
 // BuildMessage implement
+//
+// Deprecated: use NewMailMessage to build message
 func (m *Mail) BuildMessage(msg string) string {
 	return msg
 }
 
-// Send send email
+// Send send plain text email to single recipient
 func (m *Mail) Send(frAddr, toAddr, frName, toName, subject, content string) (err error) {
 	Logger.Info("send email", zap.String("toName", toName))
-	s := gomail.NewMessage()
-	s.SetAddressHeader("From", frAddr, frName)
-	s.SetAddressHeader("To", toAddr, toName)
-	s.SetHeader("Subject", subject)
-	s.SetBody("text/plain", content)
+	return m.SendMessage(NewMailMessage().
+		From(frAddr, frName).
+		To(toAddr, toName).
+		RawSubject(subject).
+		RawTextBody(content))
+}
+
+// buildToSend build messages, messages are only logged in dry mode
+func (m *Mail) buildToSend(msgs []*MailMessage) (toSend []*MailMessage, gmsgs []*gomail.Message, err error) {
+	dry := Settings.GetBool("dry")
+	for _, msg := range msgs {
+		gmsg, err := msg.Build()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "build message")
+		}
+
+		if dry {
+			from, to, _ := msg.Envelope()
+			Logger.Info("try to send email",
+				zap.String("from", from),
+				zap.Strings("to", to),
+				zap.Strings("subject", gmsg.GetHeader("Subject")),
+			)
+			continue
+		}
+
+		toSend = append(toSend, msg)
+		gmsgs = append(gmsgs, gmsg)
+	}
+
+	return toSend, gmsgs, nil
+}
+
+// SendMessage send messages in one connection
+func (m *Mail) SendMessage(msgs ...*MailMessage) (err error) {
+	_, gmsgs, err := m.buildToSend(msgs)
+	if err != nil {
+		return err
+	}
+	if len(gmsgs) == 0 {
+		return nil
+	}
 
 	d := gomail.NewDialer(m.host, m.port, m.username, m.password)
+	if err := d.DialAndSend(gmsgs...); err != nil {
+		return errors.Wrap(err, "try to send email got error")
+	}
 
-	if Settings.GetBool("dry") {
-		Logger.Info("try to send email",
-			zap.String("fromAddr", frAddr),
-			zap.String("toAddr", toAddr),
-			zap.String("frName", frName),
-			zap.String("toName", toName),
-			zap.String("subject", subject),
-			zap.String("content", content),
-		)
-	} else {
-		if err := d.DialAndSend(s); err != nil {
+	return nil
+}
+
+// SendMessageCtx send messages in one connection, interrupted when ctx done.
+//
+// like `SendMessage`, connect by TLS directly if port is 465,
+// otherwise upgrade by STARTTLS if server support.
+func (m *Mail) SendMessageCtx(ctx context.Context, msgs ...*MailMessage) (err error) {
+	toSend, gmsgs, err := m.buildToSend(msgs)
+	if err != nil {
+		return err
+	}
+	if len(gmsgs) == 0 {
+		return nil
+	}
+
+	opts := []SMTPTransportOptFunc{WithSMTPTLSMode(MailTLSStartTLSOptional)}
+	if m.port == 465 {
+		opts[0] = WithSMTPTLSMode(MailTLSImplicit)
+	}
+	if m.username != "" {
+		opts = append(opts, WithSMTPAuth(m.username, m.password))
+	}
+	transport, err := NewSMTPTransport(m.host, m.port, opts...)
+	if err != nil {
+		return errors.Wrap(err, "new smtp transport")
+	}
+	defer transport.Close()
+
+	for i, msg := range toSend {
+		from, to, _ := msg.Envelope()
+		if err = transport.Send(ctx, from, to, gmsgs[i]); err != nil {
 			return errors.Wrap(err, "try to send email got error")
 		}
 	}
 
 	return nil
 }
+
+// MailAddress email address with optional display name
+type MailAddress struct {
+	Addr, Name string
+}
+
+type mailAttachment struct {
+	name   string
+	data   []byte
+	fs     FS
+	fpath  string
+	inline bool
+}
+
+// MailMessage builder of email message.
+//
+// subject and plain text body are rendered by `text/template` unless set by
+// `RawSubject` or `RawTextBody`,
+// html body is rendered by `html/template`, both with data set by `Data`.
+// errors are returned by `Build`.
+type MailMessage struct {
+	from                MailAddress
+	to, cc, bcc         []MailAddress
+	subject, text, html string
+	// subjectRaw, textRaw whether to send subject or text without rendering
+	subjectRaw, textRaw bool
+	data                map[string]interface{}
+	headers             map[string][]string
+	attachments         []*mailAttachment
+}
+
+// NewMailMessage create new message builder
+func NewMailMessage() *MailMessage {
+	return &MailMessage{
+		headers: map[string][]string{},
+	}
+}
+
+// From set sender
+func (m *MailMessage) From(addr, name string) *MailMessage {
+	m.from = MailAddress{Addr: addr, Name: name}
+	return m
+}
+
+// To add recipient
+func (m *MailMessage) To(addr, name string) *MailMessage {
+	m.to = append(m.to, MailAddress{Addr: addr, Name: name})
+	return m
+}
+
+// Cc add carbon copy recipient
+func (m *MailMessage) Cc(addr, name string) *MailMessage {
+	m.cc = append(m.cc, MailAddress{Addr: addr, Name: name})
+	return m
+}
+
+// Bcc add blind carbon copy recipient, not shown in headers
+func (m *MailMessage) Bcc(addr, name string) *MailMessage {
+	m.bcc = append(m.bcc, MailAddress{Addr: addr, Name: name})
+	return m
+}
+
+// Subject set subject template
+func (m *MailMessage) Subject(tpl string) *MailMessage {
+	m.subject = tpl
+	m.subjectRaw = false
+	return m
+}
+
+// RawSubject set subject sent as is, without rendering
+func (m *MailMessage) RawSubject(subject string) *MailMessage {
+	m.subject = subject
+	m.subjectRaw = true
+	return m
+}
+
+// TextBody set plain text body template
+func (m *MailMessage) TextBody(tpl string) *MailMessage {
+	m.text = tpl
+	m.textRaw = false
+	return m
+}
+
+// RawTextBody set plain text body sent as is, without rendering
+func (m *MailMessage) RawTextBody(text string) *MailMessage {
+	m.text = text
+	m.textRaw = true
+	return m
+}
+
+// HTMLBody set html body template,
+// inline images can be referenced by `cid:<name>`.
+func (m *MailMessage) HTMLBody(tpl string) *MailMessage {
+	m.html = tpl
+	return m
+}
+
+// Data set data to render templates, like `{{.name}}`
+func (m *MailMessage) Data(data map[string]interface{}) *MailMessage {
+	m.data = data
+	return m
+}
+
+// Header set custom header
+func (m *MailMessage) Header(field string, values ...string) *MailMessage {
+	m.headers[field] = values
+	return m
+}
+
+// Attach attach data as file with name
+func (m *MailMessage) Attach(name string, data []byte) *MailMessage {
+	m.attachments = append(m.attachments, &mailAttachment{name: name, data: data})
+	return m
+}
+
+// AttachFile attach file on disk, file is read when building
+func (m *MailMessage) AttachFile(fpath string) *MailMessage {
+	return m.AttachFileFS(OSFS{}, fpath)
+}
+
+// AttachFileFS attach file in fsys, file is read when building
+func (m *MailMessage) AttachFileFS(fsys FS, fpath string) *MailMessage {
+	m.attachments = append(m.attachments, &mailAttachment{
+		name:  filepath.Base(fpath),
+		fs:    fsys,
+		fpath: fpath,
+	})
+	return m
+}
+
+// Embed add inline image, can be referenced in html body by `cid:<name>`
+func (m *MailMessage) Embed(name string, data []byte) *MailMessage {
+	m.attachments = append(m.attachments, &mailAttachment{name: name, data: data, inline: true})
+	return m
+}
+
+// Envelope return sender and all recipients (includes cc and bcc) used by SMTP,
+// return error if sender or recipients is empty
+func (m *MailMessage) Envelope() (from string, to []string, err error) {
+	if m.from.Addr == "" {
+		return "", nil, errors.Errorf("sender should not be empty")
+	}
+	for _, addrs := range [][]MailAddress{m.to, m.cc, m.bcc} {
+		for _, addr := range addrs {
+			to = append(to, addr.Addr)
+		}
+	}
+	if len(to) == 0 {
+		return "", nil, errors.Errorf("recipients should not be empty")
+	}
+
+	return m.from.Addr, to, nil
+}
+
+func (m *MailMessage) renderText(name, tpl string, raw bool) (string, error) {
+	if raw {
+		return tpl, nil
+	}
+
+	t, err := template.New(name).Parse(tpl)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse %s", name)
+	}
+
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, m.data); err != nil {
+		return "", errors.Wrapf(err, "render %s", name)
+	}
+
+	return buf.String(), nil
+}
+
+func (m *MailMessage) renderHTML(tpl string) (string, error) {
+	t, err := htmltemplate.New("html").Parse(tpl)
+	if err != nil {
+		return "", errors.Wrap(err, "parse html")
+	}
+
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, m.data); err != nil {
+		return "", errors.Wrap(err, "render html")
+	}
+
+	return buf.String(), nil
+}
+
+// Build render templates and build message
+func (m *MailMessage) Build() (msg *gomail.Message, err error) {
+	if _, _, err = m.Envelope(); err != nil {
+		return nil, err
+	}
+
+	msg = gomail.NewMessage()
+	msg.SetHeaders(m.headers)
+	msg.SetAddressHeader("From", m.from.Addr, m.from.Name)
+	for _, h := range []struct {
+		field string
+		addrs []MailAddress
+	}{
+		{"To", m.to},
+		{"Cc", m.cc},
+		{"Bcc", m.bcc},
+	} {
+		if len(h.addrs) == 0 {
+			continue
+		}
+
+		vs := make([]string, 0, len(h.addrs))
+		for _, addr := range h.addrs {
+			vs = append(vs, msg.FormatAddress(addr.Addr, addr.Name))
+		}
+		msg.SetHeader(h.field, vs...)
+	}
+
+	subject, err := m.renderText("subject", m.subject, m.subjectRaw)
+	if err != nil {
+		return nil, err
+	}
+	msg.SetHeader("Subject", subject)
+
+	// plain text should be the first alternative
+	if m.text != "" || m.html == "" {
+		text, err := m.renderText("text", m.text, m.textRaw)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.SetBody("text/plain", text)
+	}
+	if m.html != "" {
+		html, err := m.renderHTML(m.html)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.text != "" {
+			msg.AddAlternative("text/html", html)
+		} else {
+			msg.SetBody("text/html", html)
+		}
+	}
+
+	for _, att := range m.attachments {
+		data := att.data
+		if att.fpath != "" {
+			if data, err = readFileFS(att.fs, att.fpath); err != nil {
+				return nil, errors.Wrapf(err, "read attachment `%s`", att.fpath)
+			}
+		}
+
+		settings := []gomail.FileSetting{
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		}
+		if att.inline {
+			msg.Embed(att.name, settings...)
+		} else {
+			msg.Attach(att.name, settings...)
+		}
+	}
+
+	return msg, nil
+}
+
+// WriteTo build message and write MIME content into w, Bcc header is omitted
+func (m *MailMessage) WriteTo(w io.Writer) (n int64, err error) {
+	msg, err := m.Build()
+	if err != nil {
+		return 0, err
+	}
+
+	return msg.WriteTo(w)
+}
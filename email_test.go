@@ -1,6 +1,17 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
 	"github.com/Laisky/zap"
 )
 
@@ -17,3 +28,151 @@ func ExampleMail() {
 		Logger.Error("try to send email got error", zap.Error(err))
 	}
 }
+
+func TestMailMessage(t *testing.T) {
+	fsys := NewMemFS()
+	if err := fsys.MkdirAll("/data", 0755); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := writeFileFS(fsys, "/data/memo.txt", []byte("memo"), 0644); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	msg := NewMailMessage().
+		From("from@example.com", "Sender").
+		To("to1@example.com", "To One").
+		To("to2@example.com", "").
+		Cc("cc@example.com", "").
+		Bcc("bcc@example.com", "").
+		Subject("hello {{.name}}").
+		TextBody("hi {{.name}}").
+		HTMLBody(`<p>hi {{.name}}</p><img src="cid:logo.png">`).
+		Data(map[string]interface{}{"name": "<laisky>"}).
+		Header("X-Priority", "1").
+		Attach("report.txt", []byte("report")).
+		AttachFileFS(fsys, "/data/memo.txt").
+		Embed("logo.png", []byte("png"))
+
+	from, to, err := msg.Envelope()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if from != "from@example.com" || strings.Join(to, ",") != "to1@example.com,to2@example.com,cc@example.com,bcc@example.com" {
+		t.Fatalf("got %s, %v", from, to)
+	}
+
+	var buf bytes.Buffer
+	if _, err = msg.WriteTo(&buf); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	m, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if m.Header.Get("Bcc") != "" || m.Header.Get("X-Priority") != "1" ||
+		m.Header.Get("Subject") != "hello <laisky>" ||
+		m.Header.Get("To") != `"To One" <to1@example.com>, to2@example.com` {
+		t.Fatalf("got %v", m.Header)
+	}
+
+	// multipart/mixed [multipart/related [multipart/alternative [text, html], image], attachment]
+	parts := map[string]string{}
+	var walk func(r io.Reader, contentType, filename string)
+	walk = func(r io.Reader, contentType, filename string) {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			cnt, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			if filename != "" {
+				mediaType = filename
+			}
+			parts[mediaType] = string(cnt)
+			return
+		}
+
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			var body io.Reader = p
+			if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+				body = base64.NewDecoder(base64.StdEncoding, p)
+			} else if p.Header.Get("Content-Transfer-Encoding") == "quoted-printable" {
+				body = quotedprintable.NewReader(p)
+			}
+			walk(body, p.Header.Get("Content-Type"), p.FileName())
+		}
+	}
+	walk(m.Body, m.Header.Get("Content-Type"), "")
+
+	if parts["text/plain"] != "hi <laisky>" ||
+		parts["text/html"] != `<p>hi &lt;laisky&gt;</p><img src="cid:logo.png">` ||
+		parts["logo.png"] != "png" ||
+		parts["report.txt"] != "report" ||
+		parts["memo.txt"] != "memo" {
+		t.Fatalf("got %v", parts)
+	}
+	if len(parts) != 5 {
+		t.Fatalf("got %v", parts)
+	}
+
+	if _, err = NewMailMessage().To("to@example.com", "").Build(); err == nil {
+		t.Fatal("should error without sender")
+	}
+	if _, err = NewMailMessage().From("from@example.com", "").Build(); err == nil {
+		t.Fatal("should error without recipients")
+	}
+	if _, err = NewMailMessage().
+		From("from@example.com", "").
+		To("to@example.com", "").
+		TextBody("{{.name").
+		Build(); err == nil {
+		t.Fatal("should error with invalid template")
+	}
+}
+
+func TestMailSendRaw(t *testing.T) {
+	srv := newTestSMTPServer(t)
+	defer srv.ln.Close()
+
+	sender := NewMail("127.0.0.1", srv.port())
+	if err := sender.Send(
+		"from@example.com",
+		"to@example.com",
+		"",
+		"",
+		"raw {{ subject",
+		"raw {{.name}} content",
+	); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.msgs) != 1 {
+		t.Fatalf("got %d messages", len(srv.msgs))
+	}
+	m, err := mail.ReadMessage(strings.NewReader(srv.msgs[0]))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	cnt, err := ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if m.Header.Get("Subject") != "raw {{ subject" ||
+		strings.TrimSpace(string(cnt)) != "raw {{.name}} content" {
+		t.Fatalf("got %v, %s", m.Header, cnt)
+	}
+}
@@ -2,27 +2,81 @@ package utils
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Laisky/zap"
+	"github.com/cespare/xxhash"
 	"github.com/pkg/errors"
 )
 
 const (
-	defaultEventEngineNFork         int = 2
-	defaultEventEngineMsgBufferSize int = 1
+	defaultEventEngineNFork          int     = 2
+	defaultEventEngineMsgBufferSize  int     = 1
+	defaultEventEngineDeadLetterSize int     = 1000
+	defaultEventRetryMultiplier      float64 = 2
+)
+
+// EventEngineOverflowPolicy what to do when the event queue is full
+type EventEngineOverflowPolicy int
+
+const (
+	// EventEngineOverflowBlock block publisher until the queue has free space
+	EventEngineOverflowBlock EventEngineOverflowPolicy = iota
+	// EventEngineOverflowDropNewest discard the event being published
+	EventEngineOverflowDropNewest
+	// EventEngineOverflowDropOldest discard the oldest event in queue
+	EventEngineOverflowDropOldest
+	// EventEngineOverflowError return ErrEventEngineQueueFull to publisher
+	EventEngineOverflowError
+)
+
+var (
+	// ErrEventEngineQueueFull event queue is full
+	ErrEventEngineQueueFull = errors.New("event queue is full")
+	// ErrEventEngineClosed event engine is closed
+	ErrEventEngineClosed = errors.New("event engine is closed")
+	// ErrEventNoReply no handler replied to request
+	ErrEventNoReply = errors.New("no handler replied")
+)
+
+const (
+	// EventTopicSeparator separator of levels in topic
+	EventTopicSeparator = "."
+	// EventTopicWildcardOne match exactly one level in topic
+	EventTopicWildcardOne = "*"
+	// EventTopicWildcardAny match zero or more levels in topic
+	EventTopicWildcardAny = "#"
 )
 
 // EventTopic topic of event
+//
+// topic used to register handler can be a pattern like `order.*` or `order.#`,
+// levels are separated by `.`, `*` match exactly one level,
+// `#` match zero or more levels.
 type EventTopic string
 
 func (h EventTopic) String() string {
 	return string(h)
 }
 
+// IsPattern whether topic contains wildcard
+func (h EventTopic) IsPattern() bool {
+	for _, level := range strings.Split(string(h), EventTopicSeparator) {
+		if level == EventTopicWildcardOne || level == EventTopicWildcardAny {
+			return true
+		}
+	}
+
+	return false
+}
+
 // HandlerID id(name) of event handler
 type HandlerID string
 
@@ -48,23 +102,176 @@ type Event struct {
 	Stack string
 }
 
+// eventEnvelope event being processed in engine
+type eventEnvelope struct {
+	evt *Event
+	// offset in EventLog
+	offset int64
+	// refs number of holders (queue/dispatcher and tasks),
+	// event is finished when refs reach 0
+	refs int32
+	// waiter publisher waiting for results, could be nil
+	waiter *eventWaiter
+}
+
+// eventWaiter collect results of all handlers of one event
+type eventWaiter struct {
+	sync.Mutex
+	results []*EventHandlerResult
+	// dropped event discarded by overflow policy
+	dropped bool
+	// replied first response of replier
+	replied chan *EventHandlerResult
+	// done closed when all handlers finished
+	done chan struct{}
+}
+
+func newEventWaiter() *eventWaiter {
+	return &eventWaiter{
+		replied: make(chan *EventHandlerResult, 1),
+		done:    make(chan struct{}),
+	}
+}
+
 // EventHandler function to handle event
 type EventHandler func(*Event)
 
+// EventHandlerWithErr function to handle event, return error if failed.
+//
+// failed handler will be retried by its EventRetryPolicy,
+// then be put into dead letters.
+type EventHandlerWithErr func(*Event) error
+
+// EventReplyHandler function to handle event and reply response to requester,
+// see `EventEngine.Request`
+type EventReplyHandler func(*Event) (resp interface{}, err error)
+
+// EventHandlerResult result of one handler, see `EventEngine.PublishAndWait`
+type EventHandlerResult struct {
+	HandlerID HandlerID
+	// Resp response of EventReplyHandler, nil for other handlers
+	Resp interface{}
+	// Err last error returned by handler, nil if succeed
+	Err error
+
+	replier bool
+}
+
+// EventRetryPolicy retry policy of event handler
+type EventRetryPolicy struct {
+	// MaxRetry max number of retries after the first failure
+	MaxRetry int
+	// Backoff wait duration before the first retry
+	Backoff time.Duration
+	// MaxBackoff max wait duration between retries, no limit if 0
+	MaxBackoff time.Duration
+	// Multiplier backoff grow factor after each retry, default 2
+	Multiplier float64
+}
+
+// backoff return wait duration before nth(from 0) retry
+func (p *EventRetryPolicy) backoff(n int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = defaultEventRetryMultiplier
+	}
+
+	d := float64(p.Backoff) * math.Pow(multiplier, float64(n))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	if d >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+
+	return time.Duration(d)
+}
+
+// eventHandler registered handler
+type eventHandler struct {
+	h     EventReplyHandler
+	retry EventRetryPolicy
+	// replier whether handler can reply to requester
+	replier bool
+}
+
+// EventHandlerOptFunc options for registered handler
+type EventHandlerOptFunc func(*eventHandler) error
+
+// WithEventHandlerRetry set retry policy of handler
+func WithEventHandlerRetry(policy EventRetryPolicy) EventHandlerOptFunc {
+	return func(h *eventHandler) error {
+		if policy.MaxRetry < 0 {
+			return errors.Errorf("MaxRetry must >= 0")
+		}
+		if policy.Backoff < 0 || policy.MaxBackoff < 0 {
+			return errors.Errorf("backoff must >= 0")
+		}
+
+		h.retry = policy
+		return nil
+	}
+}
+
+// EventMetaKeyDeadLetter key of dead letter in meta of event published to dead letter topic
+const EventMetaKeyDeadLetter MetaKey = "dead_letter"
+
+// EventDeadLetter event that failed to be handled after all retries
+type EventDeadLetter struct {
+	ID        int64
+	Event     *Event
+	HandlerID HandlerID
+	// Err last error returned by handler
+	Err error
+	// Attempts number of times the handler has been called
+	Attempts int
+	Time     time.Time
+
+	h *eventHandler
+}
+
 // EventEngine type of event store
 type EventEngine struct {
 	*eventStoreManagerOpt
-	q chan *Event
+	q chan *eventEnvelope
+	// dropped number of events discarded by overflow policy
+	dropped *Counter
+
+	closeMu sync.RWMutex
+	closed  bool
+	// unfinished number of accepted events not finished
+	unfinished *Counter
+	// finished all accepted events finished
+	finished sync.WaitGroup
+	cancel   context.CancelFunc
 
 	// topic2hs map[topic]*sync.Map[handlerID]handler
 	topic2hs *sync.Map
+	// patterns handlers registered with wildcard topic
+	patterns *eventTopicTrie
+
+	ctx      context.Context
+	taskChan chan *eventRunChanItem
+	// partitions tasks of events with the same order key go to the same partition
+	partitions []chan *eventRunChanItem
+
+	deadLettersMu sync.Mutex
+	deadLetters   []*EventDeadLetter
+	deadLetterID  *Counter
 }
 
 type eventStoreManagerOpt struct {
+	log           *EventLog
 	msgBufferSize int
 	nfork         int
 	logger        *LoggerType
 	suppressPanic bool
+	disableStack  bool
+	overflow      EventEngineOverflowPolicy
+
+	deadLetterSize  int
+	deadLetterTopic EventTopic
+	orderKey        MetaKey
 }
 
 // EventEngineOptFunc options for EventEngine
@@ -114,112 +321,525 @@ func WithEventEngineSuppressPanic(suppressPanic bool) EventEngineOptFunc {
 	}
 }
 
+// WithEventEngineDisableStack set whether to skip capturing stack on publish.
+//
+// `debug.Stack()` is expensive, disable it on hot path.
+func WithEventEngineDisableStack(disable bool) EventEngineOptFunc {
+	return func(opt *eventStoreManagerOpt) error {
+		opt.disableStack = disable
+		return nil
+	}
+}
+
+// WithEventEngineOverflowPolicy set what to do when the event queue is full
+func WithEventEngineOverflowPolicy(policy EventEngineOverflowPolicy) EventEngineOptFunc {
+	return func(opt *eventStoreManagerOpt) error {
+		switch policy {
+		case EventEngineOverflowBlock,
+			EventEngineOverflowDropNewest,
+			EventEngineOverflowDropOldest,
+			EventEngineOverflowError:
+		default:
+			return errors.Errorf("unknown overflow policy %d", policy)
+		}
+
+		opt.overflow = policy
+		return nil
+	}
+}
+
+// WithEventEngineDeadLetterSize set max number of dead letters kept in memory,
+// oldest dead letter will be discarded when exceeded.
+// set 0 to disable dead letters queue.
+func WithEventEngineDeadLetterSize(size int) EventEngineOptFunc {
+	return func(opt *eventStoreManagerOpt) error {
+		if size < 0 {
+			return errors.Errorf("size must >= 0")
+		}
+
+		opt.deadLetterSize = size
+		return nil
+	}
+}
+
+// WithEventEngineDeadLetterTopic publish dead letters to topic,
+// dead letter will be put in event's Meta with key EventMetaKeyDeadLetter.
+//
+// dead letter of events in this topic will not be published again.
+func WithEventEngineDeadLetterTopic(topic EventTopic) EventEngineOptFunc {
+	return func(opt *eventStoreManagerOpt) error {
+		if topic == "" {
+			return errors.Errorf("topic is empty")
+		}
+		if topic.IsPattern() {
+			return errors.Errorf("dead letter topic should not be pattern")
+		}
+
+		opt.deadLetterTopic = topic
+		return nil
+	}
+}
+
+// WithEventEngineLog write events to log before dispatch.
+//
+// events not handled before crash or shutdown will be replayed by `ReplayLog`,
+// each handler will get at-least-once delivery.
+func WithEventEngineLog(log *EventLog) EventEngineOptFunc {
+	return func(opt *eventStoreManagerOpt) error {
+		if log == nil {
+			return errors.Errorf("log is nil")
+		}
+
+		opt.log = log
+		return nil
+	}
+}
+
+// WithEventEngineOrderKey partition dispatch by `Meta[key]`,
+// events with the same key will be handled serially in publish order,
+// events with different keys still run in parallel.
+//
+// events without the key will be handled by any runner.
+func WithEventEngineOrderKey(key MetaKey) EventEngineOptFunc {
+	return func(opt *eventStoreManagerOpt) error {
+		if key == "" {
+			return errors.Errorf("key is empty")
+		}
+
+		opt.orderKey = key
+		return nil
+	}
+}
+
 // NewEventEngine new event store manager
 func NewEventEngine(ctx context.Context, opts ...EventEngineOptFunc) (e *EventEngine, err error) {
 	opt := &eventStoreManagerOpt{
-		msgBufferSize: defaultEventEngineMsgBufferSize,
-		nfork:         defaultEventEngineNFork,
-		logger:        Logger.Named("evt-store-" + RandomStringWithLength(6)),
+		msgBufferSize:  defaultEventEngineMsgBufferSize,
+		nfork:          defaultEventEngineNFork,
+		deadLetterSize: defaultEventEngineDeadLetterSize,
+		logger:         Logger.Named("evt-store-" + RandomStringWithLength(6)),
 	}
 	for _, optf := range opts {
 		if err = optf(opt); err != nil {
 			return nil, err
 		}
 	}
+	if opt.overflow == EventEngineOverflowDropOldest && opt.msgBufferSize == 0 {
+		// unbuffered queue has no oldest event to drop
+		return nil, errors.Errorf("msgBufferSize must > 0 with EventEngineOverflowDropOldest")
+	}
 
 	e = &EventEngine{
 		eventStoreManagerOpt: opt,
-		q:                    make(chan *Event, opt.msgBufferSize),
+		q:                    make(chan *eventEnvelope, opt.msgBufferSize),
+		dropped:              NewCounter(),
+		unfinished:           NewCounter(),
 		topic2hs:             &sync.Map{},
+		patterns:             newEventTopicTrie(),
+		taskChan:             make(chan *eventRunChanItem, opt.msgBufferSize),
+		deadLetterID:         NewCounter(),
+	}
+	e.ctx, e.cancel = context.WithCancel(ctx)
+	if opt.orderKey != "" {
+		for i := 0; i < opt.nfork; i++ {
+			e.partitions = append(e.partitions, make(chan *eventRunChanItem, opt.msgBufferSize))
+		}
 	}
 
-	taskChan := make(chan *eventRunChanItem, opt.msgBufferSize)
-	e.startRunner(ctx, opt.nfork, taskChan)
-	e.run(ctx, taskChan)
+	e.startRunner(e.ctx, opt.nfork, e.taskChan)
+	e.run(e.ctx)
 	e.logger.Info("new event store",
 		zap.Int("nfork", opt.nfork),
-		zap.Int("buffer", opt.msgBufferSize))
+		zap.String("order_key", opt.orderKey.String()),
+		zap.Int("buffer", opt.msgBufferSize),
+		zap.Int("overflow", int(opt.overflow)))
 	return e, nil
 }
 
-func runHandlerWithoutPanic(h EventHandler, evt *Event) (err error) {
+func runHandlerWithoutPanic(h EventReplyHandler, evt *Event) (resp interface{}, err error) {
 	defer func() {
 		if erri := recover(); erri != nil {
 			err = errors.Errorf("run event handler with evt `%s`: %+v", evt.Topic, erri)
 		}
 	}()
 
-	h(evt)
-	return nil
+	return h(evt)
 }
 
 type eventRunChanItem struct {
-	h   EventHandler
+	h   *eventHandler
 	hid HandlerID
 	evt *Event
+	env *eventEnvelope
+	// tracked whether task is tracked by EventLog
+	tracked bool
+	// attempt number of failed attempts
+	attempt int
 }
 
 func (e *EventEngine) startRunner(ctx context.Context, nfork int, taskChan chan *eventRunChanItem) {
 	for i := 0; i < nfork; i++ {
 		logger := e.logger.Named(strconv.Itoa(i))
+		// nil channel never ready if not partitioned
+		var partition chan *eventRunChanItem
+		if len(e.partitions) != 0 {
+			partition = e.partitions[i]
+		}
+
 		go func() {
 			for {
 				select {
 				case <-ctx.Done():
 					return
 				case t := <-taskChan:
-					logger.Debug("trigger handler",
-						zap.String("evt", t.evt.Topic.String()),
-						zap.String("handler", t.hid.String()))
-
-					if e.suppressPanic {
-						if err := runHandlerWithoutPanic(t.h, t.evt); err != nil {
-							logger.Error("handler panic",
-								zap.String("handler", t.hid.String()),
-								zap.String("stack", t.evt.Stack),
-								zap.Error(err))
-						}
-					} else {
-						t.h(t.evt)
-					}
+					e.runTask(ctx, logger, t, false)
+				case t := <-partition:
+					e.runTask(ctx, logger, t, true)
 				}
 			}
 		}()
 	}
 }
 
+// runTask run handler with retry, put event into dead letters if all failed.
+//
+// unordered task waits for retry by timer without occupying runner,
+// ordered task waits in runner to keep the order of events in partition.
+func (e *EventEngine) runTask(ctx context.Context, logger *LoggerType, t *eventRunChanItem, ordered bool) {
+	for ; ; t.attempt++ {
+		logger.Debug("trigger handler",
+			zap.String("evt", t.evt.Topic.String()),
+			zap.String("handler", t.hid.String()),
+			zap.Int("attempt", t.attempt))
+		var (
+			resp interface{}
+			err  error
+		)
+		if e.suppressPanic {
+			resp, err = runHandlerWithoutPanic(t.h.h, t.evt)
+		} else {
+			resp, err = t.h.h(t.evt)
+		}
+		if err == nil {
+			e.reportResult(t, resp, nil)
+			e.finishTask(ctx, t)
+			return
+		}
+
+		if t.attempt >= t.h.retry.MaxRetry {
+			logger.Error("handler failed",
+				zap.String("handler", t.hid.String()),
+				zap.String("stack", t.evt.Stack),
+				zap.Int("attempts", t.attempt+1),
+				zap.Error(err))
+			e.putDeadLetter(t, err, t.attempt+1)
+			e.reportResult(t, nil, err)
+			e.finishTask(ctx, t)
+			return
+		}
+
+		backoff := t.h.retry.backoff(t.attempt)
+		logger.Debug("handler failed, retry later",
+			zap.String("handler", t.hid.String()),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+		if !ordered {
+			t.attempt++
+			e.retryTaskLater(ctx, t, backoff)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			e.reportResult(t, nil, ctx.Err())
+			e.finishTask(ctx, t)
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// retryTaskLater put task back to taskChan after backoff
+func (e *EventEngine) retryTaskLater(ctx context.Context, t *eventRunChanItem, backoff time.Duration) {
+	time.AfterFunc(backoff, func() {
+		select {
+		case <-ctx.Done():
+			e.reportResult(t, nil, ctx.Err())
+			e.finishTask(ctx, t)
+		case e.taskChan <- t:
+		}
+	})
+}
+
+// finishTask commit task to EventLog and release its envelope
+func (e *EventEngine) finishTask(ctx context.Context, t *eventRunChanItem) {
+	// task interrupted by ctx should be replayed
+	if t.tracked && ctx.Err() == nil {
+		e.log.untrack(t.hid, t.env.offset)
+	}
+
+	e.release(t.env)
+}
+
+// reportResult send result of task to publisher if it's waiting
+func (e *EventEngine) reportResult(t *eventRunChanItem, resp interface{}, err error) {
+	if t.env == nil || t.env.waiter == nil {
+		return
+	}
+
+	r := &EventHandlerResult{
+		HandlerID: t.hid,
+		Resp:      resp,
+		Err:       err,
+		replier:   t.h.replier,
+	}
+	w := t.env.waiter
+	w.Lock()
+	w.results = append(w.results, r)
+	w.Unlock()
+
+	if r.replier && err == nil {
+		select {
+		case w.replied <- r:
+		default: // already replied
+		}
+	}
+}
+
 // Run start EventEngine
-func (e *EventEngine) run(ctx context.Context, taskChan chan *eventRunChanItem) {
+func (e *EventEngine) run(ctx context.Context) {
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case evt := <-e.q:
-				hsi, ok := e.topic2hs.Load(evt.Topic)
-				if !ok || hsi == nil {
-					continue
-				}
+			case env := <-e.q:
+				e.dispatch(ctx, env, nil)
+			}
+		}
+	}()
+}
 
-				hsi.(*sync.Map).Range(func(hid, h interface{}) bool {
-					taskChan <- &eventRunChanItem{
-						h:   h.(EventHandler),
-						hid: hid.(HandlerID),
-						evt: evt,
-					}
+// dispatch send event to all its handlers that `filter` returns true,
+// release envelope held by dispatcher when done
+func (e *EventEngine) dispatch(ctx context.Context, env *eventEnvelope, filter func(HandlerID) bool) {
+	defer e.release(env)
+	evt := env.evt
+	taskChan := e.taskChanOf(evt)
+	for _, hs := range e.matchHandlers(evt.Topic) {
+		hs.Range(func(hid, h interface{}) bool {
+			if filter != nil && !filter(hid.(HandlerID)) {
+				return true
+			}
 
-					return true
-				})
+			t := &eventRunChanItem{
+				h:       h.(*eventHandler),
+				hid:     hid.(HandlerID),
+				evt:     evt,
+				env:     env,
+				tracked: e.log != nil,
+			}
+			if t.tracked {
+				e.log.track(t.hid, env.offset)
 			}
+
+			atomic.AddInt32(&env.refs, 1)
+			select {
+			case <-ctx.Done():
+				e.release(env)
+				return false
+			case taskChan <- t:
+			}
+
+			return true
+		})
+	}
+
+	if e.log != nil && ctx.Err() == nil {
+		e.log.markDispatched(env.offset)
+	}
+}
+
+// acquire create envelope for event, counted as unfinished until released.
+// return ErrEventEngineClosed if engine is closed.
+func (e *EventEngine) acquire(evt *Event) (*eventEnvelope, error) {
+	e.closeMu.RLock()
+	defer e.closeMu.RUnlock()
+	if e.closed {
+		return nil, ErrEventEngineClosed
+	}
+
+	e.finished.Add(1)
+	e.unfinished.Count()
+	return &eventEnvelope{
+		evt:  evt,
+		refs: 1,
+	}, nil
+}
+
+// release decrease holders of envelope, mark event finished if no holder left
+func (e *EventEngine) release(env *eventEnvelope) {
+	if atomic.AddInt32(&env.refs, -1) == 0 {
+		if env.waiter != nil {
+			close(env.waiter.done)
 		}
+
+		e.unfinished.CountN(-1)
+		e.finished.Done()
+	}
+}
+
+// Close stop accepting new events, wait until all queued events dispatched
+// and all running handlers finished, or ctx done.
+//
+// return the number of accepted events that not finished when ctx done,
+// handlers still running will be abandoned.
+func (e *EventEngine) Close(ctx context.Context) (dropped int64, err error) {
+	e.closeMu.Lock()
+	if e.closed {
+		e.closeMu.Unlock()
+		return 0, ErrEventEngineClosed
+	}
+	e.closed = true
+	e.closeMu.Unlock()
+
+	e.logger.Info("closing event engine", zap.Int64("unfinished", e.unfinished.Get()))
+	drained := make(chan struct{})
+	go func() {
+		e.finished.Wait()
+		close(drained)
 	}()
+
+	select {
+	case <-drained:
+	case <-e.ctx.Done(): // engine already stopped
+		dropped = e.unfinished.Get()
+	case <-ctx.Done():
+		dropped = e.unfinished.Get()
+		err = ctx.Err()
+	}
+	e.cancel()
+
+	if e.log != nil {
+		if serr := e.log.Sync(); serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	e.logger.Info("event engine closed", zap.Int64("dropped", dropped), zap.Error(err))
+	return dropped, err
+}
+
+// taskChanOf return the channel that tasks of evt should be sent to
+func (e *EventEngine) taskChanOf(evt *Event) chan *eventRunChanItem {
+	if len(e.partitions) == 0 {
+		return e.taskChan
+	}
+
+	key, ok := evt.Meta[e.orderKey]
+	if !ok {
+		return e.taskChan
+	}
+
+	return e.partitions[xxhash.Sum64String(fmt.Sprint(key))%uint64(len(e.partitions))]
+}
+
+// ReplayLog dispatch events in EventLog that not been handled when log opened,
+// each event will only be sent to handlers that have not committed it.
+//
+// should be called after all handlers registered.
+func (e *EventEngine) ReplayLog() (n int, err error) {
+	if e.log == nil {
+		return 0, errors.Errorf("event log is not enabled")
+	}
+
+	if err = e.log.replay(func(offset int64, evt *Event) error {
+		env, err := e.acquire(evt)
+		if err != nil {
+			return err
+		}
+
+		env.offset = offset
+		e.dispatch(e.ctx, env, func(hid HandlerID) bool {
+			return e.log.shouldReplay(hid, offset)
+		})
+		n++
+		return e.ctx.Err()
+	}); err != nil {
+		return n, errors.Wrap(err, "replay event log")
+	}
+
+	e.logger.Info("replay event log", zap.Int("n", n))
+	return n, nil
 }
 
-// Register register new handler to event store
+// matchHandlers return all handlers' map that subscribed to topic
+func (e *EventEngine) matchHandlers(topic EventTopic) (hss []*sync.Map) {
+	if hsi, _ := e.topic2hs.Load(topic); hsi != nil {
+		hss = append(hss, hsi.(*sync.Map))
+	}
+
+	return append(hss, e.patterns.match(topic)...)
+}
+
+// Register register new handler to event store,
+// topic can be a pattern contains wildcard `*` or `#`
 func (e *EventEngine) Register(topic EventTopic, handlerID HandlerID, handler EventHandler) {
-	hs := &sync.Map{}
-	actual, _ := e.topic2hs.LoadOrStore(topic, hs)
-	actual.(*sync.Map).Store(handlerID, handler)
+	e.register(topic, handlerID, &eventHandler{
+		h: func(evt *Event) (interface{}, error) {
+			handler(evt)
+			return nil, nil
+		},
+	})
+}
+
+// RegisterWithErr register new handler that may fail to event store,
+// topic can be a pattern contains wildcard `*` or `#`
+func (e *EventEngine) RegisterWithErr(topic EventTopic,
+	handlerID HandlerID,
+	handler EventHandlerWithErr,
+	opts ...EventHandlerOptFunc) error {
+	return e.registerWithOpts(topic, handlerID, &eventHandler{
+		h: func(evt *Event) (interface{}, error) {
+			return nil, handler(evt)
+		},
+	}, opts...)
+}
+
+// RegisterReplier register new handler that reply response to requester,
+// topic can be a pattern contains wildcard `*` or `#`
+func (e *EventEngine) RegisterReplier(topic EventTopic,
+	handlerID HandlerID,
+	handler EventReplyHandler,
+	opts ...EventHandlerOptFunc) error {
+	return e.registerWithOpts(topic, handlerID, &eventHandler{
+		h:       handler,
+		replier: true,
+	}, opts...)
+}
+
+func (e *EventEngine) registerWithOpts(topic EventTopic,
+	handlerID HandlerID,
+	h *eventHandler,
+	opts ...EventHandlerOptFunc) error {
+	for _, optf := range opts {
+		if err := optf(h); err != nil {
+			return err
+		}
+	}
+
+	e.register(topic, handlerID, h)
+	return nil
+}
+
+func (e *EventEngine) register(topic EventTopic, handlerID HandlerID, handler *eventHandler) {
+	if topic.IsPattern() {
+		e.patterns.load(topic, true).Store(handlerID, handler)
+	} else {
+		hs := &sync.Map{}
+		actual, _ := e.topic2hs.LoadOrStore(topic, hs)
+		actual.(*sync.Map).Store(handlerID, handler)
+	}
 
 	e.logger.Info("register handler",
 		zap.String("topic", topic.String()),
@@ -228,7 +848,11 @@ func (e *EventEngine) Register(topic EventTopic, handlerID HandlerID, handler Ev
 
 // UnRegister delete handler in event store
 func (e *EventEngine) UnRegister(topic EventTopic, handlerID HandlerID) {
-	if hsi, _ := e.topic2hs.Load(topic); hsi != nil {
+	if topic.IsPattern() {
+		if hs := e.patterns.load(topic, false); hs != nil {
+			hs.Delete(handlerID)
+		}
+	} else if hsi, _ := e.topic2hs.Load(topic); hsi != nil {
 		hsi.(*sync.Map).Delete(handlerID)
 	}
 
@@ -237,10 +861,426 @@ func (e *EventEngine) UnRegister(topic EventTopic, handlerID HandlerID) {
 		zap.String("handler", handlerID.String()))
 }
 
-// Publish publish new event
+// Publish publish new event, blocking behavior depends on overflow policy.
+//
+// errors are only logged, use PublishCtx or TryPublish to get them.
 func (e *EventEngine) Publish(evt *Event) {
+	if err := e.PublishCtx(context.Background(), evt); err != nil {
+		e.logger.Warn("publish event", zap.String("event", evt.Topic.String()), zap.Error(err))
+	}
+}
+
+// TryPublish publish new event without blocking.
+//
+// if the queue is full and overflow policy is EventEngineOverflowBlock,
+// return ErrEventEngineQueueFull.
+func (e *EventEngine) TryPublish(evt *Event) (err error) {
+	env, err := e.prepareEvent(evt)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			e.discard(env)
+		}
+	}()
+
+	select {
+	case e.q <- env:
+		e.logger.Debug("publish event", zap.String("event", evt.Topic.String()))
+		return nil
+	default:
+	}
+
+	if e.overflow == EventEngineOverflowBlock {
+		return ErrEventEngineQueueFull
+	}
+
+	return e.overflowPublish(context.Background(), env)
+}
+
+// PublishCtx publish new event,
+// blocking publisher will return with ctx.Err() when ctx done
+func (e *EventEngine) PublishCtx(ctx context.Context, evt *Event) (err error) {
+	env, err := e.prepareEvent(evt)
+	if err != nil {
+		return err
+	}
+
+	return e.publishEnvelope(ctx, env)
+}
+
+func (e *EventEngine) publishEnvelope(ctx context.Context, env *eventEnvelope) (err error) {
+	defer func() {
+		if err != nil {
+			e.discard(env)
+		}
+	}()
+
+	select {
+	case e.q <- env:
+		e.logger.Debug("publish event", zap.String("event", env.evt.Topic.String()))
+		return nil
+	default:
+	}
+
+	return e.overflowPublish(ctx, env)
+}
+
+// PublishAndWait publish new event and wait until all its handlers finished,
+// return results of all handlers.
+//
+// return ErrEventEngineQueueFull if event is discarded by overflow policy.
+func (e *EventEngine) PublishAndWait(ctx context.Context, evt *Event) ([]*EventHandlerResult, error) {
+	w, err := e.publishWithWaiter(ctx, evt)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-w.done:
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if w.dropped {
+		return nil, ErrEventEngineQueueFull
+	}
+
+	return w.results, nil
+}
+
+// Request publish new event and wait for the first response
+// from handlers registered by `RegisterReplier`.
+//
+// use ctx to set timeout. return the first error of repliers,
+// or ErrEventNoReply if no replier subscribed to the event.
+func (e *EventEngine) Request(ctx context.Context, evt *Event) (resp interface{}, err error) {
+	w, err := e.publishWithWaiter(ctx, evt)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-w.replied:
+		return r.Resp, nil
+	case <-w.done:
+	}
+
+	select {
+	case r := <-w.replied:
+		return r.Resp, nil
+	default:
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if w.dropped {
+		return nil, ErrEventEngineQueueFull
+	}
+	for _, r := range w.results {
+		if r.Err != nil && r.replier {
+			return nil, r.Err
+		}
+	}
+
+	return nil, ErrEventNoReply
+}
+
+func (e *EventEngine) publishWithWaiter(ctx context.Context, evt *Event) (*eventWaiter, error) {
+	env, err := e.prepareEvent(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	env.waiter = newEventWaiter()
+	if err = e.publishEnvelope(ctx, env); err != nil {
+		return nil, err
+	}
+
+	return env.waiter, nil
+}
+
+// DroppedCount return the number of events discarded by overflow policy
+func (e *EventEngine) DroppedCount() int64 {
+	return e.dropped.Get()
+}
+
+func (e *EventEngine) prepareEvent(evt *Event) (env *eventEnvelope, err error) {
+	if env, err = e.acquire(evt); err != nil {
+		return nil, err
+	}
+
 	evt.Time = Clock.GetUTCNow()
-	evt.Stack = string(debug.Stack())
-	e.q <- evt
-	e.logger.Debug("publish event", zap.String("event", evt.Topic.String()))
+	if !e.disableStack {
+		evt.Stack = string(debug.Stack())
+	}
+
+	if e.log != nil {
+		if env.offset, err = e.log.Append(evt); err != nil {
+			e.release(env)
+			return nil, errors.Wrap(err, "append event to log")
+		}
+	}
+
+	return env, nil
+}
+
+// discard give up event that will never be dispatched
+func (e *EventEngine) discard(env *eventEnvelope) {
+	if e.log != nil {
+		e.log.markDispatched(env.offset)
+	}
+	if env.waiter != nil {
+		env.waiter.Lock()
+		env.waiter.dropped = true
+		env.waiter.Unlock()
+	}
+
+	e.release(env)
+}
+
+// overflowPublish publish event when queue is full
+func (e *EventEngine) overflowPublish(ctx context.Context, env *eventEnvelope) error {
+	switch e.overflow {
+	case EventEngineOverflowDropNewest:
+		e.discard(env)
+		e.dropped.Count()
+		e.logger.Debug("queue is full, drop newest event", zap.String("event", env.evt.Topic.String()))
+		return nil
+	case EventEngineOverflowError:
+		return ErrEventEngineQueueFull
+	case EventEngineOverflowDropOldest:
+		for {
+			select {
+			case e.q <- env:
+				e.logger.Debug("publish event", zap.String("event", env.evt.Topic.String()))
+				return nil
+			default:
+			}
+
+			select {
+			case old := <-e.q:
+				e.discard(old)
+				e.dropped.Count()
+				e.logger.Debug("queue is full, drop oldest event", zap.String("event", old.evt.Topic.String()))
+			default:
+			}
+		}
+	default: // EventEngineOverflowBlock
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e.q <- env:
+			e.logger.Debug("publish event", zap.String("event", env.evt.Topic.String()))
+			return nil
+		}
+	}
+}
+
+// putDeadLetter save failed task to dead letters,
+// and publish it to dead letter topic if configured
+func (e *EventEngine) putDeadLetter(t *eventRunChanItem, err error, attempts int) {
+	dl := &EventDeadLetter{
+		ID:        e.deadLetterID.Count(),
+		Event:     t.evt,
+		HandlerID: t.hid,
+		Err:       err,
+		Attempts:  attempts,
+		Time:      Clock.GetUTCNow(),
+		h:         t.h,
+	}
+
+	if e.deadLetterSize > 0 {
+		e.deadLettersMu.Lock()
+		if len(e.deadLetters) >= e.deadLetterSize {
+			e.deadLetters = e.deadLetters[len(e.deadLetters)-e.deadLetterSize+1:]
+		}
+		e.deadLetters = append(e.deadLetters, dl)
+		e.deadLettersMu.Unlock()
+	}
+
+	if e.deadLetterTopic != "" && t.evt.Topic != e.deadLetterTopic {
+		// should not block runner, or runner may deadlock with itself
+		if perr := e.TryPublish(&Event{
+			Topic: e.deadLetterTopic,
+			Meta: EventMeta{
+				EventMetaKeyDeadLetter: dl,
+			},
+		}); perr != nil {
+			e.logger.Warn("publish dead letter",
+				zap.String("handler", t.hid.String()),
+				zap.Error(perr))
+		}
+	}
+}
+
+// ListDeadLetters return all dead letters kept in memory
+func (e *EventEngine) ListDeadLetters() []*EventDeadLetter {
+	e.deadLettersMu.Lock()
+	dls := make([]*EventDeadLetter, len(e.deadLetters))
+	copy(dls, e.deadLetters)
+	e.deadLettersMu.Unlock()
+	return dls
+}
+
+// RemoveDeadLetters remove dead letters by id, remove all if ids is empty
+func (e *EventEngine) RemoveDeadLetters(ids ...int64) (removed []*EventDeadLetter) {
+	idset := map[int64]struct{}{}
+	for _, id := range ids {
+		idset[id] = struct{}{}
+	}
+
+	e.deadLettersMu.Lock()
+	remains := e.deadLetters[:0]
+	for _, dl := range e.deadLetters {
+		if _, ok := idset[dl.ID]; ok || len(ids) == 0 {
+			removed = append(removed, dl)
+		} else {
+			remains = append(remains, dl)
+		}
+	}
+	e.deadLetters = remains
+	e.deadLettersMu.Unlock()
+
+	return removed
+}
+
+// ReplayDeadLetters remove dead letters by id and run their handlers again,
+// replay all if ids is empty.
+//
+// handler will be run even if it has been unregistered,
+// dead letter will be put back if failed again.
+func (e *EventEngine) ReplayDeadLetters(ids ...int64) (n int, err error) {
+	dls := e.RemoveDeadLetters(ids...)
+	for i, dl := range dls {
+		var env *eventEnvelope
+		if env, err = e.acquire(dl.Event); err == nil {
+			select {
+			case <-e.ctx.Done():
+				e.release(env)
+				err = e.ctx.Err()
+			case e.taskChanOf(dl.Event) <- &eventRunChanItem{
+				h:   dl.h,
+				hid: dl.HandlerID,
+				evt: dl.Event,
+				env: env,
+			}:
+				n++
+				continue
+			}
+		}
+
+		// put back dead letters not replayed
+		e.deadLettersMu.Lock()
+		e.deadLetters = append(dls[i:], e.deadLetters...)
+		e.deadLettersMu.Unlock()
+		return n, err
+	}
+
+	e.logger.Info("replay dead letters", zap.Int("n", n))
+	return n, nil
+}
+
+// eventTopicTrie trie of topic patterns, each level of topic is a node
+type eventTopicTrie struct {
+	sync.RWMutex
+	root *eventTopicTrieNode
+}
+
+type eventTopicTrieNode struct {
+	children map[string]*eventTopicTrieNode
+	// hs handlers registered on pattern that end at this node
+	hs *sync.Map
+}
+
+func newEventTopicTrie() *eventTopicTrie {
+	return &eventTopicTrie{
+		root: newEventTopicTrieNode(),
+	}
+}
+
+func newEventTopicTrieNode() *eventTopicTrieNode {
+	return &eventTopicTrieNode{
+		children: map[string]*eventTopicTrieNode{},
+	}
+}
+
+// load return handlers' map of pattern,
+// create nodes if not exists and `create` is true
+func (t *eventTopicTrie) load(pattern EventTopic, create bool) *sync.Map {
+	levels := strings.Split(pattern.String(), EventTopicSeparator)
+	if create {
+		t.Lock()
+		defer t.Unlock()
+	} else {
+		t.RLock()
+		defer t.RUnlock()
+	}
+
+	node := t.root
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			if !create {
+				return nil
+			}
+
+			child = newEventTopicTrieNode()
+			node.children[level] = child
+		}
+
+		node = child
+	}
+
+	if node.hs == nil && create {
+		node.hs = &sync.Map{}
+	}
+
+	return node.hs
+}
+
+// match return handlers' maps of all patterns that match topic
+func (t *eventTopicTrie) match(topic EventTopic) (hss []*sync.Map) {
+	levels := strings.Split(topic.String(), EventTopicSeparator)
+	matched := map[*eventTopicTrieNode]struct{}{}
+	t.RLock()
+	t.root.match(levels, matched)
+	t.RUnlock()
+
+	for node := range matched {
+		hss = append(hss, node.hs)
+	}
+
+	return hss
+}
+
+func (n *eventTopicTrieNode) match(levels []string, matched map[*eventTopicTrieNode]struct{}) {
+	if len(levels) == 0 {
+		if n.hs != nil {
+			matched[n] = struct{}{}
+		}
+		// `#` can match zero level
+		if child, ok := n.children[EventTopicWildcardAny]; ok {
+			child.match(levels, matched)
+		}
+
+		return
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], matched)
+	}
+	if child, ok := n.children[EventTopicWildcardOne]; ok {
+		child.match(levels[1:], matched)
+	}
+	if child, ok := n.children[EventTopicWildcardAny]; ok {
+		for i := 0; i <= len(levels); i++ {
+			child.match(levels[i:], matched)
+		}
+	}
 }
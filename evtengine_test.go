@@ -2,7 +2,13 @@ package utils
 
 import (
 	"context"
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestNewEventEngine(t *testing.T) {
@@ -43,8 +49,671 @@ func TestNewEventEngine(t *testing.T) {
 	// t.Error()
 }
 
+func TestEventEngineOverflow(t *testing.T) {
+	for _, policy := range []EventEngineOverflowPolicy{
+		EventEngineOverflowBlock,
+		EventEngineOverflowDropNewest,
+		EventEngineOverflowDropOldest,
+		EventEngineOverflowError,
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		evtstore, err := NewEventEngine(ctx,
+			WithEventEngineNFork(1),
+			WithEventEngineChanBuffer(1),
+			WithEventEngineDisableStack(true),
+			WithEventEngineOverflowPolicy(policy),
+		)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		var topic EventTopic = "t"
+		blocker := make(chan struct{})
+		evtstore.Register(topic, "handler", func(evt *Event) {
+			<-blocker
+		})
+
+		// fill the queue
+		var full bool
+		for i := 0; i < 100; i++ {
+			if err = evtstore.TryPublish(&Event{Topic: topic}); err == ErrEventEngineQueueFull ||
+				evtstore.DroppedCount() > 0 {
+				full = true
+				break
+			} else if err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !full {
+			t.Fatalf("[%d] queue should be full", policy)
+		}
+
+		switch policy {
+		case EventEngineOverflowBlock:
+			pctx, pcancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			if err = evtstore.PublishCtx(pctx, &Event{Topic: topic}); err != context.DeadlineExceeded {
+				t.Fatalf("should timeout, got %+v", err)
+			}
+			pcancel()
+		case EventEngineOverflowError:
+			if err = evtstore.PublishCtx(context.Background(), &Event{Topic: topic}); err != ErrEventEngineQueueFull {
+				t.Fatalf("should full, got %+v", err)
+			}
+		default:
+			dropped := evtstore.DroppedCount()
+			if err = evtstore.PublishCtx(context.Background(), &Event{Topic: topic}); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if evtstore.DroppedCount() != dropped+1 {
+				t.Fatalf("[%d] should drop one more event", policy)
+			}
+		}
+
+		evt := &Event{Topic: topic}
+		evtstore.TryPublish(evt)
+		if evt.Stack != "" {
+			t.Fatal("should not capture stack")
+		}
+
+		close(blocker)
+		cancel()
+	}
+
+	if _, err := NewEventEngine(context.Background(), WithEventEngineOverflowPolicy(100)); err == nil {
+		t.Fatal("should error")
+	}
+
+	if _, err := NewEventEngine(context.Background(),
+		WithEventEngineChanBuffer(0),
+		WithEventEngineOverflowPolicy(EventEngineOverflowDropOldest),
+	); err == nil {
+		t.Fatal("should reject unbuffered queue with drop oldest")
+	}
+}
+
+func TestEventTopicTrie(t *testing.T) {
+	trie := newEventTopicTrie()
+	patterns := []EventTopic{"order.*", "order.#", "order.*.paid", "#", "*.created"}
+	for _, p := range patterns {
+		trie.load(p, true).Store(HandlerID(p), p)
+	}
+
+	for topic, want := range map[EventTopic][]EventTopic{
+		"order":              {"order.#", "#"},
+		"order.created":      {"order.*", "order.#", "#", "*.created"},
+		"order.1.paid":       {"order.*.paid", "order.#", "#"},
+		"order.1.paid.again": {"order.#", "#"},
+		"user.created":       {"#", "*.created"},
+		"user":               {"#"},
+	} {
+		got := map[EventTopic]struct{}{}
+		for _, hs := range trie.match(topic) {
+			hs.Range(func(k, v interface{}) bool {
+				got[v.(EventTopic)] = struct{}{}
+				return true
+			})
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("topic %s, want %v, got %v", topic, want, got)
+		}
+		for _, p := range want {
+			if _, ok := got[p]; !ok {
+				t.Fatalf("topic %s should match %s", topic, p)
+			}
+		}
+	}
+
+	if trie.load("user.#", false) != nil {
+		t.Fatal("should not exists")
+	}
+}
+
+func TestEventEngineWildcard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evtstore, err := NewEventEngine(ctx)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		got = map[HandlerID][]EventTopic{}
+	)
+	newHandler := func(hid HandlerID) EventHandler {
+		return func(evt *Event) {
+			mu.Lock()
+			got[hid] = append(got[hid], evt.Topic)
+			mu.Unlock()
+			wg.Done()
+		}
+	}
+
+	evtstore.Register("order.*", "one", newHandler("one"))
+	evtstore.Register("order.#", "any", newHandler("any"))
+	evtstore.Register("order.created", "exact", newHandler("exact"))
+
+	wg.Add(4)
+	evtstore.Publish(&Event{Topic: "order.created"})
+	evtstore.Publish(&Event{Topic: "order.1.paid"})
+	evtstore.Publish(&Event{Topic: "user.created"})
+	wg.Wait()
+
+	mu.Lock()
+	if len(got["one"]) != 1 || len(got["any"]) != 2 || len(got["exact"]) != 1 {
+		t.Fatalf("got %+v", got)
+	}
+	mu.Unlock()
+
+	evtstore.UnRegister("order.#", "any")
+	wg.Add(2)
+	evtstore.Publish(&Event{Topic: "order.1.paid"})
+	evtstore.Publish(&Event{Topic: "order.created"})
+	wg.Wait()
+
+	mu.Lock()
+	if len(got["one"]) != 2 || len(got["any"]) != 2 || len(got["exact"]) != 2 {
+		t.Fatalf("got %+v", got)
+	}
+	mu.Unlock()
+}
+
+func TestEventRetryPolicy(t *testing.T) {
+	p := &EventRetryPolicy{
+		Backoff:    10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}
+	for n, want := range []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		50 * time.Millisecond,
+	} {
+		if got := p.backoff(n); got != want {
+			t.Fatalf("[%d] want %v, got %v", n, want, got)
+		}
+	}
+
+	p.Multiplier = 1
+	if got := p.backoff(3); got != 10*time.Millisecond {
+		t.Fatalf("got %v", got)
+	}
+
+	// no cap, should not overflow
+	p = &EventRetryPolicy{Backoff: time.Hour}
+	if got := p.backoff(100); got != math.MaxInt64 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestEventEngineRetryNotBlockRunner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evtstore, err := NewEventEngine(ctx, WithEventEngineNFork(1))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var nflaky int32
+	flakyDone := make(chan struct{})
+	if err = evtstore.RegisterWithErr("flaky", "flaky", func(evt *Event) error {
+		if atomic.AddInt32(&nflaky, 1) < 2 {
+			return errors.New("flaky")
+		}
+
+		close(flakyDone)
+		return nil
+	}, WithEventHandlerRetry(EventRetryPolicy{
+		MaxRetry: 1,
+		Backoff:  time.Second,
+	})); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fastDone := make(chan struct{})
+	evtstore.Register("fast", "fast", func(evt *Event) {
+		close(fastDone)
+	})
+
+	evtstore.Publish(&Event{Topic: "flaky"})
+	time.Sleep(50 * time.Millisecond)
+	evtstore.Publish(&Event{Topic: "fast"})
+	select {
+	case <-fastDone:
+	case <-flakyDone:
+		t.Fatal("should not wait for retry")
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("runner blocked by retry")
+	}
+	<-flakyDone
+}
+
+func TestEventEngineRetryAndDeadLetter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evtstore, err := NewEventEngine(ctx,
+		WithEventEngineSuppressPanic(true),
+		WithEventEngineDeadLetterTopic("dead"),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	retry := WithEventHandlerRetry(EventRetryPolicy{
+		MaxRetry: 2,
+		Backoff:  time.Millisecond,
+	})
+
+	// success after retry
+	var nflaky int32
+	flakyDone := make(chan struct{})
+	if err = evtstore.RegisterWithErr("flaky", "flaky", func(evt *Event) error {
+		if atomic.AddInt32(&nflaky, 1) < 3 {
+			return errors.New("flaky")
+		}
+
+		close(flakyDone)
+		return nil
+	}, retry); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// always fail
+	var (
+		nbroken int32
+		fixed   int32
+	)
+	replayed := make(chan struct{})
+	if err = evtstore.RegisterWithErr("broken", "broken", func(evt *Event) error {
+		if atomic.LoadInt32(&fixed) == 1 {
+			close(replayed)
+			return nil
+		}
+
+		atomic.AddInt32(&nbroken, 1)
+		panic("broken")
+	}, retry); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	deadChan := make(chan *EventDeadLetter, 1)
+	evtstore.Register("dead", "dead", func(evt *Event) {
+		deadChan <- evt.Meta[EventMetaKeyDeadLetter].(*EventDeadLetter)
+	})
+
+	evtstore.Publish(&Event{Topic: "flaky"})
+	evtstore.Publish(&Event{Topic: "broken"})
+	<-flakyDone
+
+	dl := <-deadChan
+	if dl.HandlerID != "broken" || dl.Attempts != 3 || dl.Err == nil {
+		t.Fatalf("got %+v", dl)
+	}
+	if atomic.LoadInt32(&nbroken) != 3 {
+		t.Fatalf("got %d", nbroken)
+	}
+
+	dls := evtstore.ListDeadLetters()
+	if len(dls) != 1 || dls[0].ID != dl.ID {
+		t.Fatalf("got %+v", dls)
+	}
+
+	atomic.StoreInt32(&fixed, 1)
+	if n, err := evtstore.ReplayDeadLetters(dl.ID); err != nil || n != 1 {
+		t.Fatalf("got %d, %+v", n, err)
+	}
+	<-replayed
+	if len(evtstore.ListDeadLetters()) != 0 {
+		t.Fatal("dead letters should be empty")
+	}
+
+	if err = evtstore.RegisterWithErr("t", "h", func(evt *Event) error { return nil },
+		WithEventHandlerRetry(EventRetryPolicy{MaxRetry: -1})); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestEventEngineDeadLetterSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evtstore, err := NewEventEngine(ctx,
+		WithEventEngineDeadLetterSize(2),
+		WithEventEngineDeadLetterTopic("dead"),
+		WithEventEngineChanBuffer(10),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var wg sync.WaitGroup
+	if err = evtstore.RegisterWithErr("t", "h", func(evt *Event) error {
+		return errors.New("failed")
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	evtstore.Register("dead", "dead", func(evt *Event) {
+		wg.Done()
+	})
+
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		evtstore.Publish(&Event{Topic: "t"})
+	}
+	wg.Wait()
+
+	if dls := evtstore.ListDeadLetters(); len(dls) != 2 {
+		t.Fatalf("got %d", len(dls))
+	}
+
+	if removed := evtstore.RemoveDeadLetters(); len(removed) != 2 {
+		t.Fatalf("got %d", len(removed))
+	}
+	if len(evtstore.ListDeadLetters()) != 0 {
+		t.Fatal("dead letters should be empty")
+	}
+}
+
+func TestEventEngineOrderKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evtstore, err := NewEventEngine(ctx,
+		WithEventEngineNFork(4),
+		WithEventEngineChanBuffer(10),
+		WithEventEngineOrderKey("order_id"),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		got = map[interface{}][]int{}
+	)
+	evtstore.Register("order.*", "handler", func(evt *Event) {
+		defer wg.Done()
+		time.Sleep(time.Duration(evt.Meta["seq"].(int)%3) * time.Millisecond)
+		mu.Lock()
+		got[evt.Meta["order_id"]] = append(got[evt.Meta["order_id"]], evt.Meta["seq"].(int))
+		mu.Unlock()
+	})
+
+	wg.Add(100)
+	for i := 0; i < 100; i++ {
+		if err = evtstore.PublishCtx(context.Background(), &Event{
+			Topic: "order.updated",
+			Meta: EventMeta{
+				"order_id": i % 5,
+				"seq":      i,
+			},
+		}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 5 {
+		t.Fatalf("got %+v", got)
+	}
+	for key, seqs := range got {
+		if len(seqs) != 20 {
+			t.Fatalf("key %v got %v", key, seqs)
+		}
+		for i := 1; i < len(seqs); i++ {
+			if seqs[i] <= seqs[i-1] {
+				t.Fatalf("key %v out of order: %v", key, seqs)
+			}
+		}
+	}
+}
+
+func TestEventEngineOrderKeyReplayDeadLetters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evtstore, err := NewEventEngine(ctx,
+		WithEventEngineNFork(2),
+		WithEventEngineOrderKey("order_id"),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var (
+		mu    sync.Mutex
+		got   []int
+		fixed int32
+	)
+	blocker := make(chan struct{})
+	done := make(chan struct{})
+	if err = evtstore.RegisterWithErr("order", "handler", func(evt *Event) error {
+		seq := evt.Meta["seq"].(int)
+		switch {
+		case seq == 1 && atomic.LoadInt32(&fixed) == 0:
+			return errors.New("failed")
+		case seq == 2:
+			<-blocker
+		}
+
+		mu.Lock()
+		got = append(got, seq)
+		if len(got) == 2 {
+			close(done)
+		}
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	evtstore.Publish(&Event{Topic: "order", Meta: EventMeta{"order_id": 1, "seq": 1}})
+	for len(evtstore.ListDeadLetters()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	atomic.StoreInt32(&fixed, 1)
+	evtstore.Publish(&Event{Topic: "order", Meta: EventMeta{"order_id": 1, "seq": 2}})
+	time.Sleep(10 * time.Millisecond)
+	// replayed event should wait behind newer event of the same key
+	if n, err := evtstore.ReplayDeadLetters(); err != nil || n != 1 {
+		t.Fatalf("got %d, %+v", n, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(blocker)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 || got[0] != 2 || got[1] != 1 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestEventEngineClose(t *testing.T) {
+	evtstore, err := NewEventEngine(context.Background(),
+		WithEventEngineChanBuffer(100),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var handled int32
+	evtstore.Register("t", "h1", func(evt *Event) {
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&handled, 1)
+	})
+	evtstore.Register("t", "h2", func(evt *Event) {
+		atomic.AddInt32(&handled, 1)
+	})
+
+	for i := 0; i < 50; i++ {
+		if err = evtstore.PublishCtx(context.Background(), &Event{Topic: "t"}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dropped, err := evtstore.Close(ctx)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if dropped != 0 {
+		t.Fatalf("got %d", dropped)
+	}
+	if n := atomic.LoadInt32(&handled); n != 100 {
+		t.Fatalf("got %d", n)
+	}
+
+	if err = evtstore.PublishCtx(context.Background(), &Event{Topic: "t"}); err != ErrEventEngineClosed {
+		t.Fatalf("got %+v", err)
+	}
+	if _, err = evtstore.Close(ctx); err != ErrEventEngineClosed {
+		t.Fatalf("got %+v", err)
+	}
+}
+
+func TestEventEngineCloseTimeout(t *testing.T) {
+	evtstore, err := NewEventEngine(context.Background(),
+		WithEventEngineNFork(1),
+		WithEventEngineChanBuffer(10),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	blocker := make(chan struct{})
+	defer close(blocker)
+	evtstore.Register("t", "h", func(evt *Event) {
+		<-blocker
+	})
+
+	for i := 0; i < 3; i++ {
+		if err = evtstore.PublishCtx(context.Background(), &Event{Topic: "t"}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	dropped, err := evtstore.Close(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %+v", err)
+	}
+	if dropped != 3 {
+		t.Fatalf("got %d", dropped)
+	}
+}
+
+func TestEventEnginePublishAndWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evtstore, err := NewEventEngine(ctx)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var handled int32
+	evtstore.Register("t", "ok", func(evt *Event) {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&handled, 1)
+	})
+	if err = evtstore.RegisterWithErr("t", "fail", func(evt *Event) error {
+		return errors.New("failed")
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	results, err := evtstore.PublishAndWait(ctx, &Event{Topic: "t"})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if atomic.LoadInt32(&handled) != 1 {
+		t.Fatal("should wait all handlers")
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %+v", results)
+	}
+	for _, r := range results {
+		switch r.HandlerID {
+		case "ok":
+			if r.Err != nil {
+				t.Fatalf("got %+v", r.Err)
+			}
+		case "fail":
+			if r.Err == nil {
+				t.Fatal("should error")
+			}
+		default:
+			t.Fatalf("unknown handler %s", r.HandlerID)
+		}
+	}
+
+	// no handler
+	if results, err = evtstore.PublishAndWait(ctx, &Event{Topic: "none"}); err != nil || len(results) != 0 {
+		t.Fatalf("got %+v, %+v", results, err)
+	}
+}
+
+func TestEventEngineRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evtstore, err := NewEventEngine(ctx)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err = evtstore.RegisterReplier("math.double", "double", func(evt *Event) (interface{}, error) {
+		return evt.Meta["n"].(int) * 2, nil
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	evtstore.Register("math.*", "audit", func(evt *Event) {})
+	if err = evtstore.RegisterReplier("math.fail", "fail", func(evt *Event) (interface{}, error) {
+		return nil, errors.New("failed")
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	blocker := make(chan struct{})
+	defer close(blocker)
+	if err = evtstore.RegisterReplier("math.slow", "slow", func(evt *Event) (interface{}, error) {
+		<-blocker
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	resp, err := evtstore.Request(ctx, &Event{Topic: "math.double", Meta: EventMeta{"n": 21}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if resp.(int) != 42 {
+		t.Fatalf("got %v", resp)
+	}
+
+	if _, err = evtstore.Request(ctx, &Event{Topic: "math.fail"}); err == nil || err == ErrEventNoReply {
+		t.Fatalf("got %+v", err)
+	}
+	if _, err = evtstore.Request(ctx, &Event{Topic: "math.none"}); err != ErrEventNoReply {
+		t.Fatalf("got %+v", err)
+	}
+
+	tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer tcancel()
+	if _, err = evtstore.Request(tctx, &Event{Topic: "math.slow"}); err != context.DeadlineExceeded {
+		t.Fatalf("got %+v", err)
+	}
+}
+
 func BenchmarkNewEventEngine(b *testing.B) {
-	evtstore, err := NewEventEngine(context.Background())
+	evtstore, err := NewEventEngine(context.Background(),
+		WithEventEngineDisableStack(true),
+		WithEventEngineOverflowPolicy(EventEngineOverflowDropNewest),
+	)
 	if err != nil {
 		b.Fatalf("%+v", err)
 	}
@@ -78,6 +747,12 @@ func BenchmarkNewEventEngine(b *testing.B) {
 			evtstore.Publish(evt2)
 		}
 	})
+	b.Run("try publish", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			evtstore.TryPublish(evt1)
+			evtstore.TryPublish(evt2)
+		}
+	})
 
 	// b.Error()
 }
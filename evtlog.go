@@ -0,0 +1,680 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultEventLogSegmentSize  int64 = 64 * 1024 * 1024
+	defaultEventLogSyncInterval       = time.Second
+	eventLogSegmentExt                = ".log"
+	eventLogOffsetsFileName           = "offsets.json"
+	// eventLogHeaderSize length(4) + crc(4) + offset(8)
+	eventLogHeaderSize = 16
+	// eventLogMaxRecordSize guard against corrupted length
+	eventLogMaxRecordSize = 64 * 1024 * 1024
+)
+
+// EventLogSyncPolicy when to fsync event log to disk
+type EventLogSyncPolicy int
+
+const (
+	// EventLogSyncAlways fsync after every append
+	EventLogSyncAlways EventLogSyncPolicy = iota
+	// EventLogSyncInterval fsync periodically
+	EventLogSyncInterval
+	// EventLogSyncNever never fsync, leave it to OS
+	EventLogSyncNever
+)
+
+// EventLog append-only, segmented on-disk log of events.
+//
+// each record is `length(4) | crc32(4) | offset(8) | json(event)`,
+// crc covers offset and payload. torn records at the tail will be
+// truncated when opening.
+//
+// EventLog also tracks committed offset of each handler, events not
+// committed will be replayed by `EventEngine.ReplayLog`.
+// `Meta` of replayed events is decoded from json, so its values are
+// json types (float64, string, map[string]interface{}...).
+type EventLog struct {
+	*eventLogOption
+	dir string
+	// stopSyncer stop runSyncer, syncerWg wait it exit
+	stopSyncer context.CancelFunc
+	syncerWg   sync.WaitGroup
+
+	mu         sync.Mutex
+	segments   []int64 // base offsets, ascending
+	active     *os.File
+	activeSize int64
+	nextOffset int64
+
+	trackMu sync.Mutex
+	// loaded offsets when open
+	loaded *eventLogOffsets
+	// replayEnd next offset when open, events before it may need replay
+	replayEnd int64
+	// dispatched all offsets <= dispatched have been dispatched
+	dispatched int64
+	// dispatchedAhead dispatched offsets > dispatched+1
+	dispatchedAhead map[int64]struct{}
+	// inflight map[handlerID]map[offset]count
+	inflight map[HandlerID]map[int64]int
+}
+
+// eventLogOffsets persisted committed offsets
+type eventLogOffsets struct {
+	// Dispatched committed offset of handlers not in `Handlers`
+	Dispatched int64               `json:"dispatched"`
+	Handlers   map[HandlerID]int64 `json:"handlers"`
+}
+
+type eventLogOption struct {
+	segmentSize  int64
+	syncPolicy   EventLogSyncPolicy
+	syncInterval time.Duration
+	logger       *LoggerType
+}
+
+// EventLogOptFunc options for EventLog
+type EventLogOptFunc func(*eventLogOption) error
+
+// WithEventLogSegmentSize set max bytes of each segment file
+func WithEventLogSegmentSize(size int64) EventLogOptFunc {
+	return func(opt *eventLogOption) error {
+		if size <= 0 {
+			return errors.Errorf("size must > 0")
+		}
+
+		opt.segmentSize = size
+		return nil
+	}
+}
+
+// WithEventLogSync set fsync policy, interval is used by `EventLogSyncInterval`,
+// and also the interval of saving committed offsets
+func WithEventLogSync(policy EventLogSyncPolicy, interval time.Duration) EventLogOptFunc {
+	return func(opt *eventLogOption) error {
+		switch policy {
+		case EventLogSyncAlways, EventLogSyncInterval, EventLogSyncNever:
+		default:
+			return errors.Errorf("unknown sync policy %d", policy)
+		}
+		if interval <= 0 {
+			return errors.Errorf("interval must > 0")
+		}
+
+		opt.syncPolicy = policy
+		opt.syncInterval = interval
+		return nil
+	}
+}
+
+// WithEventLogLogger set event log's logger
+func WithEventLogLogger(logger *LoggerType) EventLogOptFunc {
+	return func(opt *eventLogOption) error {
+		if logger == nil {
+			return errors.Errorf("logger is nil")
+		}
+
+		opt.logger = logger
+		return nil
+	}
+}
+
+// NewEventLog open or create event log in dir
+func NewEventLog(ctx context.Context, dir string, opts ...EventLogOptFunc) (l *EventLog, err error) {
+	opt := &eventLogOption{
+		segmentSize:  defaultEventLogSegmentSize,
+		syncPolicy:   EventLogSyncInterval,
+		syncInterval: defaultEventLogSyncInterval,
+		logger:       Logger.Named("evt-log"),
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "create dir `%s`", dir)
+	}
+
+	l = &EventLog{
+		eventLogOption:  opt,
+		dir:             dir,
+		dispatchedAhead: map[int64]struct{}{},
+		inflight:        map[HandlerID]map[int64]int{},
+	}
+	if err = l.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err = l.loadOffsets(); err != nil {
+		return nil, err
+	}
+	l.replayEnd = l.nextOffset
+
+	var syncerCtx context.Context
+	syncerCtx, l.stopSyncer = context.WithCancel(ctx)
+	l.syncerWg.Add(1)
+	go l.runSyncer(syncerCtx)
+	l.logger.Info("open event log",
+		zap.String("dir", dir),
+		zap.Int("segments", len(l.segments)),
+		zap.Int64("next_offset", l.nextOffset),
+		zap.Int64("dispatched", l.loaded.Dispatched))
+	return l, nil
+}
+
+func (l *EventLog) segmentPath(base int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", base, eventLogSegmentExt))
+}
+
+// loadSegments find all segments and recover the last one
+func (l *EventLog) loadSegments() error {
+	fs, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return errors.Wrapf(err, "read dir `%s`", l.dir)
+	}
+
+	for _, f := range fs {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), eventLogSegmentExt) {
+			continue
+		}
+
+		base, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), eventLogSegmentExt), 10, 64)
+		if err != nil {
+			l.logger.Warn("ignore unknown file", zap.String("file", f.Name()))
+			continue
+		}
+
+		l.segments = append(l.segments, base)
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i] < l.segments[j] })
+
+	if len(l.segments) == 0 {
+		return l.roll(0)
+	}
+
+	// recover active segment, truncate torn records at tail
+	base := l.segments[len(l.segments)-1]
+	fp, err := os.OpenFile(l.segmentPath(base), os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open segment")
+	}
+
+	l.nextOffset = base
+	validSize, err := scanEventLogSegment(fp, func(offset int64, _ []byte) error {
+		l.nextOffset = offset + 1
+		return nil
+	})
+	if err != nil {
+		_ = fp.Close()
+		return err
+	}
+	if err = fp.Truncate(validSize); err != nil {
+		_ = fp.Close()
+		return errors.Wrap(err, "truncate segment")
+	}
+	if _, err = fp.Seek(validSize, io.SeekStart); err != nil {
+		_ = fp.Close()
+		return errors.Wrap(err, "seek segment")
+	}
+
+	l.active = fp
+	l.activeSize = validSize
+	return nil
+}
+
+// roll close active segment and create new segment start at base
+func (l *EventLog) roll(base int64) (err error) {
+	if l.active != nil {
+		if err = l.active.Sync(); err != nil {
+			return errors.Wrap(err, "sync segment")
+		}
+		if err = l.active.Close(); err != nil {
+			return errors.Wrap(err, "close segment")
+		}
+	}
+
+	if l.active, err = os.OpenFile(l.segmentPath(base), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644); err != nil {
+		return errors.Wrap(err, "create segment")
+	}
+	if len(l.segments) == 0 || l.segments[len(l.segments)-1] != base {
+		l.segments = append(l.segments, base)
+	}
+
+	l.activeSize = 0
+	l.nextOffset = base
+	l.logger.Debug("roll segment", zap.Int64("base", base))
+	return nil
+}
+
+// scanEventLogSegment read records in r, stop at the first invalid record,
+// return the size of valid records
+func scanEventLogSegment(r io.Reader, fn func(offset int64, payload []byte) error) (size int64, err error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, eventLogHeaderSize)
+	for {
+		if _, err = io.ReadFull(br, header); err != nil {
+			return size, nil
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > eventLogMaxRecordSize {
+			return size, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(br, payload); err != nil {
+			return size, nil
+		}
+
+		crc := crc32.NewIEEE()
+		crc.Write(header[8:])
+		crc.Write(payload)
+		if crc.Sum32() != binary.BigEndian.Uint32(header[4:8]) {
+			return size, nil
+		}
+
+		if err = fn(int64(binary.BigEndian.Uint64(header[8:])), payload); err != nil {
+			return size, err
+		}
+
+		size += eventLogHeaderSize + int64(length)
+	}
+}
+
+// Append write event to log, return its offset
+func (l *EventLog) Append(evt *Event) (offset int64, err error) {
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return 0, errors.Wrap(err, "marshal event")
+	}
+
+	record := make([]byte, eventLogHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	copy(record[eventLogHeaderSize:], payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.activeSize >= l.segmentSize {
+		if err = l.roll(l.nextOffset); err != nil {
+			return 0, err
+		}
+	}
+
+	offset = l.nextOffset
+	binary.BigEndian.PutUint64(record[8:16], uint64(offset))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+	if _, err = l.active.Write(record); err != nil {
+		return 0, l.discardTail(errors.Wrap(err, "write record"))
+	}
+	if l.syncPolicy == EventLogSyncAlways {
+		if err = l.active.Sync(); err != nil {
+			return 0, l.discardTail(errors.Wrap(err, "sync segment"))
+		}
+	}
+
+	l.activeSize += int64(len(record))
+	l.nextOffset++
+	return offset, nil
+}
+
+// discardTail truncate partial record after activeSize written by failed Append,
+// otherwise records appended after it would be lost when reopen
+func (l *EventLog) discardTail(cause error) error {
+	if err := l.active.Truncate(l.activeSize); err != nil {
+		return errors.Wrapf(cause, "truncate segment got error: %v", err)
+	}
+	if _, err := l.active.Seek(l.activeSize, io.SeekStart); err != nil {
+		return errors.Wrapf(cause, "seek segment got error: %v", err)
+	}
+
+	return cause
+}
+
+// replay iterate events that may not be committed by some handlers when log opened,
+// fn should dispatch event to handlers that `shouldReplay`
+func (l *EventLog) replay(fn func(offset int64, evt *Event) error) error {
+	start := l.replayStart()
+	l.logger.Info("replay event log",
+		zap.Int64("from", start),
+		zap.Int64("to", l.replayEnd-1))
+
+	l.mu.Lock()
+	segments := append([]int64{}, l.segments...)
+	l.mu.Unlock()
+	for i, base := range segments {
+		if i+1 < len(segments) && segments[i+1] <= start {
+			continue
+		}
+		if base >= l.replayEnd {
+			break
+		}
+
+		if err := l.readSegment(base, start, l.replayEnd, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shouldReplay whether event at offset has not been committed by handler when log opened
+func (l *EventLog) shouldReplay(hid HandlerID, offset int64) bool {
+	return offset > l.loadedCommitted(hid)
+}
+
+// NextOffset return the offset of next appended event
+func (l *EventLog) NextOffset() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nextOffset
+}
+
+// ReadFrom iterate events in log from offset to the end when called
+func (l *EventLog) ReadFrom(offset int64, fn func(offset int64, evt *Event) error) error {
+	l.mu.Lock()
+	segments := append([]int64{}, l.segments...)
+	end := l.nextOffset
+	l.mu.Unlock()
+
+	for i, base := range segments {
+		if i+1 < len(segments) && segments[i+1] <= offset {
+			continue
+		}
+
+		if err := l.readSegment(base, offset, end, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *EventLog) readSegment(base, from, end int64, fn func(offset int64, evt *Event) error) error {
+	fp, err := os.Open(l.segmentPath(base))
+	if err != nil {
+		if os.IsNotExist(err) { // removed by compact
+			return nil
+		}
+
+		return errors.Wrap(err, "open segment")
+	}
+	defer fp.Close()
+
+	errStop := errors.New("stop")
+	if _, err = scanEventLogSegment(fp, func(offset int64, payload []byte) error {
+		if offset >= end {
+			return errStop
+		}
+		if offset < from {
+			return nil
+		}
+
+		evt := &Event{}
+		if err := json.Unmarshal(payload, evt); err != nil {
+			return errors.Wrapf(err, "unmarshal event at offset %d", offset)
+		}
+		return fn(offset, evt)
+	}); err != nil && err != errStop {
+		return err
+	}
+
+	return nil
+}
+
+func (l *EventLog) offsetsPath() string {
+	return filepath.Join(l.dir, eventLogOffsetsFileName)
+}
+
+func (l *EventLog) loadOffsets() error {
+	l.loaded = &eventLogOffsets{
+		Dispatched: -1,
+		Handlers:   map[HandlerID]int64{},
+	}
+
+	cnt, err := ioutil.ReadFile(l.offsetsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			if len(l.segments) > 0 {
+				l.loaded.Dispatched = l.segments[0] - 1
+			}
+			l.dispatched = l.loaded.Dispatched
+			return nil
+		}
+
+		return errors.Wrap(err, "read offsets")
+	}
+
+	if err = json.Unmarshal(cnt, l.loaded); err != nil {
+		return errors.Wrap(err, "unmarshal offsets")
+	}
+	if l.loaded.Handlers == nil {
+		l.loaded.Handlers = map[HandlerID]int64{}
+	}
+
+	// events after start will be replayed and dispatched again
+	l.dispatched = l.replayStart() - 1
+	return nil
+}
+
+// replayStart return the smallest offset not committed by any handler
+func (l *EventLog) replayStart() int64 {
+	start := l.loaded.Dispatched
+	for _, o := range l.loaded.Handlers {
+		if o < start {
+			start = o
+		}
+	}
+
+	return start + 1
+}
+
+// loadedCommitted return committed offset of handler when log opened
+func (l *EventLog) loadedCommitted(hid HandlerID) int64 {
+	if o, ok := l.loaded.Handlers[hid]; ok {
+		return o
+	}
+
+	return l.loaded.Dispatched
+}
+
+// track mark event at offset is being handled by handler
+func (l *EventLog) track(hid HandlerID, offset int64) {
+	l.trackMu.Lock()
+	defer l.trackMu.Unlock()
+
+	if _, ok := l.inflight[hid]; !ok {
+		l.inflight[hid] = map[int64]int{}
+	}
+	l.inflight[hid][offset]++
+}
+
+// untrack mark event at offset is handled by handler
+func (l *EventLog) untrack(hid HandlerID, offset int64) {
+	l.trackMu.Lock()
+	defer l.trackMu.Unlock()
+
+	offsets, ok := l.inflight[hid]
+	if !ok {
+		return
+	}
+	if offsets[offset]--; offsets[offset] <= 0 {
+		delete(offsets, offset)
+	}
+}
+
+// markDispatched mark event at offset has been dispatched to all its handlers
+func (l *EventLog) markDispatched(offset int64) {
+	l.trackMu.Lock()
+	defer l.trackMu.Unlock()
+
+	if offset <= l.dispatched {
+		return
+	}
+
+	l.dispatchedAhead[offset] = struct{}{}
+	for {
+		if _, ok := l.dispatchedAhead[l.dispatched+1]; !ok {
+			return
+		}
+
+		delete(l.dispatchedAhead, l.dispatched+1)
+		l.dispatched++
+	}
+}
+
+// Committed return the offset that all events before it (included)
+// have been handled by handler, -1 if none
+func (l *EventLog) Committed(hid HandlerID) int64 {
+	l.trackMu.Lock()
+	defer l.trackMu.Unlock()
+	return l.committed(hid)
+}
+
+func (l *EventLog) committed(hid HandlerID) int64 {
+	c := l.dispatched
+	for o := range l.inflight[hid] {
+		if o-1 < c {
+			c = o - 1
+		}
+	}
+
+	if loaded := l.loadedCommitted(hid); loaded > c {
+		return loaded
+	}
+
+	return c
+}
+
+// checkpoint save committed offsets of all handlers
+func (l *EventLog) checkpoint() error {
+	l.trackMu.Lock()
+	offsets := &eventLogOffsets{
+		Dispatched: l.dispatched,
+		Handlers:   map[HandlerID]int64{},
+	}
+	if l.loaded.Dispatched > offsets.Dispatched {
+		offsets.Dispatched = l.loaded.Dispatched
+	}
+
+	hids := map[HandlerID]struct{}{}
+	for hid := range l.loaded.Handlers {
+		hids[hid] = struct{}{}
+	}
+	for hid := range l.inflight {
+		hids[hid] = struct{}{}
+	}
+	for hid := range hids {
+		if c := l.committed(hid); c < offsets.Dispatched {
+			offsets.Handlers[hid] = c
+		}
+	}
+	l.trackMu.Unlock()
+
+	cnt, err := json.Marshal(offsets)
+	if err != nil {
+		return errors.Wrap(err, "marshal offsets")
+	}
+
+	// fsync file and dir, offsets would be empty or stale after crash otherwise
+	if err = WriteFileAtomic(l.offsetsPath(), cnt, 0644); err != nil {
+		return errors.Wrap(err, "write offsets")
+	}
+
+	min := offsets.Dispatched
+	for _, o := range offsets.Handlers {
+		if o < min {
+			min = o
+		}
+	}
+
+	l.compact(min)
+	return nil
+}
+
+// compact remove segments that all events in it have been committed
+func (l *EventLog) compact(committed int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for len(l.segments) > 1 && l.segments[1]-1 <= committed {
+		if err := os.Remove(l.segmentPath(l.segments[0])); err != nil && !os.IsNotExist(err) {
+			l.logger.Error("remove segment", zap.Int64("base", l.segments[0]), zap.Error(err))
+			return
+		}
+
+		l.logger.Debug("remove segment", zap.Int64("base", l.segments[0]))
+		l.segments = l.segments[1:]
+	}
+}
+
+// Sync fsync active segment and save committed offsets
+func (l *EventLog) Sync() error {
+	l.mu.Lock()
+	err := l.active.Sync()
+	l.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "sync segment")
+	}
+
+	return l.checkpoint()
+}
+
+func (l *EventLog) runSyncer(ctx context.Context) {
+	defer l.syncerWg.Done()
+	ticker := time.NewTicker(l.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		if l.syncPolicy == EventLogSyncInterval {
+			err = l.Sync()
+		} else {
+			err = l.checkpoint()
+		}
+		if err != nil {
+			l.logger.Error("sync event log", zap.Error(err))
+		}
+	}
+}
+
+// Close sync and close event log
+func (l *EventLog) Close() error {
+	l.stopSyncer()
+	l.syncerWg.Wait()
+
+	if err := l.Sync(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active.Close()
+}
@@ -0,0 +1,283 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestEventLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEventLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log, err := NewEventLog(ctx, dir,
+		WithEventLogSegmentSize(200),
+		WithEventLogSync(EventLogSyncAlways, time.Second),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		offset, err := log.Append(&Event{Topic: "t", Meta: EventMeta{"i": i}})
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if offset != int64(i) {
+			t.Fatalf("want %d, got %d", i, offset)
+		}
+	}
+	if len(log.segments) < 2 {
+		t.Fatalf("should roll segments, got %d", len(log.segments))
+	}
+
+	var got []int64
+	if err = log.ReadFrom(5, func(offset int64, evt *Event) error {
+		if int64(evt.Meta["i"].(float64)) != offset {
+			t.Fatalf("offset %d got %+v", offset, evt.Meta)
+		}
+		got = append(got, offset)
+		return nil
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(got) != 15 || got[0] != 5 || got[14] != 19 {
+		t.Fatalf("got %v", got)
+	}
+	if err = log.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// torn record at tail
+	last := log.segmentPath(log.segments[len(log.segments)-1])
+	fp, err := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = fp.Write([]byte{0, 0, 0, 10, 1, 2, 3}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fp.Close()
+
+	if log, err = NewEventLog(ctx, dir, WithEventLogSegmentSize(200)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if log.NextOffset() != 20 {
+		t.Fatalf("got %d", log.NextOffset())
+	}
+	if offset, err := log.Append(&Event{Topic: "t"}); err != nil || offset != 20 {
+		t.Fatalf("got %d, %+v", offset, err)
+	}
+	if err = log.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if _, err = NewEventLog(ctx, dir, WithEventLogSync(100, time.Second)); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestEventLogDiscardTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEventLogDiscardTail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log, err := NewEventLog(ctx, dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = log.Append(&Event{Topic: "t"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// simulate partial record written by failed Append
+	if _, err = log.active.Write([]byte("partial")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = log.discardTail(errors.New("write failed")); err == nil {
+		t.Fatal("should return cause")
+	}
+	if _, err = log.Append(&Event{Topic: "t"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = log.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if log, err = NewEventLog(ctx, dir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer log.Close()
+	if n := log.NextOffset(); n != 2 {
+		t.Fatalf("got %d", n)
+	}
+}
+
+func TestEventLogMarkDispatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEventLogMarkDispatched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log, err := NewEventLog(ctx, dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	log.track("h", 1)
+	log.markDispatched(1)
+	log.markDispatched(2)
+	if c := log.Committed("h"); c != -1 {
+		t.Fatalf("got %d", c)
+	}
+	if c := log.Committed("other"); c != -1 {
+		t.Fatalf("got %d", c)
+	}
+
+	log.markDispatched(0)
+	if c := log.Committed("h"); c != 0 {
+		t.Fatalf("got %d", c)
+	}
+	if c := log.Committed("other"); c != 2 {
+		t.Fatalf("got %d", c)
+	}
+
+	log.untrack("h", 1)
+	if c := log.Committed("h"); c != 2 {
+		t.Fatalf("got %d", c)
+	}
+}
+
+func TestEventEngineWithLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEventEngineWithLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// first run, handler `slow` never finish
+	ctx, cancel := context.WithCancel(context.Background())
+	log, err := NewEventLog(ctx, dir, WithEventLogSegmentSize(100))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	evtstore, err := NewEventEngine(ctx,
+		WithEventEngineLog(log),
+		WithEventEngineNFork(10),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var wg sync.WaitGroup
+	evtstore.Register("t", "fast", func(evt *Event) {
+		wg.Done()
+	})
+	blocker := make(chan struct{})
+	evtstore.Register("t", "slow", func(evt *Event) {
+		<-blocker
+	})
+	if _, err = evtstore.ReplayLog(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		if err = evtstore.PublishCtx(context.Background(), &Event{Topic: "t", Meta: EventMeta{"i": i}}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	wg.Wait()
+
+	for i := 0; i < 100 && log.Committed("fast") != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c := log.Committed("fast"); c != 2 {
+		t.Fatalf("got %d", c)
+	}
+	if c := log.Committed("slow"); c != -1 {
+		t.Fatalf("got %d", c)
+	}
+	if err = log.Sync(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// crash
+	cancel()
+	close(blocker)
+
+	// second run, only `slow` should get events
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if log, err = NewEventLog(ctx, dir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if evtstore, err = NewEventEngine(ctx, WithEventEngineLog(log)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var (
+		mu  sync.Mutex
+		got = map[HandlerID]int{}
+	)
+	evtstore.Register("t", "fast", func(evt *Event) {
+		mu.Lock()
+		got["fast"]++
+		mu.Unlock()
+		wg.Done()
+	})
+	evtstore.Register("t", "slow", func(evt *Event) {
+		mu.Lock()
+		got["slow"]++
+		mu.Unlock()
+		wg.Done()
+	})
+
+	wg.Add(3)
+	if n, err := evtstore.ReplayLog(); err != nil || n != 3 {
+		t.Fatalf("got %d, %+v", n, err)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	if got["fast"] != 0 || got["slow"] != 3 {
+		t.Fatalf("got %+v", got)
+	}
+	mu.Unlock()
+
+	for i := 0; i < 100 && log.Committed("slow") != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c := log.Committed("slow"); c != 2 {
+		t.Fatalf("got %d", c)
+	}
+	if err = log.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// all committed segments should be removed
+	fs, err := filepath.Glob(filepath.Join(dir, "*"+eventLogSegmentExt))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(fs) != 1 {
+		t.Fatalf("got %v", fs)
+	}
+}
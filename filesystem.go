@@ -0,0 +1,773 @@
+package utils
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrFSReadOnly write to read-only filesystem
+	ErrFSReadOnly = errors.New("read-only filesystem")
+)
+
+// FSFile file opened from FS.
+//
+// FSFile satisfies `io/fs.File`, *os.File implements FSFile.
+type FSFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// FS filesystem used by fs helpers.
+//
+// methods have the same semantics as functions in package os,
+// errors should be *os.PathError so `os.IsNotExist` works.
+// see `ToIOFS` and `FromIOFS` to convert between `io/fs.FS`.
+type FS interface {
+	Open(name string) (FSFile, error)
+	OpenFile(name string, flag int, perm os.FileMode) (FSFile, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	// ReadDir return entries sorted by name
+	ReadDir(name string) ([]os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// OSFS FS of local filesystem
+type OSFS struct{}
+
+// Open open file to read
+func (OSFS) Open(name string) (FSFile, error) {
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fp, nil
+}
+
+// OpenFile open file with flag
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	fp, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return fp, nil
+}
+
+// Stat get file info, follow symlinks
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Lstat get file info, not follow symlinks
+func (OSFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// ReadDir list entries in dir
+func (OSFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+// MkdirAll create dir and all parents
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Remove remove file or empty dir
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Chmod change mode
+func (OSFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// Chtimes change access and modification time
+func (OSFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// WalkFS walk file tree in fsys like `filepath.Walk`, symlinks are not followed
+func WalkFS(fsys FS, root string, walkFn filepath.WalkFunc) error {
+	info, err := fsys.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = walkFS(fsys, root, info, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+func walkFS(fsys FS, fpath string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(fpath, info, nil)
+	}
+
+	infos, err := fsys.ReadDir(fpath)
+	if err1 := walkFn(fpath, info, err); err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, child := range infos {
+		if err = walkFS(fsys, filepath.Join(fpath, child.Name()), child, walkFn); err != nil {
+			if !child.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func readFileFS(fsys FS, name string) ([]byte, error) {
+	fp, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return ioutil.ReadAll(fp)
+}
+
+func writeFileFS(fsys FS, name string, data []byte, perm os.FileMode) error {
+	fp, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	if _, err = fp.Write(data); err != nil {
+		return err
+	}
+
+	return fp.Close()
+}
+
+// isFSWriteFlag whether flag opens file to modify
+func isFSWriteFlag(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+}
+
+// ReadOnlyFS wrap FS, all modifications return ErrFSReadOnly
+type ReadOnlyFS struct {
+	FS
+}
+
+// NewReadOnlyFS create read-only view of fsys
+func NewReadOnlyFS(fsys FS) *ReadOnlyFS {
+	return &ReadOnlyFS{FS: fsys}
+}
+
+// OpenFile open file, return ErrFSReadOnly if flag is not read-only
+func (f *ReadOnlyFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	if isFSWriteFlag(flag) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrFSReadOnly}
+	}
+
+	return f.FS.OpenFile(name, flag, perm)
+}
+
+// MkdirAll return ErrFSReadOnly
+func (f *ReadOnlyFS) MkdirAll(path string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: path, Err: ErrFSReadOnly}
+}
+
+// Remove return ErrFSReadOnly
+func (f *ReadOnlyFS) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: ErrFSReadOnly}
+}
+
+// Chmod return ErrFSReadOnly
+func (f *ReadOnlyFS) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: ErrFSReadOnly}
+}
+
+// Chtimes return ErrFSReadOnly
+func (f *ReadOnlyFS) Chtimes(name string, atime, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: ErrFSReadOnly}
+}
+
+// memFSNode file or dir in MemFS
+type memFSNode struct {
+	data  []byte
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// memFSInfo implements os.FileInfo
+type memFSInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (i *memFSInfo) Name() string       { return i.name }
+func (i *memFSInfo) Size() int64        { return i.size }
+func (i *memFSInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFSInfo) ModTime() time.Time { return i.mtime }
+func (i *memFSInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFSInfo) Sys() interface{}   { return nil }
+
+// MemFS in-memory FS, safe for concurrent use.
+//
+// both `/` and `\` are treated as separator, all paths are relative to root,
+// symlinks are not supported.
+type MemFS struct {
+	sync.RWMutex
+	nodes map[string]*memFSNode
+}
+
+// NewMemFS create empty MemFS
+func NewMemFS() *MemFS {
+	return &MemFS{
+		nodes: map[string]*memFSNode{
+			".": {mode: os.ModeDir | 0755, mtime: Clock.GetUTCNow()},
+		},
+	}
+}
+
+// memFSName normalize name to key of nodes
+func memFSName(name string) string {
+	name = path.Clean("/" + strings.Replace(name, `\`, "/", -1))
+	if name == "/" {
+		return "."
+	}
+
+	return name[1:]
+}
+
+func (f *MemFS) info(name string, n *memFSNode) *memFSInfo {
+	return &memFSInfo{
+		name:  path.Base(name),
+		size:  int64(len(n.data)),
+		mode:  n.mode,
+		mtime: n.mtime,
+	}
+}
+
+// Open open file to read
+func (f *MemFS) Open(name string) (FSFile, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile open file with flag
+func (f *MemFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	key := memFSName(name)
+	f.Lock()
+	defer f.Unlock()
+
+	n, ok := f.nodes[key]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case ok && n.mode.IsDir() && isFSWriteFlag(flag):
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if parent, ok := f.nodes[path.Dir(key)]; !ok || !parent.mode.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+
+		n = &memFSNode{mode: perm.Perm(), mtime: Clock.GetUTCNow()}
+		f.nodes[key] = n
+	}
+
+	if flag&os.O_TRUNC != 0 && !n.mode.IsDir() {
+		n.data = nil
+		n.mtime = Clock.GetUTCNow()
+	}
+
+	return &memFile{
+		fs:    f,
+		name:  key,
+		node:  n,
+		flag:  flag,
+		isDir: n.mode.IsDir(),
+	}, nil
+}
+
+// Stat get file info
+func (f *MemFS) Stat(name string) (os.FileInfo, error) {
+	key := memFSName(name)
+	f.RLock()
+	defer f.RUnlock()
+
+	n, ok := f.nodes[key]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	return f.info(key, n), nil
+}
+
+// Lstat same as Stat
+func (f *MemFS) Lstat(name string) (os.FileInfo, error) {
+	return f.Stat(name)
+}
+
+// ReadDir list entries in dir
+func (f *MemFS) ReadDir(name string) (infos []os.FileInfo, err error) {
+	key := memFSName(name)
+	f.RLock()
+	defer f.RUnlock()
+
+	if n, ok := f.nodes[key]; !ok {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	} else if !n.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	for k, n := range f.nodes {
+		if k != "." && path.Dir(k) == key {
+			infos = append(infos, f.info(k, n))
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+// MkdirAll create dir and all parents
+func (f *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	key := memFSName(name)
+	f.Lock()
+	defer f.Unlock()
+
+	var dirs []string
+	for k := key; ; k = path.Dir(k) {
+		if n, ok := f.nodes[k]; ok {
+			if !n.mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+			}
+
+			break
+		}
+
+		dirs = append(dirs, k)
+	}
+
+	for _, k := range dirs {
+		f.nodes[k] = &memFSNode{mode: os.ModeDir | perm.Perm(), mtime: Clock.GetUTCNow()}
+	}
+
+	return nil
+}
+
+// Remove remove file or empty dir
+func (f *MemFS) Remove(name string) error {
+	key := memFSName(name)
+	f.Lock()
+	defer f.Unlock()
+
+	n, ok := f.nodes[key]
+	if !ok || key == "." {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if n.mode.IsDir() {
+		for k := range f.nodes {
+			if k != "." && path.Dir(k) == key {
+				return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+	}
+
+	delete(f.nodes, key)
+	return nil
+}
+
+// Chmod change permission bits
+func (f *MemFS) Chmod(name string, mode os.FileMode) error {
+	f.Lock()
+	defer f.Unlock()
+
+	n, ok := f.nodes[memFSName(name)]
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+
+	n.mode = n.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+// Chtimes change modification time, access time is ignored
+func (f *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	f.Lock()
+	defer f.Unlock()
+
+	n, ok := f.nodes[memFSName(name)]
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+
+	n.mtime = mtime
+	return nil
+}
+
+// memFile opened file of MemFS
+type memFile struct {
+	fs     *MemFS
+	name   string
+	node   *memFSNode
+	flag   int
+	isDir  bool
+	offset int64
+	closed bool
+}
+
+func (m *memFile) Read(p []byte) (n int, err error) {
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	if m.isDir {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: errors.New("is a directory")}
+	}
+
+	if n, err = m.ReadAt(p, m.offset); err == io.EOF && n > 0 {
+		err = nil
+	}
+	m.offset += int64(n)
+	return n, err
+}
+
+func (m *memFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	if m.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: errors.New("file not opened for reading")}
+	}
+
+	m.fs.RLock()
+	defer m.fs.RUnlock()
+
+	if off >= int64(len(m.node.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, m.node.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (m *memFile) Write(p []byte) (n int, err error) {
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	if m.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: m.name, Err: errors.New("file not opened for writing")}
+	}
+
+	m.fs.Lock()
+	defer m.fs.Unlock()
+
+	if m.flag&os.O_APPEND != 0 {
+		m.offset = int64(len(m.node.data))
+	}
+	if end := m.offset + int64(len(p)); end > int64(len(m.node.data)) {
+		// grow by append to amortize copying of sequential writes,
+		// bytes between old end and offset are zero
+		m.node.data = append(m.node.data, make([]byte, end-int64(len(m.node.data)))...)
+	}
+
+	n = copy(m.node.data[m.offset:], p)
+	m.offset += int64(n)
+	m.node.mtime = Clock.GetUTCNow()
+	return n, nil
+}
+
+func (m *memFile) Close() error {
+	if m.closed {
+		return os.ErrClosed
+	}
+
+	m.closed = true
+	return nil
+}
+
+func (m *memFile) Stat() (os.FileInfo, error) {
+	m.fs.RLock()
+	defer m.fs.RUnlock()
+	return m.fs.info(m.name, m.node), nil
+}
+
+// OverlayFS copy-on-write FS, reads from upper first then lower,
+// all modifications are written into upper, lower is never modified.
+//
+// removed files of lower are hidden by whiteouts kept in memory.
+type OverlayFS struct {
+	sync.Mutex
+	upper, lower FS
+	whiteouts    map[string]struct{}
+}
+
+// NewOverlayFS create overlay of upper on lower
+func NewOverlayFS(upper, lower FS) *OverlayFS {
+	return &OverlayFS{
+		upper:     upper,
+		lower:     lower,
+		whiteouts: map[string]struct{}{},
+	}
+}
+
+// isWhiteout whether name or any of its parents is removed
+func (f *OverlayFS) isWhiteout(name string) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	for k := memFSName(name); k != "."; k = path.Dir(k) {
+		if _, ok := f.whiteouts[k]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *OverlayFS) unWhiteout(name string) {
+	f.Lock()
+	defer f.Unlock()
+
+	for k := memFSName(name); k != "."; k = path.Dir(k) {
+		delete(f.whiteouts, k)
+	}
+}
+
+// stat get info from upper or lower, inUpper is true if found in upper
+func (f *OverlayFS) stat(name string, lstat bool) (info os.FileInfo, inUpper bool, err error) {
+	if f.isWhiteout(name) {
+		return nil, false, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	statFn := func(fsys FS) func(string) (os.FileInfo, error) {
+		if lstat {
+			return fsys.Lstat
+		}
+
+		return fsys.Stat
+	}
+
+	if info, err = statFn(f.upper)(name); err == nil {
+		return info, true, nil
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	info, err = statFn(f.lower)(name)
+	return info, false, err
+}
+
+// copyUp copy file or dir from lower into upper
+func (f *OverlayFS) copyUp(name string) error {
+	info, inUpper, err := f.stat(name, false)
+	if err != nil || inUpper {
+		return err
+	}
+
+	if info.IsDir() {
+		return f.upper.MkdirAll(name, info.Mode().Perm())
+	}
+	if err = f.upper.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+
+	data, err := readFileFS(f.lower, name)
+	if err != nil {
+		return err
+	}
+	if err = writeFileFS(f.upper, name, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	return f.upper.Chtimes(name, info.ModTime(), info.ModTime())
+}
+
+// Open open file to read
+func (f *OverlayFS) Open(name string) (FSFile, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile open file, file is copied into upper if opened to write
+func (f *OverlayFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	info, inUpper, err := f.stat(name, false)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if !isFSWriteFlag(flag) {
+		switch {
+		case err != nil:
+			return nil, err
+		case inUpper:
+			return f.upper.OpenFile(name, flag, perm)
+		default:
+			return f.lower.OpenFile(name, flag, perm)
+		}
+	}
+
+	switch {
+	case err != nil:
+		// create new file, parent dir should exist
+		if _, _, err = f.stat(filepath.Dir(name), false); err != nil {
+			return nil, err
+		}
+		if err = f.upper.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+			return nil, err
+		}
+	case !inUpper && !info.IsDir() && flag&os.O_TRUNC == 0:
+		if err = f.copyUp(name); err != nil {
+			return nil, err
+		}
+	case !inUpper:
+		if err = f.upper.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	fp, err := f.upper.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	f.unWhiteout(name)
+	return fp, nil
+}
+
+// Stat get file info
+func (f *OverlayFS) Stat(name string) (os.FileInfo, error) {
+	info, _, err := f.stat(name, false)
+	return info, err
+}
+
+// Lstat get file info, not follow symlinks
+func (f *OverlayFS) Lstat(name string) (os.FileInfo, error) {
+	info, _, err := f.stat(name, true)
+	return info, err
+}
+
+// ReadDir merge entries in upper and lower
+func (f *OverlayFS) ReadDir(name string) ([]os.FileInfo, error) {
+	if _, _, err := f.stat(name, false); err != nil {
+		return nil, err
+	}
+
+	merged := map[string]os.FileInfo{}
+	for _, fsys := range []FS{f.lower, f.upper} {
+		infos, err := fsys.ReadDir(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		for _, info := range infos {
+			merged[info.Name()] = info
+		}
+	}
+
+	infos := make([]os.FileInfo, 0, len(merged))
+	for fname, info := range merged {
+		if !f.isWhiteout(filepath.Join(name, fname)) {
+			infos = append(infos, info)
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+// MkdirAll create dir and all parents in upper
+func (f *OverlayFS) MkdirAll(name string, perm os.FileMode) error {
+	if info, _, err := f.stat(name, false); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+		}
+
+		return nil
+	}
+
+	if err := f.upper.MkdirAll(name, perm); err != nil {
+		return err
+	}
+
+	f.unWhiteout(name)
+	return nil
+}
+
+// Remove remove file or empty dir
+func (f *OverlayFS) Remove(name string) error {
+	info, inUpper, err := f.stat(name, false)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if infos, err := f.ReadDir(name); err != nil {
+			return err
+		} else if len(infos) != 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+
+	if inUpper {
+		if err = f.upper.Remove(name); err != nil {
+			return err
+		}
+	}
+	if _, err = f.lower.Lstat(name); err == nil {
+		f.Lock()
+		f.whiteouts[memFSName(name)] = struct{}{}
+		f.Unlock()
+	}
+
+	return nil
+}
+
+// Chmod change mode, file is copied into upper
+func (f *OverlayFS) Chmod(name string, mode os.FileMode) error {
+	if err := f.copyUp(name); err != nil {
+		return err
+	}
+
+	return f.upper.Chmod(name, mode)
+}
+
+// Chtimes change times, file is copied into upper
+func (f *OverlayFS) Chtimes(name string, atime, mtime time.Time) error {
+	if err := f.copyUp(name); err != nil {
+		return err
+	}
+
+	return f.upper.Chtimes(name, atime, mtime)
+}
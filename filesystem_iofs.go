@@ -0,0 +1,214 @@
+//go:build go1.17
+// +build go1.17
+
+package utils
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// iofsAdapter convert FS to io/fs.FS
+type iofsAdapter struct {
+	fsys FS
+}
+
+// ToIOFS convert FS to read-only `io/fs.FS`,
+// the result also implements `fs.StatFS` and `fs.ReadDirFS`
+func ToIOFS(fsys FS) fs.FS {
+	return &iofsAdapter{fsys: fsys}
+}
+
+// name validate name, backslash is invalid since MemFS treats it as separator
+func (a *iofsAdapter) name(op, name string) (string, error) {
+	if !fs.ValidPath(name) || strings.Contains(name, `\`) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return filepath.FromSlash(name), nil
+}
+
+// Open open file
+func (a *iofsAdapter) Open(name string) (fs.File, error) {
+	fpath, err := a.name("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := a.fsys.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := fp.Stat()
+	if err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	if !st.IsDir() {
+		return fp, nil
+	}
+
+	infos, err := a.fsys.ReadDir(fpath)
+	if err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+
+	return &iofsDir{FSFile: fp, infos: infos}, nil
+}
+
+// iofsDir implements fs.ReadDirFile
+type iofsDir struct {
+	FSFile
+	infos []os.FileInfo
+}
+
+// ReadDir return the next n entries, or all entries if n <= 0
+func (d *iofsDir) ReadDir(n int) (entries []fs.DirEntry, err error) {
+	if n > 0 && len(d.infos) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(d.infos) {
+		n = len(d.infos)
+	}
+
+	for _, info := range d.infos[:n] {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+
+	d.infos = d.infos[n:]
+	return entries, nil
+}
+
+// Stat get file info
+func (a *iofsAdapter) Stat(name string) (fs.FileInfo, error) {
+	fpath, err := a.name("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.fsys.Stat(fpath)
+}
+
+// ReadDir list entries in dir
+func (a *iofsAdapter) ReadDir(name string) ([]fs.DirEntry, error) {
+	fpath, err := a.name("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := a.fsys.ReadDir(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+
+	return entries, nil
+}
+
+// fromIOFS convert io/fs.FS to read-only FS
+type fromIOFS struct {
+	fsys fs.FS
+}
+
+// FromIOFS convert `io/fs.FS` (like `embed.FS`) to read-only FS,
+// names are converted to slash-separated paths relative to root.
+func FromIOFS(fsys fs.FS) FS {
+	return NewReadOnlyFS(&fromIOFS{fsys: fsys})
+}
+
+func (f *fromIOFS) name(name string) string {
+	return memFSName(name)
+}
+
+// Open open file to read
+func (f *fromIOFS) Open(name string) (FSFile, error) {
+	fp, err := f.fsys.Open(f.name(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &fromIOFSFile{File: fp, name: name}, nil
+}
+
+// OpenFile open file to read, flag is ignored
+func (f *fromIOFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	return f.Open(name)
+}
+
+// Stat get file info
+func (f *fromIOFS) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(f.fsys, f.name(name))
+}
+
+// Lstat same as Stat
+func (f *fromIOFS) Lstat(name string) (os.FileInfo, error) {
+	return f.Stat(name)
+}
+
+// ReadDir list entries in dir
+func (f *fromIOFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(f.fsys, f.name(name))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// MkdirAll return ErrFSReadOnly
+func (f *fromIOFS) MkdirAll(path string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: path, Err: ErrFSReadOnly}
+}
+
+// Remove return ErrFSReadOnly
+func (f *fromIOFS) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: ErrFSReadOnly}
+}
+
+// Chmod return ErrFSReadOnly
+func (f *fromIOFS) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: ErrFSReadOnly}
+}
+
+// Chtimes return ErrFSReadOnly
+func (f *fromIOFS) Chtimes(name string, atime, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: ErrFSReadOnly}
+}
+
+// fromIOFSFile wrap fs.File to FSFile
+type fromIOFSFile struct {
+	fs.File
+	name string
+}
+
+func (f *fromIOFSFile) ReadAt(p []byte, off int64) (int, error) {
+	if r, ok := f.File.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+
+	return 0, &os.PathError{Op: "readat", Path: f.name, Err: fs.ErrInvalid}
+}
+
+func (f *fromIOFSFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrFSReadOnly}
+}
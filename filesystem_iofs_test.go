@@ -0,0 +1,46 @@
+//go:build go1.17
+// +build go1.17
+
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFS(t *testing.T) {
+	fsys := NewMemFS()
+	if err := fsys.MkdirAll("dir/sub", 0755); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, name := range []string{"dir/a", "dir/sub/b", "c"} {
+		if err := writeFileFS(fsys, name, []byte(name), 0644); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	if err := fstest.TestFS(ToIOFS(fsys), "dir/a", "dir/sub/b", "c"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	back := FromIOFS(fstest.MapFS{
+		"dir/a": &fstest.MapFile{Data: []byte("a"), Mode: 0644},
+	})
+	if size, err := DirSizeFS(back, "."); err != nil || size != 1 {
+		t.Fatalf("got %d, %+v", size, err)
+	}
+	if got, err := readFileFS(back, "/dir/a"); err != nil || string(got) != "a" {
+		t.Fatalf("got %s, %+v", got, err)
+	}
+	if _, err := back.Stat("notexists"); !os.IsNotExist(err) {
+		t.Fatalf("got %+v", err)
+	}
+	if err := writeFileFS(back, "dir/b", nil, 0644); err == nil {
+		t.Fatal("should be read-only")
+	}
+	if _, err := fs.ReadFile(ToIOFS(fsys), "../c"); err == nil {
+		t.Fatal("should be invalid")
+	}
+}
@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestMemFS(t *testing.T) {
+	fsys := NewMemFS()
+	if err := writeFileFS(fsys, "a/b.txt", []byte("b"), 0644); !os.IsNotExist(err) {
+		t.Fatalf("parent not exists, got %+v", err)
+	}
+	if err := fsys.MkdirAll(`a\sub`, 0755); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := writeFileFS(fsys, "/a/b.txt", []byte("hello"), 0600); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// append and read back
+	fp, err := fsys.OpenFile("a/b.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = fp.Write([]byte(" world")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = fp.Read(make([]byte, 1)); err == nil {
+		t.Fatal("should not readable")
+	}
+	if err = fp.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got, err := readFileFS(fsys, "a/b.txt"); err != nil || string(got) != "hello world" {
+		t.Fatalf("got %s, %+v", got, err)
+	}
+
+	infos, err := fsys.ReadDir("a")
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("got %v, %+v", infos, err)
+	}
+	if infos[0].Name() != "b.txt" || infos[0].Size() != 11 || infos[0].Mode() != 0600 ||
+		infos[1].Name() != "sub" || !infos[1].IsDir() {
+		t.Fatalf("got %v", infos)
+	}
+
+	if err = fsys.Remove("a"); err == nil {
+		t.Fatal("dir not empty")
+	}
+	if _, err = fsys.OpenFile("a/b.txt", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); !os.IsExist(err) {
+		t.Fatalf("got %+v", err)
+	}
+	if err = fsys.Remove("a/b.txt"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = fsys.Stat("a/b.txt"); !os.IsNotExist(err) {
+		t.Fatalf("got %+v", err)
+	}
+}
+
+func TestOverlayFS(t *testing.T) {
+	lower := NewMemFS()
+	if err := lower.MkdirAll("dir", 0755); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, name := range []string{"dir/a", "dir/b", "c"} {
+		if err := writeFileFS(lower, name, []byte(name), 0644); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	upper := NewMemFS()
+	fsys := NewOverlayFS(upper, NewReadOnlyFS(lower))
+
+	// copy on write
+	fp, err := fsys.OpenFile("dir/a", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = fp.Write([]byte("+")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fp.Close()
+	if got, err := readFileFS(fsys, "dir/a"); err != nil || string(got) != "dir/a+" {
+		t.Fatalf("got %s, %+v", got, err)
+	}
+	if got, err := readFileFS(lower, "dir/a"); err != nil || string(got) != "dir/a" {
+		t.Fatalf("lower modified, got %s, %+v", got, err)
+	}
+
+	// whiteout
+	if err = fsys.Remove("dir/b"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = writeFileFS(fsys, "dir/new", []byte("new"), 0644); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	infos, err := fsys.ReadDir("dir")
+	if err != nil || len(infos) != 2 || infos[0].Name() != "a" || infos[1].Name() != "new" {
+		t.Fatalf("got %v, %+v", infos, err)
+	}
+	if _, err = lower.Stat("dir/b"); err != nil {
+		t.Fatalf("lower modified, %+v", err)
+	}
+
+	// recreate removed dir should not expose files in lower
+	for _, name := range []string{"dir/a", "dir/new", "dir"} {
+		if err = fsys.Remove(name); err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+	}
+	if err = fsys.MkdirAll("dir", 0755); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if infos, err = fsys.ReadDir("dir"); err != nil || len(infos) != 0 {
+		t.Fatalf("got %v, %+v", infos, err)
+	}
+
+	if err = lower.Remove("c"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = NewReadOnlyFS(lower).Remove("dir/a"); errors.Cause(err.(*os.PathError).Err) != ErrFSReadOnly {
+		t.Fatalf("got %+v", err)
+	}
+}
+
+func TestFSHelpers(t *testing.T) {
+	fsys := NewMemFS()
+	if err := fsys.MkdirAll("src/sub", 0755); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, name := range []string{"src/a.toml", "src/sub/b.toml"} {
+		if err := writeFileFS(fsys, name, []byte("12345"), 0644); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	if size, err := DirSizeFS(fsys, "src"); err != nil || size != 10 {
+		t.Fatalf("got %d, %+v", size, err)
+	}
+	if files, err := ListFilesInDirFS(fsys, "src"); err != nil ||
+		len(files) != 1 || files[0] != filepath.Join("src", "a.toml") {
+		t.Fatalf("got %v, %+v", files, err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := fsys.Chtimes("src/a.toml", mtime, mtime); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := CopyFileFS(fsys, "src/a.toml", "dst/a.toml"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if st, err := fsys.Stat("dst/a.toml"); err != nil || !st.ModTime().Equal(mtime) || st.Mode() != 0644 {
+		t.Fatalf("got %v, %+v", st, err)
+	}
+
+	if err := ZipFilesFS(fsys, "src.zip", []string{"src"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	files, err := UnzipFS(fsys, "src.zip", "unzip")
+	if err != nil || len(files) != 2 {
+		t.Fatalf("got %v, %+v", files, err)
+	}
+	if got, err := readFileFS(fsys, "unzip/src/sub/b.toml"); err != nil || string(got) != "12345" {
+		t.Fatalf("got %s, %+v", got, err)
+	}
+
+	secret := []byte("laisky")
+	if err = AESEncryptFilesInDirFS(fsys, "src", secret); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	cipher, err := readFileFS(fsys, "src/a.enc.toml")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got, err := DecryptByAes(secret, cipher); err != nil || string(got) != "12345" {
+		t.Fatalf("got %s, %+v", got, err)
+	}
+
+	// nothing written to disk
+	if _, err = os.Stat("src.zip"); !os.IsNotExist(err) {
+		t.Fatal("should not write to disk")
+	}
+
+	// read-only
+	if err = CopyFileFS(NewReadOnlyFS(fsys), "src/a.toml", "dst/b.toml"); err == nil {
+		t.Fatal("should error")
+	}
+
+	dir, err := ioutil.TempDir("", "TestFSHelpers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = CopyFileFS(NewOverlayFS(OSFS{}, fsys),
+		"src/a.toml", filepath.Join(dir, "a.toml")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "a.toml")); err != nil || string(got) != "12345" {
+		t.Fatalf("got %s, %+v", got, err)
+	}
+}
+
+func BenchmarkMemFSWrite(b *testing.B) {
+	fsys := NewMemFS()
+	fp, err := fsys.OpenFile("bench", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		b.Fatalf("%+v", err)
+	}
+	defer fp.Close()
+
+	data := make([]byte, 1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = fp.Write(data); err != nil {
+			b.Fatalf("%+v", err)
+		}
+	}
+}
@@ -1,21 +1,105 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
 
 	"github.com/Laisky/zap"
 	"github.com/pkg/errors"
 )
 
-// MoveFile move file from src to dst by copy
+// SymlinkPolicy how to handle symlinks
+type SymlinkPolicy int
+
+const (
+	// SymlinkSkip ignore symlinks
+	SymlinkSkip SymlinkPolicy = iota
+	// SymlinkKeep keep symlinks as symlinks
+	SymlinkKeep
+	// SymlinkFollow handle the file that symlink points to
+	SymlinkFollow
+)
+
+// pathMatcher filter paths by include/exclude globs.
+//
+// pattern is matched against both the slash-separated relative path and the base name.
+type pathMatcher struct {
+	includes, excludes []string
+}
+
+func validateGlobs(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid pattern `%s`", pattern)
+		}
+	}
+
+	return nil
+}
+
+func matchAnyGlob(patterns []string, name string) bool {
+	name = filepath.ToSlash(name)
+	base := filepath.Base(name)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// excluded is name or any of its parent dirs match any exclude pattern
+func (m *pathMatcher) excluded(name string) bool {
+	if len(m.excludes) == 0 {
+		return false
+	}
+
+	for name = filepath.Clean(name); name != "." && name != string(filepath.Separator); name = filepath.Dir(name) {
+		if matchAnyGlob(m.excludes, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// match is name match includes (or includes is empty) and not excluded
+func (m *pathMatcher) match(name string) bool {
+	if m.excluded(name) {
+		return false
+	}
+
+	return len(m.includes) == 0 || matchAnyGlob(m.includes, name)
+}
+
+// MoveFile move file from src to dst
 //
-// sometimes move file by `rename` not work.
+// try `rename` first, fallback to copy and remove if src and dst are on different devices.
 // for example, you can not move file between docker volumes by `rename`.
 func MoveFile(src, dst string) (err error) {
-	if err = CopyFile(src, dst); err != nil {
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return errors.Wrapf(err, "create dir `%s`", dst)
+	}
+
+	if err = os.Rename(src, dst); err == nil {
+		return nil
+	} else if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != syscall.EXDEV {
+		return errors.Wrapf(err, "rename `%s` to `%s`", src, dst)
+	}
+
+	Logger.Debug("cross device, move file by copy", zap.String("src", src), zap.String("dst", dst))
+	if err = CopyFileAtomic(src, dst); err != nil {
 		return err
 	}
 
@@ -56,35 +140,156 @@ func IsFile(path string) (bool, error) {
 	return !isdir, err
 }
 
-// CopyFile copy file content from src to dst
+// CopyFile copy file content from src to dst, preserve mode and mtime
 func CopyFile(src, dst string) (err error) {
-	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+	return CopyFileFS(OSFS{}, src, dst)
+}
+
+// CopyFileFS copy file content from src to dst in fsys, preserve mode and mtime
+func CopyFileFS(fsys FS, src, dst string) (err error) {
+	if err = fsys.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
 		return errors.Wrapf(err, "create dir `%s`", dst)
 	}
 
-	srcFp, err := os.Open(src)
+	srcFp, err := fsys.Open(src)
 	if err != nil {
 		return errors.Wrapf(err, "open file `%s`", src)
 	}
+	defer srcFp.Close()
+
+	st, err := srcFp.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "get stat of `%s`", src)
+	}
 
-	dstFp, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	dstFp, err := fsys.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, st.Mode().Perm())
 	if err != nil {
 		return errors.Wrapf(err, "open file `%s`", dst)
 	}
+	defer dstFp.Close()
 
 	var n int64
 	if n, err = io.Copy(dstFp, srcFp); err != nil {
 		return errors.Wrap(err, "copy file")
 	}
+	if err = dstFp.Close(); err != nil {
+		return errors.Wrapf(err, "close file `%s`", dst)
+	}
 	Logger.Debug("copy file", zap.String("dst", dst), zap.Int64("len", n))
 
+	return preserveFileStat(fsys, dst, st)
+}
+
+// preserveFileStat set mode and mtime of fpath same as st
+func preserveFileStat(fsys FS, fpath string, st os.FileInfo) error {
+	if err := fsys.Chmod(fpath, st.Mode().Perm()); err != nil {
+		return errors.Wrapf(err, "chmod `%s`", fpath)
+	}
+	if err := fsys.Chtimes(fpath, st.ModTime(), st.ModTime()); err != nil {
+		return errors.Wrapf(err, "chtimes `%s`", fpath)
+	}
+
 	return nil
 }
 
+// writeFileAtomic write into temp file in the same dir,
+// then fsync and rename to fpath, so fpath is either old or new content.
+func writeFileAtomic(fpath string, perm os.FileMode, write func(fp *os.File) error) (err error) {
+	dir := filepath.Dir(fpath)
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "create dir `%s`", dir)
+	}
+
+	fp, err := ioutil.TempFile(dir, "."+filepath.Base(fpath)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "create temp file")
+	}
+	defer func() {
+		if err != nil {
+			_ = fp.Close()
+			_ = os.Remove(fp.Name())
+		}
+	}()
+
+	if err = write(fp); err != nil {
+		return err
+	}
+	if err = fp.Chmod(perm); err != nil {
+		return errors.Wrapf(err, "chmod `%s`", fp.Name())
+	}
+	if err = fp.Sync(); err != nil {
+		return errors.Wrapf(err, "sync file `%s`", fp.Name())
+	}
+	if err = fp.Close(); err != nil {
+		return errors.Wrapf(err, "close file `%s`", fp.Name())
+	}
+	if err = os.Rename(fp.Name(), fpath); err != nil {
+		return errors.Wrapf(err, "rename to `%s`", fpath)
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir fsync dir to persist entries, not supported on windows
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	fp, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "open dir `%s`", dir)
+	}
+	defer fp.Close()
+
+	return errors.Wrapf(fp.Sync(), "sync dir `%s`", dir)
+}
+
+// WriteFileAtomic write data to file atomically,
+// file is either old content or new content even if crashed.
+func WriteFileAtomic(fpath string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(fpath, perm, func(fp *os.File) error {
+		_, err := fp.Write(data)
+		return errors.Wrapf(err, "write file `%s`", fp.Name())
+	})
+}
+
+// CopyFileAtomic copy file content from src to dst atomically, preserve mode and mtime
+func CopyFileAtomic(src, dst string) (err error) {
+	srcFp, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", src)
+	}
+	defer srcFp.Close()
+
+	st, err := srcFp.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "get stat of `%s`", src)
+	}
+
+	return writeFileAtomic(dst, st.Mode().Perm(), func(fp *os.File) error {
+		n, err := io.Copy(fp, srcFp)
+		if err != nil {
+			return errors.Wrap(err, "copy file")
+		}
+		if err = os.Chtimes(fp.Name(), st.ModTime(), st.ModTime()); err != nil {
+			return errors.Wrapf(err, "chtimes `%s`", fp.Name())
+		}
+
+		Logger.Debug("copy file", zap.String("dst", dst), zap.Int64("len", n))
+		return nil
+	})
+}
+
 // DirSize calculate directory size.
 // https://stackoverflow.com/a/32482941/2368737
 func DirSize(path string) (size int64, err error) {
-	err = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+	return DirSizeFS(OSFS{}, path)
+}
+
+// DirSizeFS calculate directory size in fsys
+func DirSizeFS(fsys FS, path string) (size int64, err error) {
+	err = WalkFS(fsys, path, func(_ string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -99,7 +304,12 @@ func DirSize(path string) (size int64, err error) {
 
 // ListFilesInDir list files in dir
 func ListFilesInDir(dir string) (files []string, err error) {
-	fs, err := ioutil.ReadDir(dir)
+	return ListFilesInDirFS(OSFS{}, dir)
+}
+
+// ListFilesInDirFS list files in dir of fsys
+func ListFilesInDirFS(fsys FS, dir string) (files []string, err error) {
+	fs, err := fsys.ReadDir(dir)
 	if err != nil {
 		return nil, errors.Wrapf(err, "read dir `%s`", dir)
 	}
@@ -114,3 +324,345 @@ func ListFilesInDir(dir string) (files []string, err error) {
 
 	return
 }
+
+type dirOption struct {
+	pathMatcher
+	symlink     SymlinkPolicy
+	compareHash bool
+	delete      bool
+}
+
+// DirOptFunc options for CopyDir, SyncDir and DiffDirs
+type DirOptFunc func(*dirOption) error
+
+// WithDirIncludes only handle files match any of glob patterns
+func WithDirIncludes(patterns ...string) DirOptFunc {
+	return func(opt *dirOption) error {
+		if err := validateGlobs(patterns); err != nil {
+			return err
+		}
+
+		opt.includes = append(opt.includes, patterns...)
+		return nil
+	}
+}
+
+// WithDirExcludes skip files and dirs match any of glob patterns
+func WithDirExcludes(patterns ...string) DirOptFunc {
+	return func(opt *dirOption) error {
+		if err := validateGlobs(patterns); err != nil {
+			return err
+		}
+
+		opt.excludes = append(opt.excludes, patterns...)
+		return nil
+	}
+}
+
+// WithDirSymlinkPolicy set how to handle symlinks, default is SymlinkKeep.
+//
+// SymlinkFollow only follows symlinks to files, symlinks to dirs are skipped.
+func WithDirSymlinkPolicy(policy SymlinkPolicy) DirOptFunc {
+	return func(opt *dirOption) error {
+		switch policy {
+		case SymlinkSkip, SymlinkKeep, SymlinkFollow:
+		default:
+			return errors.Errorf("unknown symlink policy %d", policy)
+		}
+
+		opt.symlink = policy
+		return nil
+	}
+}
+
+// WithDirCompareHash compare files by sha256 of content,
+// default is compare by size and mtime
+func WithDirCompareHash() DirOptFunc {
+	return func(opt *dirOption) error {
+		opt.compareHash = true
+		return nil
+	}
+}
+
+// WithDirSyncDelete remove files in dst that not exist in src when `SyncDir`
+func WithDirSyncDelete() DirOptFunc {
+	return func(opt *dirOption) error {
+		opt.delete = true
+		return nil
+	}
+}
+
+func newDirOption(opts []DirOptFunc) (*dirOption, error) {
+	opt := &dirOption{
+		symlink: SymlinkKeep,
+	}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	return opt, nil
+}
+
+// DirDiff difference between two dirs,
+// paths are slash-separated and relative to dir, sorted
+type DirDiff struct {
+	// Added files only exist in src
+	Added []string
+	// Removed files only exist in dst
+	Removed []string
+	// Modified files exist in both but different
+	Modified []string
+}
+
+type dirEntry struct {
+	path string
+	info os.FileInfo
+	// link target if entry is symlink
+	link string
+}
+
+// walkDirEntries list files (not dirs) in root, return map of relative path to entry.
+//
+// return empty map if root not exists and allowNotExist is true.
+func walkDirEntries(root string, opt *dirOption, allowNotExist bool) (entries map[string]*dirEntry, err error) {
+	entries = map[string]*dirEntry{}
+	if _, err = os.Stat(root); os.IsNotExist(err) && allowNotExist {
+		return entries, nil
+	}
+
+	err = filepath.Walk(root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "walk `%s`", fpath)
+		}
+
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return errors.Wrapf(err, "get relative path of `%s`", fpath)
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if opt.excluded(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+		if info.IsDir() || !opt.match(rel) {
+			return nil
+		}
+
+		entry := &dirEntry{path: fpath, info: info}
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch opt.symlink {
+			case SymlinkSkip:
+				return nil
+			case SymlinkKeep:
+				if entry.link, err = os.Readlink(fpath); err != nil {
+					return errors.Wrapf(err, "read link `%s`", fpath)
+				}
+			case SymlinkFollow:
+				if entry.info, err = os.Stat(fpath); err != nil {
+					return errors.Wrapf(err, "stat `%s`", fpath)
+				}
+				if entry.info.IsDir() {
+					Logger.Debug("skip symlink to dir", zap.String("path", fpath))
+					return nil
+				}
+			}
+		}
+		if !entry.info.Mode().IsRegular() && entry.info.Mode()&os.ModeSymlink == 0 {
+			Logger.Debug("skip special file", zap.String("path", fpath))
+			return nil
+		}
+
+		entries[rel] = entry
+		return nil
+	})
+
+	return entries, err
+}
+
+func fileSHA256(fpath string) ([]byte, error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer fp.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, fp); err != nil {
+		return nil, errors.Wrapf(err, "read file `%s`", fpath)
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// isDirEntryModified compare src and dst
+func isDirEntryModified(src, dst *dirEntry, compareHash bool) (bool, error) {
+	srcIsLink := src.info.Mode()&os.ModeSymlink != 0
+	dstIsLink := dst.info.Mode()&os.ModeSymlink != 0
+	switch {
+	case srcIsLink != dstIsLink:
+		return true, nil
+	case srcIsLink:
+		return src.link != dst.link, nil
+	case src.info.Size() != dst.info.Size():
+		return true, nil
+	case !compareHash:
+		return !src.info.ModTime().Equal(dst.info.ModTime()), nil
+	}
+
+	srcHash, err := fileSHA256(src.path)
+	if err != nil {
+		return false, err
+	}
+	dstHash, err := fileSHA256(dst.path)
+	if err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(srcHash, dstHash), nil
+}
+
+func diffDirEntries(srcEntries, dstEntries map[string]*dirEntry, opt *dirOption) (diff *DirDiff, err error) {
+	diff = new(DirDiff)
+	for rel, srcEntry := range srcEntries {
+		dstEntry, ok := dstEntries[rel]
+		if !ok {
+			diff.Added = append(diff.Added, rel)
+			continue
+		}
+
+		modified, err := isDirEntryModified(srcEntry, dstEntry, opt.compareHash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compare `%s`", rel)
+		}
+		if modified {
+			diff.Modified = append(diff.Modified, rel)
+		}
+	}
+	for rel := range dstEntries {
+		if _, ok := srcEntries[rel]; !ok {
+			diff.Removed = append(diff.Removed, rel)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Modified)
+	return diff, nil
+}
+
+// DiffDirs report files added, removed or modified in src compared with dst.
+//
+// dst not exists is treated as empty.
+func DiffDirs(src, dst string, opts ...DirOptFunc) (diff *DirDiff, err error) {
+	opt, err := newDirOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	srcEntries, err := walkDirEntries(src, opt, false)
+	if err != nil {
+		return nil, err
+	}
+	dstEntries, err := walkDirEntries(dst, opt, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffDirEntries(srcEntries, dstEntries, opt)
+}
+
+// copyDirEntry copy file or symlink to dst
+func copyDirEntry(entry *dirEntry, dst string, atomic bool) error {
+	if entry.info.Mode()&os.ModeSymlink == 0 {
+		if atomic {
+			return CopyFileAtomic(entry.path, dst)
+		}
+
+		return CopyFile(entry.path, dst)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return errors.Wrapf(err, "create dir `%s`", dst)
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove `%s`", dst)
+	}
+
+	return errors.Wrapf(os.Symlink(entry.link, dst), "create symlink `%s`", dst)
+}
+
+// CopyDir copy files in src into dst recursively, existing files will be overwritten.
+//
+// mode and mtime of files are preserved.
+func CopyDir(src, dst string, opts ...DirOptFunc) (err error) {
+	opt, err := newDirOption(opts)
+	if err != nil {
+		return err
+	}
+
+	entries, err := walkDirEntries(src, opt, false)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dst, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "create dir `%s`", dst)
+	}
+
+	for rel, entry := range entries {
+		if err = copyDirEntry(entry, filepath.Join(dst, filepath.FromSlash(rel)), false); err != nil {
+			return errors.Wrapf(err, "copy `%s`", rel)
+		}
+	}
+
+	return nil
+}
+
+// SyncDir copy only added or modified files from src into dst,
+// return the difference before sync.
+//
+// files are replaced atomically,
+// files only exist in dst are removed if `WithDirSyncDelete` is set.
+func SyncDir(src, dst string, opts ...DirOptFunc) (diff *DirDiff, err error) {
+	opt, err := newDirOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	srcEntries, err := walkDirEntries(src, opt, false)
+	if err != nil {
+		return nil, err
+	}
+	dstEntries, err := walkDirEntries(dst, opt, true)
+	if err != nil {
+		return nil, err
+	}
+	if diff, err = diffDirEntries(srcEntries, dstEntries, opt); err != nil {
+		return nil, err
+	}
+
+	for _, rels := range [][]string{diff.Added, diff.Modified} {
+		for _, rel := range rels {
+			if err = copyDirEntry(srcEntries[rel], filepath.Join(dst, filepath.FromSlash(rel)), true); err != nil {
+				return nil, errors.Wrapf(err, "copy `%s`", rel)
+			}
+		}
+	}
+
+	if opt.delete {
+		for _, rel := range diff.Removed {
+			if err = os.Remove(dstEntries[rel].path); err != nil {
+				return nil, errors.Wrapf(err, "remove `%s`", rel)
+			}
+		}
+	}
+
+	return diff, nil
+}
@@ -2,10 +2,12 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Laisky/zap"
 )
@@ -80,6 +82,63 @@ func TestCopyFile(t *testing.T) {
 	}
 }
 
+func TestCopyFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCopyFileAtomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err = WriteFileAtomic(src, []byte("short"), 0600); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err = os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for name, copyf := range map[string]func(src, dst string) error{
+		"CopyFile":       CopyFile,
+		"CopyFileAtomic": CopyFileAtomic,
+	} {
+		// dst is longer than src, should be truncated
+		dst := filepath.Join(dir, "sub", name)
+		if err = WriteFileAtomic(dst, []byte("very long content"), 0644); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		if err = copyf(src, dst); err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		got, err := ioutil.ReadFile(dst)
+		if err != nil || string(got) != "short" {
+			t.Fatalf("%s: got %s, %+v", name, got, err)
+		}
+
+		st, err := os.Stat(dst)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if st.Mode().Perm() != 0600 || !st.ModTime().Equal(mtime) {
+			t.Fatalf("%s: got %v, %v", name, st.Mode(), st.ModTime())
+		}
+	}
+
+	// no temp file left
+	fs, err := ioutil.ReadDir(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(fs) != 2 {
+		t.Fatalf("got %d files", len(fs))
+	}
+
+	if err = CopyFileAtomic(filepath.Join(dir, "notexists"), filepath.Join(dir, "dst")); err == nil {
+		t.Fatal("should error")
+	}
+}
+
 func TestMoveFile(t *testing.T) {
 	dir, err := ioutil.TempDir("", "TestMoveFile")
 	if err != nil {
@@ -153,3 +212,102 @@ func TestIsDirWritable(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestSyncDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSyncDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	write := func(fpath, content string) {
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err := ioutil.WriteFile(fpath, []byte(content), 0640); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err := os.Chtimes(fpath, mtime, mtime); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	for name, content := range map[string]string{
+		"a.txt":       "a",
+		"sub/b.txt":   "b",
+		"sub/c.log":   "c",
+		"skip/d.txt":  "d",
+		"sub/e/f.txt": "f",
+	} {
+		write(filepath.Join(src, name), content)
+	}
+	if err = os.Symlink("a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err = CopyDir(src, dst, WithDirExcludes("skip", "*.log")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "skip")); !os.IsNotExist(err) {
+		t.Fatal("skip should be excluded")
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "a.txt" {
+		t.Fatalf("got %s, %+v", link, err)
+	}
+	st, err := os.Stat(filepath.Join(dst, "sub", "e", "f.txt"))
+	if err != nil || st.Mode().Perm() != 0640 || !st.ModTime().Equal(mtime) {
+		t.Fatalf("got %v, %+v", st, err)
+	}
+
+	// same size and mtime, only detected by hash
+	write(filepath.Join(src, "a.txt"), "A")
+	write(filepath.Join(dst, "extra.txt"), "x")
+	diff, err := DiffDirs(src, dst, WithDirExcludes("skip", "*.log"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(diff.Added) != 0 || len(diff.Modified) != 0 ||
+		len(diff.Removed) != 1 || diff.Removed[0] != "extra.txt" {
+		t.Fatalf("got %+v", diff)
+	}
+
+	diff, err = SyncDir(src, dst, WithDirCompareHash(), WithDirSyncDelete(), WithDirIncludes("*.txt"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expect := DirDiff{
+		Added:    []string{"skip/d.txt"},
+		Removed:  []string{"extra.txt"},
+		Modified: []string{"a.txt"},
+	}
+	if fmt.Sprint(*diff) != fmt.Sprint(expect) {
+		t.Fatalf("got %+v", diff)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dst, "a.txt")); err != nil || string(got) != "A" {
+		t.Fatalf("got %s, %+v", got, err)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "extra.txt")); !os.IsNotExist(err) {
+		t.Fatal("extra.txt should be removed")
+	}
+
+	// synced
+	diff, err = DiffDirs(src, dst, WithDirCompareHash(), WithDirSymlinkPolicy(SymlinkFollow))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0] != "sub/c.log" ||
+		len(diff.Removed) != 0 || len(diff.Modified) != 0 {
+		t.Fatalf("got %+v", diff)
+	}
+
+	// dst not exists
+	diff, err = DiffDirs(src, filepath.Join(dir, "notexists"), WithDirSymlinkPolicy(SymlinkSkip))
+	if err != nil || len(diff.Added) != 5 {
+		t.Fatalf("got %+v, %+v", diff, err)
+	}
+	if _, err = DiffDirs(filepath.Join(dir, "notexists"), dst); err == nil {
+		t.Fatal("should error")
+	}
+}
@@ -8,9 +8,12 @@ require (
 	github.com/Laisky/zap v1.12.2
 	github.com/cespare/xxhash v1.1.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/json-iterator/go v1.1.10
-	github.com/klauspost/compress v1.11.4 // indirect
+	github.com/klauspost/compress v1.11.4
 	github.com/klauspost/pgzip v1.2.5
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.5
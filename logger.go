@@ -8,11 +8,11 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/Laisky/graphql"
 	zap "github.com/Laisky/zap"
-	"github.com/Laisky/zap/buffer"
 	"github.com/Laisky/zap/zapcore"
 	"github.com/pkg/errors"
 )
@@ -21,9 +21,12 @@ const (
 	// SampleRateDenominator sample rate = sample / SampleRateDenominator
 	SampleRateDenominator = 1000
 
-	defaultAlertPusherTimeout = 10 * time.Second
-	defaultAlertPusherBufSize = 20
-	defaultAlertHookLevel     = zapcore.ErrorLevel
+	defaultAlertPusherTimeout      = 10 * time.Second
+	defaultAlertPusherBufSize      = 20
+	defaultAlertHookLevel          = zapcore.ErrorLevel
+	defaultAlertHookDigestInterval = time.Minute
+	defaultAlertHookRateLimit      = 5 * time.Minute
+	defaultMailAlertMaxEntries     = 100
 
 	// LoggerLevelInfo Logger level info
 	LoggerLevelInfo = "info"
@@ -54,6 +57,8 @@ var (
 type LoggerType struct {
 	*zap.Logger
 	level zap.AtomicLevel
+	// fields added by `With`, used to build new cores like `WithRotateFile`
+	fields []zapcore.Field
 }
 
 // CreateNewDefaultLogger set default utils.Logger
@@ -88,13 +93,10 @@ func NewLoggerWithNameAndFormat(name, format, level string, opts ...zap.Option)
 		Level:            zl,
 		Development:      false,
 		Encoding:         format,
-		EncoderConfig:    zap.NewProductionEncoderConfig(),
+		EncoderConfig:    newLoggerEncoderConfig(),
 		OutputPaths:      []string{"stdout"},
 		ErrorOutputPaths: []string{"stderr"},
 	}
-	cfg.EncoderConfig.EncodeCaller = zapcore.ShortCallerEncoder
-	cfg.EncoderConfig.MessageKey = "message"
-	cfg.EncoderConfig.EncodeTime = zapcore.RFC3339TimeEncoder
 	if format == "console" {
 		cfg.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	}
@@ -112,6 +114,14 @@ func NewLoggerWithNameAndFormat(name, format, level string, opts ...zap.Option)
 	return l, l.ChangeLevel(level)
 }
 
+func newLoggerEncoderConfig() zapcore.EncoderConfig {
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.EncodeCaller = zapcore.ShortCallerEncoder
+	cfg.MessageKey = "message"
+	cfg.EncodeTime = zapcore.RFC3339TimeEncoder
+	return cfg
+}
+
 // Level get current level of logger
 func (l *LoggerType) Level() string {
 	return l.level.String()
@@ -170,6 +180,7 @@ func (l *LoggerType) Clone() *LoggerType {
 	return &LoggerType{
 		Logger: l.Logger.With(),
 		level:  l.level,
+		fields: l.fields,
 	}
 }
 
@@ -179,6 +190,7 @@ func (l *LoggerType) Named(s string) *LoggerType {
 	return &LoggerType{
 		Logger: l.Logger.Named(s),
 		level:  l.level,
+		fields: l.fields,
 	}
 }
 
@@ -188,6 +200,7 @@ func (l *LoggerType) With(fields ...zapcore.Field) *LoggerType {
 	return &LoggerType{
 		Logger: l.Logger.With(fields...),
 		level:  l.level,
+		fields: append(l.fields[:len(l.fields):len(l.fields)], fields...),
 	}
 }
 
@@ -197,9 +210,21 @@ func (l *LoggerType) WithOptions(opts ...zap.Option) *LoggerType {
 	return &LoggerType{
 		Logger: l.Logger.WithOptions(opts...),
 		level:  l.level,
+		fields: l.fields,
 	}
 }
 
+// WithRotateFile clone new Logger that also writes json logs into w,
+// shares the same level and fields added by `With` with current logger.
+// fields added by `WithOptions(zap.Fields(...))` are not written into w.
+func (l *LoggerType) WithRotateFile(w *RotateFileWriter) *LoggerType {
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(newLoggerEncoderConfig()), w, l.level).
+		With(l.fields)
+	return l.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, core)
+	}))
+}
+
 func init() {
 	var err error
 	if Logger, err = NewConsoleLoggerWithName("go-utils", "info"); err != nil {
@@ -213,6 +238,21 @@ func init() {
 // alert pusher hook
 // ================================
 
+// AlertPusherItf pusher sends log entries to alert backends
+type AlertPusherItf interface {
+	// GetZapHook get hook for zap logger
+	GetZapHook() func(zapcore.Entry, []zapcore.Field) error
+	// Close stop pusher and wait requests in flight finished
+	Close()
+}
+
+var (
+	_ AlertPusherItf = new(AlertPusher)
+	_ AlertPusherItf = new(PateoAlertPusher)
+	_ AlertPusherItf = new(MailAlertPusher)
+	_ AlertPusherItf = new(WebhookAlertPusher)
+)
+
 type alertMutation struct {
 	TelegramMonitorAlert struct {
 		Name graphql.String
@@ -223,20 +263,21 @@ type alertMutation struct {
 //
 // https://github.com/Laisky/laisky-blog-graphql/tree/master/telegram
 type AlertPusher struct {
-	*alertHookOption
+	*alertSender
 
-	cli        *graphql.Client
-	stopChan   chan struct{}
-	senderChan chan *alertMsg
+	cli *graphql.Client
 
 	token, alertType,
 	pushAPI string
 }
 
 type alertHookOption struct {
-	encPool *sync.Pool
-	level   zapcore.LevelEnabler
-	timeout time.Duration
+	encPool        *sync.Pool
+	level          zapcore.LevelEnabler
+	timeout        time.Duration
+	digestInterval time.Duration
+	rateLimit      time.Duration
+	header         http.Header
 }
 
 func newAlertHookOpt() *alertHookOption {
@@ -246,11 +287,149 @@ func newAlertHookOpt() *alertHookOption {
 				return zapcore.NewJSONEncoder(zapcore.EncoderConfig{})
 			},
 		},
-		level:   defaultAlertHookLevel,
-		timeout: defaultAlertPusherTimeout,
+		level:          defaultAlertHookLevel,
+		timeout:        defaultAlertPusherTimeout,
+		digestInterval: defaultAlertHookDigestInterval,
+		rateLimit:      defaultAlertHookRateLimit,
+		header:         http.Header{},
+	}
+}
+
+// AlertPayload log entry to be sent by alert pushers,
+// also used as data of WebhookAlertPusher's payload template
+type AlertPayload struct {
+	Logger  string
+	Level   string
+	Time    time.Time
+	Caller  string
+	Stack   string
+	Message string
+	// Fields fields encoded in json
+	Fields string
+	// Text all above in plain text
+	Text string
+}
+
+// newAlertPayload format log entry and fields into alert payload
+func (o *alertHookOption) newAlertPayload(e zapcore.Entry, fs []zapcore.Field) (*AlertPayload, error) {
+	enc := o.encPool.Get().(zapcore.Encoder)
+	defer o.encPool.Put(enc)
+
+	bb, err := enc.EncodeEntry(e, fs)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode fields")
+	}
+	fsb := bb.String()
+	bb.Free()
+
+	return &AlertPayload{
+		Logger:  e.LoggerName,
+		Level:   e.Level.String(),
+		Time:    e.Time,
+		Caller:  e.Caller.FullPath(),
+		Stack:   e.Stack,
+		Message: e.Message,
+		Fields:  strings.TrimSpace(fsb),
+		Text: "logger: " + e.LoggerName + "\n" +
+			"time: " + e.Time.Format(time.RFC3339Nano) + "\n" +
+			"level: " + e.Level.String() + "\n" +
+			"caller: " + e.Caller.FullPath() + "\n" +
+			"stack: " + e.Stack + "\n" +
+			"message: " + e.Message + "\n" +
+			fsb,
+	}, nil
+}
+
+// newZapHook build zap hook that calls send with entries enabled by level
+func (o *alertHookOption) newZapHook(send func(*AlertPayload) error) func(zapcore.Entry, []zapcore.Field) error {
+	return func(e zapcore.Entry, fs []zapcore.Field) error {
+		if !o.level.Enabled(e.Level) {
+			return nil
+		}
+
+		payload, err := o.newAlertPayload(e, fs)
+		if err != nil {
+			Logger.Debug("zapcore encode fields got error", zap.Error(err))
+			return nil
+		}
+		if err = send(payload); err != nil {
+			Logger.Debug("send alert got error", zap.Error(err))
+			return nil
+		}
+
+		return nil
+	}
+}
+
+// alertSender buffer alert jobs and run them in background one by one,
+// each job is limited by alert push timeout
+type alertSender struct {
+	*alertHookOption
+	stopOnce   sync.Once
+	stopChan   chan struct{}
+	senderChan chan func(context.Context) error
+	// wg wait background goroutines exit
+	wg sync.WaitGroup
+}
+
+func newAlertSender(ctx context.Context, opt *alertHookOption) *alertSender {
+	s := &alertSender{
+		alertHookOption: opt,
+		stopChan:        make(chan struct{}),
+		senderChan:      make(chan func(context.Context) error, defaultAlertPusherBufSize),
+	}
+
+	s.wg.Add(1)
+	go s.runSender(ctx)
+	return s
+}
+
+// enqueue put job into buffer, never blocks
+func (s *alertSender) enqueue(job func(context.Context) error) error {
+	select {
+	case <-s.stopChan:
+		return fmt.Errorf("sender closed")
+	default:
+	}
+
+	select {
+	case s.senderChan <- job:
+		return nil
+	default:
+		return fmt.Errorf("sender chan overflow")
+	}
+}
+
+func (s *alertSender) runSender(ctx context.Context) {
+	defer s.wg.Done()
+	for {
+		var job func(context.Context) error
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopChan:
+			return
+		case job = <-s.senderChan:
+		}
+
+		jobCtx, cancel := context.WithTimeout(ctx, s.timeout)
+		// only allow use debug level logger
+		if err := job(jobCtx); err != nil {
+			Logger.Debug("send alert", zap.Error(err))
+		}
+		cancel()
 	}
 }
 
+// Close stop sender and wait the running job finished,
+// alerts in buffer are dropped
+func (s *alertSender) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+	s.wg.Wait()
+}
+
 // AlertHookOptFunc option for create AlertHook
 type AlertHookOptFunc func(*alertHookOption)
 
@@ -277,10 +456,36 @@ func WithAlertPushTimeout(timeout time.Duration) AlertHookOptFunc {
 	}
 }
 
-type alertMsg struct {
-	alertType,
-	pushToken,
-	msg string
+// WithAlertHookDigestInterval merge alerts within interval into one digest,
+// only used by pushers support digest, like MailAlertPusher
+func WithAlertHookDigestInterval(interval time.Duration) AlertHookOptFunc {
+	if interval <= 0 {
+		Logger.Panic("interval must > 0")
+	}
+
+	return func(a *alertHookOption) {
+		a.digestInterval = interval
+	}
+}
+
+// WithAlertHookRateLimit send the same message at most once per interval,
+// 0 means no limit. only used by pushers support rate limit, like MailAlertPusher
+func WithAlertHookRateLimit(interval time.Duration) AlertHookOptFunc {
+	if interval < 0 {
+		Logger.Panic("interval must >= 0")
+	}
+
+	return func(a *alertHookOption) {
+		a.rateLimit = interval
+	}
+}
+
+// WithAlertHookHeader add HTTP header to requests,
+// only used by WebhookAlertPusher
+func WithAlertHookHeader(key, value string) AlertHookOptFunc {
+	return func(a *alertHookOption) {
+		a.header.Add(key, value)
+	}
 }
 
 // NewAlertPusher create new AlertPusher
@@ -296,18 +501,13 @@ func NewAlertPusher(ctx context.Context, pushAPI string, opts ...AlertHookOptFun
 	}
 
 	a = &AlertPusher{
-		alertHookOption: opt,
-		stopChan:        make(chan struct{}),
-		senderChan:      make(chan *alertMsg, defaultAlertPusherBufSize),
-
 		pushAPI: pushAPI,
 	}
-
 	a.cli = graphql.NewClient(a.pushAPI, &http.Client{
-		Timeout: a.timeout,
+		Timeout: opt.timeout,
 	})
 
-	go a.runSender(ctx)
+	a.alertSender = newAlertSender(ctx, opt)
 	return a, nil
 }
 
@@ -323,60 +523,23 @@ func NewAlertPusherWithAlertType(ctx context.Context, pushAPI string, alertType,
 	return a, nil
 }
 
-// Close close AlertPusher
-func (a *AlertPusher) Close() {
-	close(a.stopChan) // should close stopChan first
-	close(a.senderChan)
-}
-
 // SendWithType send alert with specific type, token and msg
 func (a *AlertPusher) SendWithType(alertType, pushToken, msg string) (err error) {
-	select {
-	case a.senderChan <- &alertMsg{
-		alertType: alertType,
-		pushToken: pushToken,
-		msg:       msg,
-	}:
-	default:
-		return fmt.Errorf("send channel overflow")
-	}
-
-	return nil
-}
-
-func (a *AlertPusher) runSender(ctx context.Context) {
-	var (
-		ok      bool
-		payload *alertMsg
-		err     error
-		query   = new(alertMutation)
-		vars    = map[string]interface{}{}
-	)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-a.stopChan:
-			return
-		case payload, ok = <-a.senderChan:
-			if !ok {
-				return
-			}
-		}
-
-		// only allow use debug level logger
-		Logger.Debug("send alert", zap.String("type", payload.alertType))
-		vars["type"] = graphql.String(payload.alertType)
-		vars["token"] = graphql.String(payload.pushToken)
-		vars["msg"] = graphql.String(payload.msg)
-		if err = a.cli.Mutate(ctx, query, vars); err != nil {
-			Logger.Debug("send alert mutation", zap.Error(err))
+	return a.enqueue(func(ctx context.Context) error {
+		Logger.Debug("send alert", zap.String("type", alertType))
+		if err := a.cli.Mutate(ctx, new(alertMutation), map[string]interface{}{
+			"type":  graphql.String(alertType),
+			"token": graphql.String(pushToken),
+			"msg":   graphql.String(msg),
+		}); err != nil {
+			return errors.Wrap(err, "send alert mutation")
 		}
 
 		Logger.Debug("send telegram msg",
-			zap.String("alert", payload.alertType),
-			zap.String("msg", payload.msg))
-	}
+			zap.String("alert", alertType),
+			zap.String("msg", msg))
+		return nil
+	})
 }
 
 // Send send with default alertType and pushToken
@@ -386,35 +549,9 @@ func (a *AlertPusher) Send(msg string) (err error) {
 
 // GetZapHook get hook for zap logger
 func (a *AlertPusher) GetZapHook() func(zapcore.Entry, []zapcore.Field) (err error) {
-	return func(e zapcore.Entry, fs []zapcore.Field) (err error) {
-		if !a.level.Enabled(e.Level) {
-			return nil
-		}
-
-		var bb *buffer.Buffer
-		enc := a.encPool.Get().(zapcore.Encoder)
-		if bb, err = enc.EncodeEntry(e, fs); err != nil {
-			Logger.Debug("zapcore encode fields got error", zap.Error(err))
-			return nil
-		}
-		fsb := bb.String()
-		bb.Reset()
-		a.encPool.Put(enc)
-
-		msg := "logger: " + e.LoggerName + "\n" +
-			"time: " + e.Time.Format(time.RFC3339Nano) + "\n" +
-			"level: " + e.Level.String() + "\n" +
-			"caller: " + e.Caller.FullPath() + "\n" +
-			"stack: " + e.Stack + "\n" +
-			"message: " + e.Message + "\n" +
-			fsb
-		if err = a.Send(msg); err != nil {
-			Logger.Debug("send alert got error", zap.Error(err))
-			return nil
-		}
-
-		return nil
-	}
+	return a.newZapHook(func(payload *AlertPayload) error {
+		return a.Send(payload.Text)
+	})
 }
 
 type pateoAlertMsg struct {
@@ -425,11 +562,9 @@ type pateoAlertMsg struct {
 
 // PateoAlertPusher alert pusher for pateo wechat service
 type PateoAlertPusher struct {
-	*alertHookOption
+	*alertSender
 	cli        *http.Client
 	api, token string
-
-	senderBufChan chan *pateoAlertMsg
 }
 
 // NewPateoAlertPusher create new PateoAlertPusher
@@ -440,103 +575,327 @@ func NewPateoAlertPusher(ctx context.Context, api, token string, opts ...AlertHo
 	}
 
 	p = &PateoAlertPusher{
-		alertHookOption: opt,
-		api:             api,
-		token:           token,
+		api:   api,
+		token: token,
 		cli: &http.Client{
 			Timeout: opt.timeout,
 		},
 	}
 
-	p.senderBufChan = make(chan *pateoAlertMsg, defaultAlertPusherBufSize)
-	go p.runSender(ctx)
-
+	p.alertSender = newAlertSender(ctx, opt)
 	return
 }
 
-func (p *PateoAlertPusher) runSender(ctx context.Context) {
-	var (
-		ok   bool
-		msg  *pateoAlertMsg
-		req  *http.Request
-		resp *http.Response
-		jb   []byte
-		err  error
-	)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg, ok = <-p.senderBufChan:
-			if !ok {
-				return
-			}
-		}
+// Send send alert msg
+func (p *PateoAlertPusher) Send(title, content string, ts time.Time) (err error) {
+	jb, err := json.Marshal(&pateoAlertMsg{
+		Title:   title,
+		Content: content,
+		Time:    ts.Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal msg to json")
+	}
 
-		if jb, err = json.Marshal(msg); err != nil {
-			Logger.Debug("marshal msg to json", zap.Error(err))
-			continue
-		}
-		if req, err = http.NewRequest("POST", p.api, bytes.NewBuffer(jb)); err != nil {
-			Logger.Debug("make pateo alert request", zap.Error(err))
-			continue
+	return p.enqueue(func(ctx context.Context) error {
+		req, err := http.NewRequest("POST", p.api, bytes.NewReader(jb))
+		if err != nil {
+			return errors.Wrap(err, "make pateo alert request")
 		}
+		req = req.WithContext(ctx)
 		req.Header.Add(HTTPHeaderContentType, HTTPHeaderContentTypeValJSON)
 		req.Header.Add("Authorization", "Bearer "+p.token)
-		if resp, err = p.cli.Do(req); err != nil {
-			Logger.Debug("http post pateo alert server", zap.Error(err))
-			continue
+		resp, err := p.cli.Do(req)
+		if err != nil {
+			return errors.Wrap(err, "http post pateo alert server")
 		}
-		if err = CheckResp(resp); err != nil {
-			Logger.Debug("pateo alert server return error", zap.Error(err))
-			continue
+		defer resp.Body.Close()
+
+		return errors.Wrap(CheckResp(resp), "pateo alert server return error")
+	})
+}
+
+// GetZapHook get hook for zap logger
+func (p *PateoAlertPusher) GetZapHook() func(zapcore.Entry, []zapcore.Field) (err error) {
+	return p.newZapHook(func(payload *AlertPayload) error {
+		return p.Send(payload.Logger+":"+payload.Message, payload.Text, payload.Time)
+	})
+}
+
+const (
+	// AlertWebhookTplSlack payload template for slack incoming webhook
+	AlertWebhookTplSlack = `{"text":{{json .Text}}}`
+	// AlertWebhookTplDingTalk payload template for dingtalk robot
+	AlertWebhookTplDingTalk = `{"msgtype":"text","text":{"content":{{json .Text}}}}`
+	// AlertWebhookTplFeishu payload template for feishu bot
+	AlertWebhookTplFeishu = `{"msg_type":"text","content":{"text":{{json .Text}}}}`
+	// AlertWebhookTplAlertmanager payload template for alertmanager `/api/v2/alerts`
+	AlertWebhookTplAlertmanager = `[{"labels":{"alertname":"log_alert","logger":{{json .Logger}},"level":{{json .Level}}},` +
+		`"annotations":{"summary":{{json .Message}},"description":{{json .Text}}},"startsAt":{{json .Time}}}]`
+)
+
+// webhookAlertTplFuncs functions can be used in payload template
+var webhookAlertTplFuncs = template.FuncMap{
+	// json encode value into json, strings should always be quoted by it
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// WebhookAlertPusher post alerts in json to webhook,
+// payload is rendered by text/template with AlertPayload,
+// see AlertWebhookTplSlack, AlertWebhookTplDingTalk, etc.
+type WebhookAlertPusher struct {
+	*alertSender
+	cli *http.Client
+	api string
+	tpl *template.Template
+}
+
+// NewWebhookAlertPusher create new WebhookAlertPusher post alerts to api,
+// use `{{json .Text}}` in payloadTpl to quote strings
+func NewWebhookAlertPusher(ctx context.Context, api, payloadTpl string, opts ...AlertHookOptFunc) (p *WebhookAlertPusher, err error) {
+	Logger.Debug("create new WebhookAlertPusher", zap.String("api", api))
+	if api == "" {
+		return nil, fmt.Errorf("api should not be empty")
+	}
+
+	opt := newAlertHookOpt()
+	for _, optf := range opts {
+		optf(opt)
+	}
+
+	p = &WebhookAlertPusher{
+		api: api,
+		cli: &http.Client{
+			Timeout: opt.timeout,
+		},
+	}
+	if p.tpl, err = template.New("payload").
+		Funcs(webhookAlertTplFuncs).
+		Option("missingkey=error").
+		Parse(payloadTpl); err != nil {
+		return nil, errors.Wrap(err, "parse payload template")
+	}
+
+	p.alertSender = newAlertSender(ctx, opt)
+	return p, nil
+}
+
+// Send render payload and post it to webhook in background
+func (p *WebhookAlertPusher) Send(payload *AlertPayload) (err error) {
+	buf := &bytes.Buffer{}
+	if err = p.tpl.Execute(buf, payload); err != nil {
+		return errors.Wrap(err, "render payload")
+	}
+	if !json.Valid(buf.Bytes()) {
+		return errors.Errorf("payload is not valid json: %s", buf.String())
+	}
+
+	return p.enqueue(func(ctx context.Context) error {
+		req, err := http.NewRequest("POST", p.api, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return errors.Wrap(err, "make webhook alert request")
+		}
+		req = req.WithContext(ctx)
+		for k, vs := range p.header {
+			req.Header[k] = vs
 		}
+		req.Header.Set(HTTPHeaderContentType, HTTPHeaderContentTypeValJSON)
+		resp, err := p.cli.Do(req)
+		if err != nil {
+			return errors.Wrap(err, "http post webhook")
+		}
+		defer resp.Body.Close()
+
+		return errors.Wrap(CheckResp(resp), "webhook return error")
+	})
+}
+
+// GetZapHook get hook for zap logger
+func (p *WebhookAlertPusher) GetZapHook() func(zapcore.Entry, []zapcore.Field) (err error) {
+	return p.newZapHook(p.Send)
+}
+
+// mailAlertEntry alert waiting to be sent in digest
+type mailAlertEntry struct {
+	key, msg string
+	time     time.Time
+}
+
+// MailAlertPusher send alerts by email,
+// alerts within digest interval are merged into one email,
+// the same message is sent at most once per rate limit interval.
+type MailAlertPusher struct {
+	*alertSender
+	mail *Mail
+	from string
+	to   []string
+
+	// mu protect digest and rate limit states below
+	mu         sync.Mutex
+	entries    []*mailAlertEntry
+	suppressed int
+	lastSent   map[string]time.Time
+}
+
+// NewMailAlertPusher create new MailAlertPusher sends alerts from `from` to `to`
+func NewMailAlertPusher(ctx context.Context, mail *Mail, from string, to []string, opts ...AlertHookOptFunc) (p *MailAlertPusher, err error) {
+	if mail == nil {
+		return nil, fmt.Errorf("mail should not be nil")
+	}
+	if from == "" || len(to) == 0 {
+		return nil, fmt.Errorf("from and to should not be empty")
 	}
+
+	opt := newAlertHookOpt()
+	for _, optf := range opts {
+		optf(opt)
+	}
+
+	p = &MailAlertPusher{
+		mail:     mail,
+		from:     from,
+		to:       to,
+		lastSent: map[string]time.Time{},
+	}
+	p.alertSender = newAlertSender(ctx, opt)
+
+	p.wg.Add(1)
+	go p.runDigest(ctx)
+	return p, nil
 }
 
-// Send send alert msg
-func (p *PateoAlertPusher) Send(title, content string, ts time.Time) (err error) {
+// Close send pending alerts and stop pusher
+func (p *MailAlertPusher) Close() {
+	p.alertSender.Close()
+
+	p.mu.Lock()
+	job := p.popDigest()
+	p.mu.Unlock()
+	if job == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	// only allow use debug level logger
+	if err := job(ctx); err != nil {
+		Logger.Debug("send alert digest", zap.Error(err))
+	}
+}
+
+// Send put alert msg into digest, key is used to rate limit
+func (p *MailAlertPusher) Send(key, msg string) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	select {
-	case p.senderBufChan <- &pateoAlertMsg{
-		Title:   title,
-		Content: content,
-		Time:    ts.Format(time.RFC3339Nano),
-	}:
-		return nil
+	case <-p.stopChan:
+		return fmt.Errorf("sender closed")
 	default:
-		return fmt.Errorf("sender chan overflow")
 	}
+
+	now := Clock.GetUTCNow()
+	if t, ok := p.lastSent[key]; ok && now.Sub(t) < p.rateLimit {
+		p.suppressed++
+		return nil
+	}
+	if len(p.entries) >= defaultMailAlertMaxEntries {
+		p.suppressed++
+		return nil
+	}
+
+	p.entries = append(p.entries, &mailAlertEntry{
+		key:  key,
+		msg:  msg,
+		time: now,
+	})
+	// only alerts in digest start rate limit window
+	if p.rateLimit > 0 {
+		p.lastSent[key] = now
+	}
+	return nil
 }
 
-// GetZapHook get hook for zap logger
-func (p *PateoAlertPusher) GetZapHook() func(zapcore.Entry, []zapcore.Field) (err error) {
-	return func(e zapcore.Entry, fs []zapcore.Field) (err error) {
-		if !p.level.Enabled(e.Level) {
-			return nil
+// popDigest return job to send pending alerts, return nil if no alerts.
+// should be called with p.mu locked.
+func (p *MailAlertPusher) popDigest() func(context.Context) error {
+	now := Clock.GetUTCNow()
+	for key, t := range p.lastSent {
+		if now.Sub(t) >= p.rateLimit {
+			delete(p.lastSent, key)
+		}
+	}
+	if len(p.entries) == 0 {
+		return nil
+	}
+
+	entries, suppressed := p.entries, p.suppressed
+	p.entries = nil
+	p.suppressed = 0
+	return func(ctx context.Context) error {
+		return p.sendDigest(ctx, entries, suppressed)
+	}
+}
+
+// runDigest put pending alerts into sender every digest interval
+func (p *MailAlertPusher) runDigest(ctx context.Context) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.digestInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
 		}
 
-		var bb *buffer.Buffer
-		enc := p.encPool.Get().(zapcore.Encoder)
-		if bb, err = enc.EncodeEntry(e, fs); err != nil {
-			Logger.Debug("zapcore encode fields got error", zap.Error(err))
-			return nil
+		p.mu.Lock()
+		job := p.popDigest()
+		p.mu.Unlock()
+		if job == nil {
+			continue
 		}
-		fsb := bb.String()
-		bb.Reset()
-		p.encPool.Put(enc)
-		msg := "logger: " + e.LoggerName + "\n" +
-			"time: " + e.Time.Format(time.RFC3339Nano) + "\n" +
-			"level: " + e.Level.String() + "\n" +
-			"caller: " + e.Caller.FullPath() + "\n" +
-			"stack: " + e.Stack + "\n" +
-			"message: " + e.Message + "\n" +
-			fsb
 
-		if err = p.Send(e.LoggerName+":"+e.Message, msg, e.Time); err != nil {
-			Logger.Debug("send alert got error", zap.Error(err))
-			return nil
+		// only allow use debug level logger
+		if err := p.enqueue(job); err != nil {
+			Logger.Debug("send alert digest", zap.Error(err))
 		}
+	}
+}
 
-		return nil
+// sendDigest send entries in one email, interrupted when ctx done
+func (p *MailAlertPusher) sendDigest(ctx context.Context, entries []*mailAlertEntry, suppressed int) error {
+	Logger.Debug("send alert digest", zap.Int("n", len(entries)))
+	msgs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		msgs = append(msgs, entry.msg)
+	}
+
+	msg := NewMailMessage().
+		From(p.from, "").
+		Subject("[alert] {{.n}} alerts, {{.suppressed}} suppressed").
+		TextBody("{{range .msgs}}{{.}}\n----------------\n{{end}}").
+		Data(map[string]interface{}{
+			"n":          len(entries),
+			"suppressed": suppressed,
+			"msgs":       msgs,
+		})
+	for _, to := range p.to {
+		msg.To(to, "")
 	}
+
+	return p.mail.SendMessageCtx(ctx, msg)
+}
+
+// GetZapHook get hook for zap logger
+func (p *MailAlertPusher) GetZapHook() func(zapcore.Entry, []zapcore.Field) (err error) {
+	return p.newZapHook(func(payload *AlertPayload) error {
+		return p.Send(payload.Logger+":"+payload.Message, payload.Text)
+	})
 }
@@ -3,6 +3,11 @@ package utils
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -199,3 +204,310 @@ func ExampleAlertPusher() {
 // 	time.Sleep(1 * time.Second)
 // 	t.Error()
 // }
+
+func TestAlertSenderClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newAlertSender(ctx, newAlertHookOpt())
+	started := make(chan struct{})
+	var finished int32
+	if err := s.enqueue(func(ctx context.Context) error {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		return nil
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	<-started
+	s.Close()
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Fatal("close should wait running job")
+	}
+	if err := s.enqueue(func(ctx context.Context) error { return nil }); err == nil {
+		t.Fatal("should error after close")
+	}
+}
+
+func TestMailAlertPusher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestSMTPServer(t)
+	defer srv.ln.Close()
+
+	pusher, err := NewMailAlertPusher(ctx,
+		NewMail("127.0.0.1", srv.port()),
+		"from@example.com",
+		[]string{"to@example.com"},
+		WithAlertHookDigestInterval(time.Hour),
+		WithAlertHookRateLimit(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	logger := Logger.Named("mail_alert").WithOptions(
+		zap.HooksWithFields(pusher.GetZapHook()),
+	)
+
+	logger.Warn("should not be sent")
+	for i := 0; i < 3; i++ {
+		logger.Error("boom", zap.Int("i", i))
+	}
+	logger.Error("another")
+	pusher.Close()
+	pusher.Close()
+	if err = pusher.Send("key", "after close"); err == nil {
+		t.Fatal("should error after close")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.msgs) != 1 {
+		t.Fatalf("got %d", len(srv.msgs))
+	}
+	msg := srv.msgs[0]
+	for _, want := range []string{
+		"Subject: [alert] 2 alerts, 2 suppressed",
+		"message: boom",
+		"message: another",
+		`"i":0`,
+	} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("%q not found in %s", want, msg)
+		}
+	}
+	if strings.Contains(msg, "should not be sent") || strings.Contains(msg, `"i":1`) {
+		t.Fatalf("got %s", msg)
+	}
+}
+
+func TestMailAlertPusherDigest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestSMTPServer(t)
+	defer srv.ln.Close()
+
+	pusher, err := NewMailAlertPusher(ctx,
+		NewMail("127.0.0.1", srv.port()),
+		"from@example.com",
+		[]string{"to@example.com"},
+		WithAlertHookDigestInterval(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer pusher.Close()
+
+	if err = pusher.Send("key", "msg"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; ; i++ {
+		srv.mu.Lock()
+		n := len(srv.msgs)
+		srv.mu.Unlock()
+		if n == 1 {
+			break
+		} else if i > 100 {
+			t.Fatalf("got %d", n)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestMailAlertPusherRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestSMTPServer(t)
+	defer srv.ln.Close()
+
+	pusher, err := NewMailAlertPusher(ctx,
+		NewMail("127.0.0.1", srv.port()),
+		"from@example.com",
+		[]string{"to@example.com"},
+		WithAlertHookDigestInterval(time.Hour),
+		WithAlertHookRateLimit(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer pusher.Close()
+
+	for i := 0; i < defaultMailAlertMaxEntries; i++ {
+		if err = pusher.Send(fmt.Sprint(i), "msg"); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	// dropped by full digest, should not start rate limit window
+	if err = pusher.Send("full", "msg"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	pusher.mu.Lock()
+	defer pusher.mu.Unlock()
+	if pusher.popDigest() == nil {
+		t.Fatal("should have digest")
+	}
+	pusher.mu.Unlock()
+	if err = pusher.Send("full", "msg"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	pusher.mu.Lock()
+	if len(pusher.entries) != 1 || pusher.entries[0].key != "full" {
+		t.Fatalf("got %d", len(pusher.entries))
+	}
+}
+
+func TestMailAlertPusherTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// server accept connection but never response
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	pusher, err := NewMailAlertPusher(ctx,
+		NewMail("127.0.0.1", ln.Addr().(*net.TCPAddr).Port),
+		"from@example.com",
+		[]string{"to@example.com"},
+		WithAlertHookDigestInterval(time.Hour),
+		WithAlertPushTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err = pusher.Send("key", "msg"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	start := time.Now()
+	pusher.Close()
+	if cost := time.Since(start); cost > 5*time.Second {
+		t.Fatalf("cost %s", cost)
+	}
+}
+
+func TestWebhookAlertPusher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "abc" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received <- body
+	}))
+	defer srv.Close()
+
+	if _, err := NewWebhookAlertPusher(ctx, srv.URL, `{"text":{{.Text}`); err == nil {
+		t.Fatal("should error with invalid template")
+	}
+
+	pusher, err := NewWebhookAlertPusher(ctx, srv.URL,
+		`{"text":{{json .Text}},"level":{{json .Level}},"fields":{{.Fields}}}`,
+		WithAlertHookHeader("X-Token", "abc"),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer pusher.Close()
+
+	var _ AlertPusherItf = pusher
+	logger := Logger.Named("webhook").WithOptions(
+		zap.HooksWithFields(pusher.GetZapHook()),
+	)
+	logger.Warn("should not be sent")
+	logger.Error(`say "hi"`, zap.String("yo", "hello"))
+
+	select {
+	case body := <-received:
+		if !strings.Contains(body["text"].(string), `message: say "hi"`) ||
+			body["level"] != "error" ||
+			body["fields"].(map[string]interface{})["yo"] != "hello" {
+			t.Fatalf("got %+v", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case body := <-received:
+		t.Fatalf("got %+v", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err = pusher.Send(&AlertPayload{Message: "yo", Fields: "{}"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	<-received
+
+	pusher.Close()
+	if err = pusher.Send(&AlertPayload{Message: "yo", Fields: "{}"}); err == nil {
+		t.Fatal("should error after closed")
+	}
+}
+
+func TestWebhookAlertPusherTpl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	payload := &AlertPayload{
+		Logger:  "test",
+		Level:   "error",
+		Time:    time.Now(),
+		Message: `say "hi"`,
+		Text:    "message: say \"hi\"\n\t",
+	}
+	for _, tpl := range []string{
+		AlertWebhookTplSlack,
+		AlertWebhookTplDingTalk,
+		AlertWebhookTplFeishu,
+		AlertWebhookTplAlertmanager,
+	} {
+		pusher, err := NewWebhookAlertPusher(ctx, "http://127.0.0.1:1", tpl)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		// render error would be returned immediately
+		if err = pusher.Send(payload); err != nil {
+			t.Fatalf("%s: %+v", tpl, err)
+		}
+		pusher.Close()
+	}
+
+	pusher, err := NewWebhookAlertPusher(ctx, "http://127.0.0.1:1", `{"text":"{{.Message}}"}`)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer pusher.Close()
+	if err = pusher.Send(payload); err == nil {
+		t.Fatal("should error with invalid json")
+	}
+}
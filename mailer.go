@@ -0,0 +1,748 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMailerQueueSize     = 100
+	defaultMailerWorkers       = 2
+	defaultMailerMaxRetry      = 3
+	defaultMailerRetryBackoff  = time.Second
+	defaultSMTPMaxConns        = 2
+	defaultSMTPIdleTimeout     = 30 * time.Second
+	defaultSMTPDialTimeout     = 10 * time.Second
+	defaultSMTPCommandDeadline = time.Minute
+)
+
+var (
+	// ErrMailerQueueFull mail queue is full
+	ErrMailerQueueFull = errors.New("mail queue is full")
+	// ErrMailerClosed mailer is closed
+	ErrMailerClosed = errors.New("mailer is closed")
+)
+
+// MailTransport send raw message to recipients, should be safe for concurrent use
+type MailTransport interface {
+	Send(ctx context.Context, from string, to []string, msg io.WriterTo) error
+	Close() error
+}
+
+// IsMailTemporaryErr whether err is temporary SMTP error (4xx) or network error,
+// temporary errors are retried by Mailer
+func IsMailTemporaryErr(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case *textproto.Error:
+		return err.Code >= 400 && err.Code < 500
+	case net.Error:
+		return true
+	}
+
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// MailTLSMode how to secure connection to SMTP server
+type MailTLSMode int
+
+const (
+	// MailTLSStartTLS upgrade by STARTTLS, fail if server not support
+	MailTLSStartTLS MailTLSMode = iota
+	// MailTLSStartTLSOptional upgrade by STARTTLS if server support
+	MailTLSStartTLSOptional
+	// MailTLSImplicit connect by TLS directly, usually on port 465
+	MailTLSImplicit
+	// MailTLSNone plain text connection
+	MailTLSNone
+)
+
+type smtpTransportOption struct {
+	username, password string
+	tlsMode            MailTLSMode
+	tlsConfig          *tls.Config
+	maxConns           int
+	idleTimeout        time.Duration
+	dialTimeout        time.Duration
+	localName          string
+}
+
+// SMTPTransportOptFunc options for SMTPTransport
+type SMTPTransportOptFunc func(*smtpTransportOption) error
+
+// WithSMTPAuth login by PLAIN auth
+func WithSMTPAuth(username, password string) SMTPTransportOptFunc {
+	return func(opt *smtpTransportOption) error {
+		opt.username = username
+		opt.password = password
+		return nil
+	}
+}
+
+// WithSMTPTLSMode set tls mode, default is MailTLSStartTLS
+func WithSMTPTLSMode(mode MailTLSMode) SMTPTransportOptFunc {
+	return func(opt *smtpTransportOption) error {
+		switch mode {
+		case MailTLSStartTLS, MailTLSStartTLSOptional, MailTLSImplicit, MailTLSNone:
+		default:
+			return errors.Errorf("unknown tls mode %d", mode)
+		}
+
+		opt.tlsMode = mode
+		return nil
+	}
+}
+
+// WithSMTPTLSConfig set tls config, default verifies server by host
+func WithSMTPTLSConfig(cfg *tls.Config) SMTPTransportOptFunc {
+	return func(opt *smtpTransportOption) error {
+		if cfg == nil {
+			return errors.Errorf("tls config is nil")
+		}
+
+		opt.tlsConfig = cfg
+		return nil
+	}
+}
+
+// WithSMTPMaxConns set max number of connections, default is 2
+func WithSMTPMaxConns(n int) SMTPTransportOptFunc {
+	return func(opt *smtpTransportOption) error {
+		if n <= 0 {
+			return errors.Errorf("max conns must > 0")
+		}
+
+		opt.maxConns = n
+		return nil
+	}
+}
+
+// WithSMTPIdleTimeout close connections idle longer than timeout, default is 30s
+func WithSMTPIdleTimeout(timeout time.Duration) SMTPTransportOptFunc {
+	return func(opt *smtpTransportOption) error {
+		if timeout <= 0 {
+			return errors.Errorf("timeout must > 0")
+		}
+
+		opt.idleTimeout = timeout
+		return nil
+	}
+}
+
+// WithSMTPDialTimeout set timeout to connect, default is 10s
+func WithSMTPDialTimeout(timeout time.Duration) SMTPTransportOptFunc {
+	return func(opt *smtpTransportOption) error {
+		if timeout <= 0 {
+			return errors.Errorf("timeout must > 0")
+		}
+
+		opt.dialTimeout = timeout
+		return nil
+	}
+}
+
+// WithSMTPLocalName set hostname sent in HELO, default is `localhost`
+func WithSMTPLocalName(name string) SMTPTransportOptFunc {
+	return func(opt *smtpTransportOption) error {
+		if name == "" {
+			return errors.Errorf("name should not be empty")
+		}
+
+		opt.localName = name
+		return nil
+	}
+}
+
+// smtpConn pooled connection
+type smtpConn struct {
+	conn     net.Conn
+	cli      *smtp.Client
+	lastUsed time.Time
+}
+
+func (c *smtpConn) close() {
+	if err := c.cli.Quit(); err != nil {
+		_ = c.cli.Close()
+	}
+}
+
+// SMTPTransport MailTransport reuses connections to SMTP server
+type SMTPTransport struct {
+	*smtpTransportOption
+	addr, host string
+
+	mu     sync.Mutex
+	idle   []*smtpConn
+	sem    chan struct{}
+	closed bool
+}
+
+// NewSMTPTransport create SMTPTransport, connections are created lazily
+func NewSMTPTransport(host string, port int, opts ...SMTPTransportOptFunc) (t *SMTPTransport, err error) {
+	opt := &smtpTransportOption{
+		tlsMode:     MailTLSStartTLS,
+		maxConns:    defaultSMTPMaxConns,
+		idleTimeout: defaultSMTPIdleTimeout,
+		dialTimeout: defaultSMTPDialTimeout,
+		localName:   "localhost",
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+	if opt.tlsConfig == nil {
+		opt.tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	return &SMTPTransport{
+		smtpTransportOption: opt,
+		addr:                net.JoinHostPort(host, strconv.Itoa(port)),
+		host:                host,
+		sem:                 make(chan struct{}, opt.maxConns),
+	}, nil
+}
+
+func (t *SMTPTransport) dial(ctx context.Context) (c *smtpConn, err error) {
+	dialer := &net.Dialer{Timeout: t.dialTimeout}
+	c = &smtpConn{}
+	if c.conn, err = dialer.DialContext(ctx, "tcp", t.addr); err != nil {
+		return nil, errors.Wrapf(err, "dial `%s`", t.addr)
+	}
+	rawConn := c.conn
+	if t.tlsMode == MailTLSImplicit {
+		tlsConn := tls.Client(c.conn, t.tlsConfig)
+		if err = tlsHandshake(ctx, tlsConn, t.dialTimeout); err != nil {
+			_ = c.conn.Close()
+			return nil, errors.Wrapf(err, "tls handshake `%s`", t.addr)
+		}
+
+		c.conn = tlsConn
+	}
+
+	if err = c.conn.SetDeadline(commandDeadline(ctx)); err != nil {
+		_ = c.conn.Close()
+		return nil, errors.Wrap(err, "set deadline")
+	}
+
+	// conn wrapped by STARTTLS is interrupted by deadline of raw conn
+	stop := interruptConnOnCtxDone(ctx, rawConn)
+	if c.cli, err = smtp.NewClient(c.conn, t.host); err != nil {
+		err = errors.Wrap(err, "new smtp client")
+	} else {
+		err = t.handshake(c.cli)
+	}
+	if stop() && err != nil {
+		err = errors.Wrapf(ctx.Err(), "connect `%s`: %v", t.addr, err)
+	}
+	if err != nil {
+		_ = c.conn.Close()
+		return nil, err
+	}
+
+	Logger.Debug("connect to smtp server", zap.String("addr", t.addr))
+	return c, nil
+}
+
+// tlsHandshake run tls handshake, interrupted when ctx done or timeout
+func tlsHandshake(ctx context.Context, conn *tls.Conn, timeout time.Duration) (err error) {
+	if timeout > 0 {
+		if err = conn.SetDeadline(Clock.GetUTCNow().Add(timeout)); err != nil {
+			return errors.Wrap(err, "set deadline")
+		}
+	}
+
+	stop := interruptConnOnCtxDone(ctx, conn)
+	err = conn.Handshake()
+	if stop() && err != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// commandDeadline return deadline of SMTP commands, not later than ctx deadline
+func commandDeadline(ctx context.Context) time.Time {
+	deadline := Clock.GetUTCNow().Add(defaultSMTPCommandDeadline)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	return deadline
+}
+
+// interruptConnOnCtxDone interrupt blocking io of conn when ctx done.
+// stop must be called after io finished, return whether conn is interrupted.
+func interruptConnOnCtxDone(ctx context.Context, conn net.Conn) (stop func() (interrupted bool)) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	var interrupted bool
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+			interrupted = true
+		case <-done:
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		<-stopped
+		return interrupted
+	}
+}
+
+func (t *SMTPTransport) handshake(cli *smtp.Client) (err error) {
+	if err = cli.Hello(t.localName); err != nil {
+		return errors.Wrap(err, "hello")
+	}
+
+	switch t.tlsMode {
+	case MailTLSStartTLS, MailTLSStartTLSOptional:
+		if ok, _ := cli.Extension("STARTTLS"); ok {
+			if err = cli.StartTLS(t.tlsConfig); err != nil {
+				return errors.Wrap(err, "starttls")
+			}
+		} else if t.tlsMode == MailTLSStartTLS {
+			return errors.Errorf("server `%s` not support STARTTLS", t.addr)
+		}
+	}
+
+	if t.username != "" {
+		if err = cli.Auth(smtp.PlainAuth("", t.username, t.password, t.host)); err != nil {
+			return errors.Wrap(err, "auth")
+		}
+	}
+
+	return nil
+}
+
+// acquire get idle connection or dial new one, bounded by max conns
+func (t *SMTPTransport) acquire(ctx context.Context) (*smtpConn, error) {
+	select {
+	case t.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	now := Clock.GetUTCNow()
+	for {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			<-t.sem
+			return nil, ErrMailerClosed
+		}
+		if len(t.idle) == 0 {
+			t.mu.Unlock()
+			break
+		}
+
+		c := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		t.mu.Unlock()
+
+		if now.Sub(c.lastUsed) > t.idleTimeout {
+			c.close()
+			continue
+		}
+		if err := c.conn.SetDeadline(now.Add(defaultSMTPCommandDeadline)); err != nil {
+			_ = c.cli.Close()
+			continue
+		}
+		if err := c.cli.Reset(); err != nil {
+			// connection closed by server
+			_ = c.cli.Close()
+			continue
+		}
+
+		return c, nil
+	}
+
+	c, err := t.dial(ctx)
+	if err != nil {
+		<-t.sem
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// release put connection back to pool, close it if broken
+func (t *SMTPTransport) release(c *smtpConn, broken bool) {
+	defer func() { <-t.sem }()
+
+	t.mu.Lock()
+	if broken || t.closed {
+		t.mu.Unlock()
+		_ = c.cli.Close()
+		return
+	}
+
+	c.lastUsed = Clock.GetUTCNow()
+	t.idle = append(t.idle, c)
+	t.mu.Unlock()
+}
+
+// Send send message by pooled connection, commands are interrupted when ctx done
+func (t *SMTPTransport) Send(ctx context.Context, from string, to []string, msg io.WriterTo) (err error) {
+	c, err := t.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = c.conn.SetDeadline(commandDeadline(ctx)); err != nil {
+		t.release(c, true)
+		return errors.Wrap(err, "set deadline")
+	}
+
+	// connection can be reused after SMTP errors, but not after network errors
+	broken := false
+	stop := interruptConnOnCtxDone(ctx, c.conn)
+	defer func() {
+		if stop() {
+			broken = true
+			if err != nil {
+				err = errors.Wrapf(ctx.Err(), "send email: %v", err)
+			}
+		}
+
+		t.release(c, broken)
+	}()
+
+	if err = c.cli.Mail(from); err != nil {
+		broken = !isSMTPReplyErr(err)
+		return errors.Wrapf(err, "mail from `%s`", from)
+	}
+	for _, addr := range to {
+		if err = c.cli.Rcpt(addr); err != nil {
+			broken = !isSMTPReplyErr(err)
+			return errors.Wrapf(err, "rcpt to `%s`", addr)
+		}
+	}
+
+	w, err := c.cli.Data()
+	if err != nil {
+		broken = !isSMTPReplyErr(err)
+		return errors.Wrap(err, "data")
+	}
+	if _, err = msg.WriteTo(w); err != nil {
+		broken = true
+		return errors.Wrap(err, "write message")
+	}
+	if err = w.Close(); err != nil {
+		broken = !isSMTPReplyErr(err)
+		return errors.Wrap(err, "close data")
+	}
+
+	return nil
+}
+
+func isSMTPReplyErr(err error) bool {
+	_, ok := err.(*textproto.Error)
+	return ok
+}
+
+// Close close all idle connections, connections in use are closed after released
+func (t *SMTPTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	idle := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+
+	for _, c := range idle {
+		c.close()
+	}
+
+	return nil
+}
+
+// MemMail message sent by MemMailTransport
+type MemMail struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// MemMailTransport in-memory MailTransport for testing
+type MemMailTransport struct {
+	sync.Mutex
+	sent []*MemMail
+	// onSend return error to simulate failure
+	onSend func(from string, to []string) error
+}
+
+// NewMemMailTransport create MemMailTransport
+func NewMemMailTransport() *MemMailTransport {
+	return &MemMailTransport{}
+}
+
+// OnSend set hook called before each sending,
+// return error to simulate failure, like `&textproto.Error{Code: 451}`
+func (t *MemMailTransport) OnSend(f func(from string, to []string) error) {
+	t.Lock()
+	t.onSend = f
+	t.Unlock()
+}
+
+// Send record message
+func (t *MemMailTransport) Send(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	t.Lock()
+	onSend := t.onSend
+	t.Unlock()
+	if onSend != nil {
+		if err := onSend(from, to); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return errors.Wrap(err, "write message")
+	}
+
+	t.Lock()
+	t.sent = append(t.sent, &MemMail{
+		From: from,
+		To:   append([]string(nil), to...),
+		Data: buf.Bytes(),
+	})
+	t.Unlock()
+	return nil
+}
+
+// Sent return all sent messages
+func (t *MemMailTransport) Sent() []*MemMail {
+	t.Lock()
+	defer t.Unlock()
+	return append([]*MemMail(nil), t.sent...)
+}
+
+// Close do nothing
+func (t *MemMailTransport) Close() error {
+	return nil
+}
+
+type mailerOption struct {
+	queueSize int
+	nWorkers  int
+	retry     EventRetryPolicy
+	onError   func(msg *MailMessage, err error)
+}
+
+// MailerOptFunc options for Mailer
+type MailerOptFunc func(*mailerOption) error
+
+// WithMailerQueueSize set size of async queue, default is 100
+func WithMailerQueueSize(size int) MailerOptFunc {
+	return func(opt *mailerOption) error {
+		if size <= 0 {
+			return errors.Errorf("size must > 0")
+		}
+
+		opt.queueSize = size
+		return nil
+	}
+}
+
+// WithMailerWorkers set number of workers sending async messages, default is 2
+func WithMailerWorkers(n int) MailerOptFunc {
+	return func(opt *mailerOption) error {
+		if n <= 0 {
+			return errors.Errorf("workers must > 0")
+		}
+
+		opt.nWorkers = n
+		return nil
+	}
+}
+
+// WithMailerRetry set retry policy of temporary errors,
+// default is 3 retries with backoff from 1s
+func WithMailerRetry(policy EventRetryPolicy) MailerOptFunc {
+	return func(opt *mailerOption) error {
+		if policy.MaxRetry < 0 || policy.Backoff < 0 {
+			return errors.Errorf("invalid retry policy")
+		}
+
+		opt.retry = policy
+		return nil
+	}
+}
+
+// WithMailerOnError set callback for async messages failed finally,
+// default is to log error
+func WithMailerOnError(f func(msg *MailMessage, err error)) MailerOptFunc {
+	return func(opt *mailerOption) error {
+		if f == nil {
+			return errors.Errorf("callback is nil")
+		}
+
+		opt.onError = f
+		return nil
+	}
+}
+
+// Mailer long-lived mail sender with async queue and retries
+type Mailer struct {
+	*mailerOption
+	transport MailTransport
+	ctx       context.Context
+	cancel    context.CancelFunc
+	q         chan *MailMessage
+	wg        sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewMailer create Mailer and start workers, stopped by ctx or `Close`.
+// messages still in queue are dropped when ctx done.
+func NewMailer(ctx context.Context, transport MailTransport, opts ...MailerOptFunc) (m *Mailer, err error) {
+	opt := &mailerOption{
+		queueSize: defaultMailerQueueSize,
+		nWorkers:  defaultMailerWorkers,
+		retry: EventRetryPolicy{
+			MaxRetry: defaultMailerMaxRetry,
+			Backoff:  defaultMailerRetryBackoff,
+		},
+		onError: func(msg *MailMessage, err error) {
+			Logger.Error("send email", zap.Error(err))
+		},
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+	if transport == nil {
+		return nil, errors.Errorf("transport is nil")
+	}
+
+	m = &Mailer{
+		mailerOption: opt,
+		transport:    transport,
+		q:            make(chan *MailMessage, opt.queueSize),
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	for i := 0; i < opt.nWorkers; i++ {
+		m.wg.Add(1)
+		go m.runWorker()
+	}
+
+	return m, nil
+}
+
+func (m *Mailer) runWorker() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case msg, ok := <-m.q:
+			if !ok {
+				return
+			}
+
+			if err := m.Send(m.ctx, msg); err != nil {
+				m.onError(msg, err)
+			}
+		}
+	}
+}
+
+// Send send message synchronously, retry on temporary errors
+func (m *Mailer) Send(ctx context.Context, msg *MailMessage) (err error) {
+	from, to, err := msg.Envelope()
+	if err != nil {
+		return err
+	}
+	gmsg, err := msg.Build()
+	if err != nil {
+		return errors.Wrap(err, "build message")
+	}
+
+	for i := 0; ; i++ {
+		if err = m.transport.Send(ctx, from, to, gmsg); err == nil {
+			return nil
+		}
+		if i >= m.retry.MaxRetry || !IsMailTemporaryErr(err) {
+			return errors.Wrapf(err, "send email after %d attempts", i+1)
+		}
+
+		Logger.Warn("retry to send email", zap.Strings("to", to), zap.Int("attempt", i+1), zap.Error(err))
+		select {
+		case <-time.After(m.retry.backoff(i)):
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "send email: %v", err)
+		}
+	}
+}
+
+// SendAsync put message into queue without blocking,
+// return ErrMailerQueueFull if queue is full.
+// failures are reported to callback set by `WithMailerOnError`.
+func (m *Mailer) SendAsync(msg *MailMessage) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed || m.ctx.Err() != nil {
+		return ErrMailerClosed
+	}
+
+	select {
+	case m.q <- msg:
+		return nil
+	default:
+		return ErrMailerQueueFull
+	}
+}
+
+// Close stop accepting messages and wait queued messages sent,
+// messages not sent are dropped when ctx done.
+// transport is closed at last.
+func (m *Mailer) Close(ctx context.Context) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+
+	m.closed = true
+	close(m.q)
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		m.cancel()
+		<-done
+		err = ctx.Err()
+	}
+
+	m.cancel()
+	if cerr := m.transport.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,386 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSMTPServer minimal SMTP server without TLS
+type testSMTPServer struct {
+	ln       net.Listener
+	conns    int32
+	failRcpt int32
+	// blockMail if not nil, block MAIL command until it closed
+	blockMail chan struct{}
+
+	mu   sync.Mutex
+	msgs []string
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	s := &testSMTPServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *testSMTPServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		switch strings.ToUpper(strings.Fields(line + " ")[0]) {
+		case "EHLO":
+			_ = tp.PrintfLine("250-localhost")
+			_ = tp.PrintfLine("250 8BITMIME")
+		case "RCPT":
+			if atomic.AddInt32(&s.failRcpt, -1) >= 0 {
+				_ = tp.PrintfLine("451 try again later")
+				continue
+			}
+
+			_ = tp.PrintfLine("250 ok")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.msgs = append(s.msgs, string(data))
+			s.mu.Unlock()
+			_ = tp.PrintfLine("250 queued")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		case "MAIL":
+			if s.blockMail != nil {
+				<-s.blockMail
+			}
+
+			_ = tp.PrintfLine("250 ok")
+		case "RSET", "NOOP", "HELO":
+			_ = tp.PrintfLine("250 ok")
+		default:
+			_ = tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func newTestMailMessage(to string) *MailMessage {
+	return NewMailMessage().
+		From("from@example.com", "").
+		To(to, "").
+		Subject("test").
+		TextBody("hello")
+}
+
+func TestSMTPTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestSMTPServer(t)
+	defer srv.ln.Close()
+
+	// server not support STARTTLS
+	transport, err := NewSMTPTransport("127.0.0.1", srv.port())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	mailer, err := NewMailer(ctx, transport)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = mailer.Send(ctx, newTestMailMessage("to@example.com")); err == nil ||
+		!strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("got %+v", err)
+	}
+	if err = mailer.Close(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	atomic.StoreInt32(&srv.conns, 0)
+	atomic.StoreInt32(&srv.failRcpt, 1)
+	if transport, err = NewSMTPTransport("127.0.0.1", srv.port(),
+		WithSMTPTLSMode(MailTLSNone),
+		WithSMTPMaxConns(1),
+	); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if mailer, err = NewMailer(ctx, transport,
+		WithMailerRetry(EventRetryPolicy{MaxRetry: 2, Backoff: 10 * time.Millisecond}),
+	); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = mailer.Send(ctx, newTestMailMessage("to@example.com")); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = mailer.Close(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.msgs) != 3 || !strings.Contains(srv.msgs[0], "Subject: test") {
+		t.Fatalf("got %v", srv.msgs)
+	}
+	if n := atomic.LoadInt32(&srv.conns); n != 1 {
+		t.Fatalf("connection should be reused, got %d", n)
+	}
+}
+
+func TestMailer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transport := NewMemMailTransport()
+	var nFailed int32
+	transport.OnSend(func(from string, to []string) error {
+		switch to[0] {
+		case "temporary@example.com":
+			if atomic.AddInt32(&nFailed, 1) <= 2 {
+				return &textproto.Error{Code: 451, Msg: "try again"}
+			}
+		case "permanent@example.com":
+			return &textproto.Error{Code: 550, Msg: "no such user"}
+		}
+
+		return nil
+	})
+
+	var (
+		mu     sync.Mutex
+		failed []error
+	)
+	mailer, err := NewMailer(ctx, transport,
+		WithMailerRetry(EventRetryPolicy{MaxRetry: 3, Backoff: 10 * time.Millisecond}),
+		WithMailerOnError(func(msg *MailMessage, err error) {
+			mu.Lock()
+			failed = append(failed, err)
+			mu.Unlock()
+		}),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for _, to := range []string{"a@example.com", "temporary@example.com", "permanent@example.com"} {
+		if err = mailer.SendAsync(newTestMailMessage(to)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = mailer.Close(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = mailer.SendAsync(newTestMailMessage("a@example.com")); err != ErrMailerClosed {
+		t.Fatalf("got %+v", err)
+	}
+
+	if sent := transport.Sent(); len(sent) != 2 {
+		t.Fatalf("got %d", len(sent))
+	}
+	if len(failed) != 1 || !strings.Contains(failed[0].Error(), "after 1 attempts") {
+		t.Fatalf("got %v", failed)
+	}
+	if nFailed != 3 {
+		t.Fatalf("got %d", nFailed)
+	}
+}
+
+func TestMailerQueueFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transport := NewMemMailTransport()
+	block := make(chan struct{})
+	transport.OnSend(func(from string, to []string) error {
+		<-block
+		return nil
+	})
+	mailer, err := NewMailer(ctx, transport, WithMailerQueueSize(1), WithMailerWorkers(1))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var nFull int
+	for i := 0; i < 5; i++ {
+		if err = mailer.SendAsync(newTestMailMessage("a@example.com")); err == ErrMailerQueueFull {
+			nFull++
+		}
+	}
+	if nFull < 3 {
+		t.Fatalf("got %d", nFull)
+	}
+
+	close(block)
+	if err = mailer.Close(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if n := len(transport.Sent()); n != 5-nFull {
+		t.Fatalf("got %d", n)
+	}
+}
+
+func TestMailerCtxDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mailer, err := NewMailer(ctx, NewMemMailTransport())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		mailer.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers should stop when ctx done")
+	}
+
+	if err = mailer.SendAsync(newTestMailMessage("a@example.com")); err != ErrMailerClosed {
+		t.Fatalf("got %+v", err)
+	}
+}
+
+func TestSMTPTransportImplicitTLSCtx(t *testing.T) {
+	// server accept connection but never finish tls handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	transport, err := NewSMTPTransport("127.0.0.1", ln.Addr().(*net.TCPAddr).Port,
+		WithSMTPTLSMode(MailTLSImplicit),
+		WithSMTPDialTimeout(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer transport.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = transport.Send(ctx, "from@example.com", []string{"to@example.com"}, newTestMailMessage("to@example.com")); err == nil ||
+		!strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("got %+v", err)
+	}
+	if cost := time.Since(start); cost > 5*time.Second {
+		t.Fatalf("cost %s", cost)
+	}
+}
+
+func TestSMTPTransportSendCtx(t *testing.T) {
+	srv := newTestSMTPServer(t)
+	defer srv.ln.Close()
+	srv.blockMail = make(chan struct{})
+	defer close(srv.blockMail)
+
+	transport, err := NewSMTPTransport("127.0.0.1", srv.port(), WithSMTPTLSMode(MailTLSNone))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer transport.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if err = transport.Send(ctx, "from@example.com", []string{"to@example.com"}, newTestMailMessage("to@example.com")); err == nil ||
+		!strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("got %+v", err)
+	}
+	if cost := time.Since(start); cost > 5*time.Second {
+		t.Fatalf("cost %s", cost)
+	}
+}
+
+func TestSMTPTransportDialCtx(t *testing.T) {
+	// server accept connection but never greet
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	transport, err := NewSMTPTransport("127.0.0.1", ln.Addr().(*net.TCPAddr).Port, WithSMTPTLSMode(MailTLSNone))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer transport.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if err = transport.Send(ctx, "from@example.com", []string{"to@example.com"}, newTestMailMessage("to@example.com")); err == nil ||
+		!strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("got %+v", err)
+	}
+	if cost := time.Since(start); cost > 5*time.Second {
+		t.Fatalf("cost %s", cost)
+	}
+}
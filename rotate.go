@@ -0,0 +1,434 @@
+package utils
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// rotateFileTimeLayout layout of timestamp in name of backups
+	rotateFileTimeLayout = "2006-01-02T15-04-05.000"
+	rotateFileGzExt      = ".gz"
+)
+
+type rotateFileOption struct {
+	maxSizeByte int64
+	interval    time.Duration
+	maxBackups  int
+	maxAge      time.Duration
+	compress    bool
+	perm        os.FileMode
+}
+
+// RotateFileOptFunc options for RotateFileWriter
+type RotateFileOptFunc func(*rotateFileOption) error
+
+// WithRotateMaxSizeByte rotate when file size exceeds n bytes, 0 means no limit
+func WithRotateMaxSizeByte(n int64) RotateFileOptFunc {
+	return func(opt *rotateFileOption) error {
+		if n < 0 {
+			return errors.Errorf("size must >= 0")
+		}
+
+		opt.maxSizeByte = n
+		return nil
+	}
+}
+
+// WithRotateInterval rotate at every boundary of interval (truncated by UTC),
+// like every hour or every day. 0 means no time-based rotation.
+func WithRotateInterval(interval time.Duration) RotateFileOptFunc {
+	return func(opt *rotateFileOption) error {
+		if interval < 0 {
+			return errors.Errorf("interval must >= 0")
+		}
+
+		opt.interval = interval
+		return nil
+	}
+}
+
+// WithRotateMaxBackups keep at most n backups, 0 means keep all
+func WithRotateMaxBackups(n int) RotateFileOptFunc {
+	return func(opt *rotateFileOption) error {
+		if n < 0 {
+			return errors.Errorf("backups must >= 0")
+		}
+
+		opt.maxBackups = n
+		return nil
+	}
+}
+
+// WithRotateMaxAge remove backups older than age, 0 means never
+func WithRotateMaxAge(age time.Duration) RotateFileOptFunc {
+	return func(opt *rotateFileOption) error {
+		if age < 0 {
+			return errors.Errorf("age must >= 0")
+		}
+
+		opt.maxAge = age
+		return nil
+	}
+}
+
+// WithRotateCompress gzip backups by GZCompressor
+func WithRotateCompress(compress bool) RotateFileOptFunc {
+	return func(opt *rotateFileOption) error {
+		opt.compress = compress
+		return nil
+	}
+}
+
+// WithRotateFilePerm set permission of log files, default is 0644
+func WithRotateFilePerm(perm os.FileMode) RotateFileOptFunc {
+	return func(opt *rotateFileOption) error {
+		opt.perm = perm.Perm()
+		return nil
+	}
+}
+
+// RotateFileWriter file writer rotated by size and time, safe for concurrent use.
+//
+// backups are renamed to `<name>-<timestamp><ext>` in the same dir,
+// compressing and cleaning of backups are run in background.
+// implements `zapcore.WriteSyncer`, see `LoggerType.WithRotateFile`.
+type RotateFileWriter struct {
+	*rotateFileOption
+	sync.Mutex
+	fpath string
+	fp    *os.File
+	size  int64
+	// nextRotateAt time to rotate, zero if no time-based rotation
+	nextRotateAt time.Time
+
+	millChan chan struct{}
+	millWg   sync.WaitGroup
+	closed   bool
+}
+
+// NewRotateFileWriter create writer appends to fpath
+func NewRotateFileWriter(fpath string, opts ...RotateFileOptFunc) (w *RotateFileWriter, err error) {
+	opt := &rotateFileOption{
+		perm: 0644,
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	w = &RotateFileWriter{
+		rotateFileOption: opt,
+		fpath:            fpath,
+		millChan:         make(chan struct{}, 1),
+	}
+	if err = w.openExistingOrNew(); err != nil {
+		return nil, err
+	}
+
+	w.millWg.Add(1)
+	go w.runMill()
+	w.triggerMill()
+	return w, nil
+}
+
+func (w *RotateFileWriter) nextRotateTime(now time.Time) time.Time {
+	if w.interval == 0 {
+		return time.Time{}
+	}
+
+	return now.Truncate(w.interval).Add(w.interval)
+}
+
+// openExistingOrNew append to existing file,
+// rotate it if its period is passed or it is oversized.
+// backup of existing file is named by its mtime.
+func (w *RotateFileWriter) openExistingOrNew() (err error) {
+	now := Clock.GetUTCNow()
+	st, err := os.Stat(w.fpath)
+	if os.IsNotExist(err) {
+		return w.openNew(now)
+	} else if err != nil {
+		return errors.Wrapf(err, "stat `%s`", w.fpath)
+	}
+
+	if (w.maxSizeByte > 0 && st.Size() >= w.maxSizeByte) ||
+		(w.interval != 0 && st.Size() != 0 && st.ModTime().Before(now.Truncate(w.interval))) {
+		return w.rotate(now, st.ModTime())
+	}
+
+	if w.fp, err = os.OpenFile(w.fpath, os.O_WRONLY|os.O_APPEND, w.perm); err != nil {
+		return errors.Wrapf(err, "open file `%s`", w.fpath)
+	}
+
+	w.size = st.Size()
+	w.nextRotateAt = w.nextRotateTime(now)
+	return nil
+}
+
+func (w *RotateFileWriter) openNew(now time.Time) (err error) {
+	if err = os.MkdirAll(filepath.Dir(w.fpath), os.ModePerm); err != nil {
+		return errors.Wrapf(err, "create dir `%s`", w.fpath)
+	}
+	if w.fp, err = os.OpenFile(w.fpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, w.perm); err != nil {
+		return errors.Wrapf(err, "open file `%s`", w.fpath)
+	}
+
+	w.size = 0
+	w.nextRotateAt = w.nextRotateTime(now)
+	return nil
+}
+
+// backupName return `<dir>/<name>-<timestamp><ext>` not exists,
+// timestamp is increased by 1ms if backup already exists
+func (w *RotateFileWriter) backupName(t time.Time) string {
+	dir, name := filepath.Split(w.fpath)
+	ext := filepath.Ext(name)
+	for ; ; t = t.Add(time.Millisecond) {
+		fpath := filepath.Join(dir, strings.TrimSuffix(name, ext)+"-"+t.UTC().Format(rotateFileTimeLayout)+ext)
+		if _, err := os.Stat(fpath); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Stat(fpath + rotateFileGzExt); !os.IsNotExist(err) {
+			continue
+		}
+
+		return fpath
+	}
+}
+
+// rotate rename current file to backup named by backupAt and open new file
+func (w *RotateFileWriter) rotate(now, backupAt time.Time) (err error) {
+	if w.fp != nil {
+		if err = w.fp.Close(); err != nil {
+			return errors.Wrapf(err, "close file `%s`", w.fpath)
+		}
+		w.fp = nil
+	}
+
+	backup := w.backupName(backupAt)
+	if err = os.Rename(w.fpath, backup); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "rename `%s` to `%s`", w.fpath, backup)
+	}
+	if err = w.openNew(now); err != nil {
+		return err
+	}
+
+	w.triggerMill()
+	return nil
+}
+
+// Write write p into file, rotate before writing if needed
+func (w *RotateFileWriter) Write(p []byte) (n int, err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	now := Clock.GetUTCNow()
+	if w.fp == nil {
+		// failed to rotate last time
+		if err = w.openNew(now); err != nil {
+			return 0, err
+		}
+	}
+	rotateByTime := !w.nextRotateAt.IsZero() && !now.Before(w.nextRotateAt)
+	if rotateByTime && w.size == 0 {
+		// no need to backup empty file
+		w.nextRotateAt = w.nextRotateTime(now)
+		rotateByTime = false
+	}
+	if rotateByTime ||
+		(w.maxSizeByte > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSizeByte) {
+		if err = w.rotate(now, now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = w.fp.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate rotate file immediately
+func (w *RotateFileWriter) Rotate() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+
+	now := Clock.GetUTCNow()
+	return w.rotate(now, now)
+}
+
+// Sync commit file to disk
+func (w *RotateFileWriter) Sync() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.fp == nil {
+		return nil
+	}
+
+	return w.fp.Sync()
+}
+
+// Close close file and wait background compressing and cleaning
+func (w *RotateFileWriter) Close() (err error) {
+	w.Lock()
+	if w.closed {
+		w.Unlock()
+		return nil
+	}
+
+	w.closed = true
+	if w.fp != nil {
+		err = w.fp.Close()
+	}
+	close(w.millChan)
+	w.Unlock()
+
+	w.millWg.Wait()
+	return errors.Wrapf(err, "close file `%s`", w.fpath)
+}
+
+// triggerMill notify background goroutine, never blocks
+func (w *RotateFileWriter) triggerMill() {
+	select {
+	case w.millChan <- struct{}{}:
+	default:
+	}
+}
+
+func (w *RotateFileWriter) runMill() {
+	defer w.millWg.Done()
+	for range w.millChan {
+		if err := w.mill(); err != nil {
+			Logger.Error("clean log backups", zap.String("file", w.fpath), zap.Error(err))
+		}
+	}
+}
+
+type rotateFileBackup struct {
+	path string
+	t    time.Time
+}
+
+// listBackups return backups sorted by time, newest first
+func (w *RotateFileWriter) listBackups() (backups []*rotateFileBackup, err error) {
+	dir, name := filepath.Split(w.fpath)
+	if dir == "" {
+		dir = "."
+	}
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read dir `%s`", dir)
+	}
+
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), prefix) {
+			continue
+		}
+
+		ts := strings.TrimPrefix(info.Name(), prefix)
+		ts = strings.TrimSuffix(ts, rotateFileGzExt)
+		if !strings.HasSuffix(ts, ext) {
+			continue
+		}
+
+		t, err := time.Parse(rotateFileTimeLayout, strings.TrimSuffix(ts, ext))
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, &rotateFileBackup{
+			path: filepath.Join(dir, info.Name()),
+			t:    t,
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].t.After(backups[j].t)
+	})
+	return backups, nil
+}
+
+// mill remove expired backups, then compress the rest
+func (w *RotateFileWriter) mill() error {
+	backups, err := w.listBackups()
+	if err != nil {
+		return err
+	}
+
+	cutoff := Clock.GetUTCNow().Add(-w.maxAge)
+	for i, b := range backups {
+		if (w.maxBackups > 0 && i >= w.maxBackups) ||
+			(w.maxAge > 0 && b.t.Before(cutoff)) {
+			if err = os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "remove `%s`", b.path)
+			}
+
+			Logger.Debug("remove log backup", zap.String("file", b.path))
+			continue
+		}
+
+		if w.compress && !strings.HasSuffix(b.path, rotateFileGzExt) {
+			if err = gzipRotateBackup(b.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// gzipRotateBackup compress fpath to fpath.gz, then remove fpath
+func gzipRotateBackup(fpath string) (err error) {
+	src, err := os.Open(fpath)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer src.Close()
+
+	st, err := src.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "stat `%s`", fpath)
+	}
+
+	if err = writeFileAtomic(fpath+rotateFileGzExt, st.Mode().Perm(), func(fp *os.File) error {
+		c, err := NewGZCompressor(fp)
+		if err != nil {
+			return errors.Wrap(err, "new compressor")
+		}
+		if _, err = io.Copy(c, src); err != nil {
+			return errors.Wrapf(err, "compress `%s`", fpath)
+		}
+
+		return c.Flush()
+	}); err != nil {
+		return err
+	}
+
+	Logger.Debug("compress log backup", zap.String("file", fpath))
+	return errors.Wrapf(os.Remove(fpath), "remove `%s`", fpath)
+}
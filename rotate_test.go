@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Laisky/zap"
+)
+
+func TestRotateFileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRotateFileWriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "app.log")
+
+	// expired backup should be removed
+	expired := filepath.Join(dir, "app-"+time.Now().Add(-48*time.Hour).UTC().Format(rotateFileTimeLayout)+".log")
+	if err = ioutil.WriteFile(expired, []byte("old"), 0644); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	w, err := NewRotateFileWriter(fpath,
+		WithRotateMaxSizeByte(100),
+		WithRotateMaxBackups(2),
+		WithRotateMaxAge(24*time.Hour),
+		WithRotateCompress(true),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	line := []byte(strings.Repeat("x", 29) + "\n")
+	for i := 0; i < 10; i++ {
+		if _, err = w.Write(line); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = w.Write(line); err == nil {
+		t.Fatal("should error after closed")
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var backups []string
+	for _, info := range infos {
+		if info.Name() == "app.log" {
+			if info.Size() != 30 {
+				t.Fatalf("got %d", info.Size())
+			}
+
+			continue
+		}
+
+		backups = append(backups, info.Name())
+		if !strings.HasSuffix(info.Name(), ".log.gz") {
+			t.Fatalf("got %s", info.Name())
+		}
+
+		fp, err := os.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		got, err := ioutil.ReadAll(gz)
+		fp.Close()
+		if err != nil || !bytes.Equal(got, bytes.Repeat(line, 3)) {
+			t.Fatalf("got %q, %+v", got, err)
+		}
+	}
+	if len(backups) != 2 {
+		t.Fatalf("got %v", backups)
+	}
+}
+
+func TestRotateFileWriterInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRotateFileWriterInterval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "app.log")
+
+	w, err := NewRotateFileWriter(fpath, WithRotateInterval(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	logger := Logger.With(zap.String("app", "test")).WithRotateFile(w)
+	// empty file should not be backed up
+	time.Sleep(300 * time.Millisecond)
+	logger.Info("first")
+	time.Sleep(300 * time.Millisecond)
+	logger.Info("second")
+	logger.Debug("should not be written")
+	if err = w.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	cnt, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.Contains(string(cnt), `"message":"second"`) || strings.Contains(string(cnt), "first") ||
+		!strings.Contains(string(cnt), `"app":"test"`) {
+		t.Fatalf("got %s", cnt)
+	}
+
+	backups, err := filepath.Glob(filepath.Join(dir, "app-*.log"))
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("got %v, %+v", backups, err)
+	}
+	if cnt, err = ioutil.ReadFile(backups[0]); err != nil || !strings.Contains(string(cnt), `"message":"first"`) {
+		t.Fatalf("got %s, %+v", cnt, err)
+	}
+}
+
+func TestRotateFileWriterExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRotateFileWriterExisting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "app.log")
+
+	// oversized file is rotated at open, backup named by its mtime
+	mtime := time.Now().Add(-2 * time.Hour)
+	if err = ioutil.WriteFile(fpath, bytes.Repeat([]byte("x"), 200), 0644); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = os.Chtimes(fpath, mtime, mtime); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	w, err := NewRotateFileWriter(fpath, WithRotateMaxSizeByte(100))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	backup := filepath.Join(dir, "app-"+mtime.UTC().Format(rotateFileTimeLayout)+".log")
+	if st, err := os.Stat(backup); err != nil || st.Size() != 200 {
+		t.Fatalf("got %v, %+v", st, err)
+	}
+	if st, err := os.Stat(fpath); err != nil || st.Size() != 0 {
+		t.Fatalf("got %v, %+v", st, err)
+	}
+}
@@ -3,7 +3,6 @@ package utils
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -407,6 +406,11 @@ func AESEncryptFilesInDirFileAppend(append string) SettingsEncryptOptf {
 
 // AESEncryptFilesInDir encrypt files in dir
 func AESEncryptFilesInDir(dir string, secret []byte, opts ...SettingsEncryptOptf) (err error) {
+	return AESEncryptFilesInDirFS(OSFS{}, dir, secret, opts...)
+}
+
+// AESEncryptFilesInDirFS encrypt files in dir of fsys
+func AESEncryptFilesInDirFS(fsys FS, dir string, secret []byte, opts ...SettingsEncryptOptf) (err error) {
 	opt := &settingsAESEncryptOpt{
 		ext:    ".toml",
 		append: ".enc",
@@ -420,7 +424,7 @@ func AESEncryptFilesInDir(dir string, secret []byte, opts ...SettingsEncryptOptf
 		zap.String("append", opt.append),
 		zap.String("ext", opt.ext))
 
-	fs, err := ioutil.ReadDir(dir)
+	fs, err := fsys.ReadDir(dir)
 	if err != nil {
 		return errors.Wrapf(err, "read dir `%s`", dir)
 	}
@@ -434,7 +438,7 @@ func AESEncryptFilesInDir(dir string, secret []byte, opts ...SettingsEncryptOptf
 		}
 
 		pool.Go(func() (err error) {
-			raw, err := ioutil.ReadFile(fname)
+			raw, err := readFileFS(fsys, fname)
 			if err != nil {
 				return errors.Wrapf(err, "read file `%s`", fname)
 			}
@@ -446,7 +450,7 @@ func AESEncryptFilesInDir(dir string, secret []byte, opts ...SettingsEncryptOptf
 
 			ext := filepath.Ext(fname)
 			out := strings.TrimSuffix(fname, ext) + opt.append + ext
-			if err = ioutil.WriteFile(out, cipher, os.ModePerm); err != nil {
+			if err = writeFileFS(fsys, out, cipher, os.ModePerm); err != nil {
 				return errors.Wrapf(err, "write file `%s`", out)
 			}
 
@@ -0,0 +1,313 @@
+package utils
+
+import (
+	"encoding/gob"
+	"io"
+	"os"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+const cacheSnapshotVersion = 1
+
+// CacheEncoder encode one value into stream
+type CacheEncoder interface {
+	Encode(v interface{}) error
+}
+
+// CacheDecoder decode one value from stream
+type CacheDecoder interface {
+	Decode(v interface{}) error
+}
+
+// CacheCodec codec used to snapshot caches
+type CacheCodec interface {
+	NewEncoder(w io.Writer) CacheEncoder
+	NewDecoder(r io.Reader) CacheDecoder
+}
+
+type gobCacheCodec struct{}
+
+func (gobCacheCodec) NewEncoder(w io.Writer) CacheEncoder {
+	return gob.NewEncoder(w)
+}
+
+func (gobCacheCodec) NewDecoder(r io.Reader) CacheDecoder {
+	return gob.NewDecoder(r)
+}
+
+type jsonCacheCodec struct{}
+
+func (jsonCacheCodec) NewEncoder(w io.Writer) CacheEncoder {
+	return json.NewEncoder(w)
+}
+
+func (jsonCacheCodec) NewDecoder(r io.Reader) CacheDecoder {
+	return &jsonCacheDecoder{json.NewDecoder(r)}
+}
+
+type jsonCacheDecoder struct {
+	*jsoniter.Decoder
+}
+
+// Decode return io.EOF when there is no more value
+func (d *jsonCacheDecoder) Decode(v interface{}) error {
+	if !d.More() {
+		return io.EOF
+	}
+
+	return d.Decoder.Decode(v)
+}
+
+var (
+	// GobCacheCodec encode cache by gob, keeps the concrete types of keys and values.
+	//
+	// custom types should be registered by `gob.Register`
+	GobCacheCodec CacheCodec = gobCacheCodec{}
+	// JSONCacheCodec encode cache by json,
+	// keys and values are decoded as generic json types (string, float64, map...)
+	JSONCacheCodec CacheCodec = jsonCacheCodec{}
+)
+
+type cacheSnapshotHeader struct {
+	Version int
+}
+
+type cacheSnapshotEntry struct {
+	Key, Val interface{}
+	// ExpireAt wall clock in unix nano
+	ExpireAt int64
+}
+
+type cacheSnapshotOption struct {
+	codec CacheCodec
+}
+
+// CacheSnapshotOptFunc options for cache snapshot
+type CacheSnapshotOptFunc func(*cacheSnapshotOption) error
+
+// WithCacheSnapshotCodec set codec of snapshot, default is GobCacheCodec
+func WithCacheSnapshotCodec(codec CacheCodec) CacheSnapshotOptFunc {
+	return func(opt *cacheSnapshotOption) error {
+		if codec == nil {
+			return errors.Errorf("codec is nil")
+		}
+
+		opt.codec = codec
+		return nil
+	}
+}
+
+func newCacheSnapshotOption(opts []CacheSnapshotOptFunc) (*cacheSnapshotOption, error) {
+	opt := &cacheSnapshotOption{
+		codec: GobCacheCodec,
+	}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	return opt, nil
+}
+
+// writeCacheSnapshot write entries into w
+func writeCacheSnapshot(w io.Writer, entries []cacheSnapshotEntry, opts []CacheSnapshotOptFunc) error {
+	opt, err := newCacheSnapshotOption(opts)
+	if err != nil {
+		return err
+	}
+
+	enc := opt.codec.NewEncoder(w)
+	if err = enc.Encode(&cacheSnapshotHeader{Version: cacheSnapshotVersion}); err != nil {
+		return errors.Wrap(err, "encode header")
+	}
+	for i := range entries {
+		if err = enc.Encode(&entries[i]); err != nil {
+			return errors.Wrapf(err, "encode key `%v`", entries[i].Key)
+		}
+	}
+
+	return nil
+}
+
+// readCacheSnapshot read entries from r, call restore for each not expired entry
+func readCacheSnapshot(r io.Reader, opts []CacheSnapshotOptFunc, restore func(entry *cacheSnapshotEntry) error) (n int, err error) {
+	opt, err := newCacheSnapshotOption(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	dec := opt.codec.NewDecoder(r)
+	header := new(cacheSnapshotHeader)
+	if err = dec.Decode(header); err != nil {
+		return 0, errors.Wrap(err, "decode header")
+	}
+	if header.Version != cacheSnapshotVersion {
+		return 0, errors.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	now := Clock.GetUTCNow().UnixNano()
+	for {
+		entry := new(cacheSnapshotEntry)
+		if err = dec.Decode(entry); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, errors.Wrap(err, "decode entry")
+		}
+
+		if entry.ExpireAt <= now {
+			continue
+		}
+		if err = restore(entry); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+}
+
+// snapshotToFile write snapshot into file atomically,
+// so the old snapshot is intact if failed
+func snapshotToFile(fpath string, snapshot func(w io.Writer) error) (err error) {
+	return writeFileAtomic(fpath, 0644, func(fp *os.File) error {
+		return snapshot(fp)
+	})
+}
+
+func loadFromFile(fpath string, restore func(r io.Reader) (int, error)) (n int, err error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer fp.Close()
+
+	return restore(fp)
+}
+
+// Snapshot write all not expired items into w
+func (c *ExpCache) Snapshot(w io.Writer, opts ...CacheSnapshotOptFunc) error {
+	now := Clock.GetUTCNow()
+	var entries []cacheSnapshotEntry
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		for k, item := range s.m {
+			if item.exp.After(now) {
+				entries = append(entries, cacheSnapshotEntry{
+					Key:      k,
+					Val:      item.data,
+					ExpireAt: item.exp.UnixNano(),
+				})
+			}
+		}
+		s.RUnlock()
+	}
+
+	return writeCacheSnapshot(w, entries, opts)
+}
+
+// Restore load items from snapshot, return the number of restored items.
+//
+// items keep their expire time, items already expired are skipped,
+// keys already exist in cache are not overwritten.
+func (c *ExpCache) Restore(r io.Reader, opts ...CacheSnapshotOptFunc) (n int, err error) {
+	return readCacheSnapshot(r, opts, func(entry *cacheSnapshotEntry) error {
+		exp := time.Unix(0, entry.ExpireAt).UTC()
+		s := c.shard(entry.Key)
+		s.Lock()
+		if _, ok := s.m[entry.Key]; ok {
+			s.Unlock()
+			return nil
+		}
+
+		s.m[entry.Key] = &expCacheItem{
+			data: entry.Val,
+			exp:  exp,
+		}
+		s.Unlock()
+		c.wheel.Add(entry.Key, exp)
+		return nil
+	})
+}
+
+// SnapshotToFile write snapshot into file
+func (c *ExpCache) SnapshotToFile(fpath string, opts ...CacheSnapshotOptFunc) error {
+	return snapshotToFile(fpath, func(w io.Writer) error {
+		return c.Snapshot(w, opts...)
+	})
+}
+
+// LoadFromFile restore items from snapshot file
+func (c *ExpCache) LoadFromFile(fpath string, opts ...CacheSnapshotOptFunc) (n int, err error) {
+	return loadFromFile(fpath, func(r io.Reader) (int, error) {
+		return c.Restore(r, opts...)
+	})
+}
+
+// Snapshot write all not expired items into w
+func (e *ExpiredMap) Snapshot(w io.Writer, opts ...CacheSnapshotOptFunc) error {
+	now := Clock.GetUTCNow()
+	var entries []cacheSnapshotEntry
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.RLock()
+		for k, item := range s.m {
+			if exp := item.getTime().Add(e.ttl); exp.After(now) {
+				entries = append(entries, cacheSnapshotEntry{
+					Key:      k,
+					Val:      item.data,
+					ExpireAt: exp.UnixNano(),
+				})
+			}
+		}
+		s.RUnlock()
+	}
+
+	return writeCacheSnapshot(w, entries, opts)
+}
+
+// Restore load items from snapshot, return the number of restored items.
+//
+// items keep their expire time, items already expired are skipped,
+// keys already exist in map are not overwritten.
+func (e *ExpiredMap) Restore(r io.Reader, opts ...CacheSnapshotOptFunc) (n int, err error) {
+	return readCacheSnapshot(r, opts, func(entry *cacheSnapshotEntry) error {
+		key, ok := entry.Key.(string)
+		if !ok {
+			return errors.Errorf("key should be string, got %T", entry.Key)
+		}
+
+		exp := time.Unix(0, entry.ExpireAt).UTC()
+		s := e.shard(key)
+		s.Lock()
+		if _, ok := s.m[key]; ok {
+			s.Unlock()
+			return nil
+		}
+
+		s.m[key] = &expiredMapItem{
+			data: entry.Val,
+			t:    exp.Add(-e.ttl).UnixNano(),
+		}
+		s.Unlock()
+		e.wheel.Add(key, exp)
+		return nil
+	})
+}
+
+// SnapshotToFile write snapshot into file
+func (e *ExpiredMap) SnapshotToFile(fpath string, opts ...CacheSnapshotOptFunc) error {
+	return snapshotToFile(fpath, func(w io.Writer) error {
+		return e.Snapshot(w, opts...)
+	})
+}
+
+// LoadFromFile restore items from snapshot file
+func (e *ExpiredMap) LoadFromFile(fpath string, opts ...CacheSnapshotOptFunc) (n int, err error) {
+	return loadFromFile(fpath, func(r io.Reader) (int, error) {
+		return e.Restore(r, opts...)
+	})
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpCacheSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "TestExpCacheSnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "cache.snapshot")
+
+	for _, codec := range []CacheCodec{GobCacheCodec, JSONCacheCodec} {
+		src := NewExpCache(ctx, time.Hour)
+		src.Store("a", "1")
+		src.Store("b", "2")
+		// expired item should be skipped
+		short := NewExpCache(ctx, 50*time.Millisecond)
+		short.Store("c", "3")
+
+		var buf bytes.Buffer
+		if err = short.Snapshot(&buf, WithCacheSnapshotCodec(codec)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = src.SnapshotToFile(fpath, WithCacheSnapshotCodec(codec)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		dst := NewExpCache(ctx, time.Hour)
+		dst.Store("b", "new")
+		n, err := dst.LoadFromFile(fpath, WithCacheSnapshotCodec(codec))
+		if err != nil || n != 2 {
+			t.Fatalf("got %d, %+v", n, err)
+		}
+		if v, ok := dst.Load("a"); !ok || v.(string) != "1" {
+			t.Fatalf("got %v", v)
+		}
+		if v, ok := dst.Load("b"); !ok || v.(string) != "new" {
+			t.Fatalf("got %v", v)
+		}
+
+		// ttl preserved
+		dst.shards[shardIdxOfKey("a", expCacheShards)].RLock()
+		exp := dst.shards[shardIdxOfKey("a", expCacheShards)].m["a"].exp
+		dst.shards[shardIdxOfKey("a", expCacheShards)].RUnlock()
+		if d := exp.Sub(Clock.GetUTCNow()); d > time.Hour || d < 59*time.Minute {
+			t.Fatalf("got %v", d)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		if n, err = dst.Restore(&buf, WithCacheSnapshotCodec(codec)); err != nil || n != 0 {
+			t.Fatalf("got %d, %+v", n, err)
+		}
+		if _, ok := dst.Load("c"); ok {
+			t.Fatal("c should expired")
+		}
+	}
+
+	if _, err = NewExpCache(ctx, time.Hour).LoadFromFile(filepath.Join(dir, "notexists")); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestExpiredMapSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, err := NewExpiredMap(ctx, time.Hour, func() interface{} { return 1 })
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	src.Get("a")
+
+	var buf bytes.Buffer
+	if err = src.Snapshot(&buf); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	dst, err := NewExpiredMap(ctx, time.Hour, func() interface{} { return 2 })
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if n, err := dst.Restore(&buf); err != nil || n != 1 {
+		t.Fatalf("got %d, %+v", n, err)
+	}
+	if v := dst.Get("a"); v.(int) != 1 {
+		t.Fatalf("got %v", v)
+	}
+	if v := dst.Get("b"); v.(int) != 2 {
+		t.Fatalf("got %v", v)
+	}
+}
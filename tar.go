@@ -0,0 +1,488 @@
+package utils
+
+import (
+	"archive/tar"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+type tarOption struct {
+	pathMatcher
+	compress    string
+	symlink     SymlinkPolicy
+	maxSizeByte int64
+}
+
+// TarOptFunc options for tar
+type TarOptFunc func(*tarOption) error
+
+// WithTarCompress set compress codec name registered by `RegisterCompressCodec`,
+// empty means no compression.
+//
+// only used when creating archive, format is detected automatically when extracting.
+func WithTarCompress(name string) TarOptFunc {
+	return func(opt *tarOption) error {
+		if name != "" {
+			if _, ok := GetCompressCodec(name); !ok {
+				return errors.Errorf("unknown compress codec `%s`", name)
+			}
+		}
+
+		opt.compress = name
+		return nil
+	}
+}
+
+// WithTarSymlinkPolicy set how to handle symlinks, default is SymlinkKeep.
+//
+// when extracting, SymlinkFollow is same as SymlinkKeep,
+// symlinks point to outside of dest are always rejected.
+func WithTarSymlinkPolicy(policy SymlinkPolicy) TarOptFunc {
+	return func(opt *tarOption) error {
+		switch policy {
+		case SymlinkSkip, SymlinkKeep, SymlinkFollow:
+		default:
+			return errors.Errorf("unknown symlink policy %d", policy)
+		}
+
+		opt.symlink = policy
+		return nil
+	}
+}
+
+// WithTarIncludes only handle files match any of glob patterns
+func WithTarIncludes(patterns ...string) TarOptFunc {
+	return func(opt *tarOption) error {
+		if err := validateGlobs(patterns); err != nil {
+			return err
+		}
+
+		opt.includes = append(opt.includes, patterns...)
+		return nil
+	}
+}
+
+// WithTarExcludes skip files and dirs match any of glob patterns
+func WithTarExcludes(patterns ...string) TarOptFunc {
+	return func(opt *tarOption) error {
+		if err := validateGlobs(patterns); err != nil {
+			return err
+		}
+
+		opt.excludes = append(opt.excludes, patterns...)
+		return nil
+	}
+}
+
+// WithTarMaxSizeByte set max decompressed size when extracting, default is unlimited
+func WithTarMaxSizeByte(n int64) TarOptFunc {
+	return func(opt *tarOption) error {
+		if n <= 0 {
+			return errors.Errorf("max size must > 0")
+		}
+
+		opt.maxSizeByte = n
+		return nil
+	}
+}
+
+func newTarOption(opts []TarOptFunc) (*tarOption, error) {
+	opt := &tarOption{
+		symlink:     SymlinkKeep,
+		maxSizeByte: math.MaxInt64,
+	}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	return opt, nil
+}
+
+// tarCompressOfPath guess compress codec by file extension
+func tarCompressOfPath(fpath string) string {
+	fpath = strings.ToLower(fpath)
+	switch {
+	case strings.HasSuffix(fpath, ".tar.gz"), strings.HasSuffix(fpath, ".tgz"):
+		return "gzip"
+	case strings.HasSuffix(fpath, ".tar.zst"), strings.HasSuffix(fpath, ".tzst"):
+		return "zstd"
+	case strings.HasSuffix(fpath, ".tar.lz4"):
+		return "lz4"
+	default:
+		return ""
+	}
+}
+
+// TarFiles archive one or many files into a single tar file.
+//
+// compression is chosen by output's extension (.tar.gz/.tgz, .tar.zst, .tar.lz4),
+// can be overwritten by `WithTarCompress`.
+// files can be directory.
+func TarFiles(output string, files []string, opts ...TarOptFunc) (err error) {
+	opts = append([]TarOptFunc{WithTarCompress(tarCompressOfPath(output))}, opts...)
+	fp, err := os.Create(output)
+	if err != nil {
+		return errors.Wrapf(err, "create file `%s`", output)
+	}
+
+	if err = WriteTar(fp, files, opts...); err != nil {
+		_ = fp.Close()
+		return err
+	}
+
+	return errors.Wrapf(fp.Close(), "close file `%s`", output)
+}
+
+// WriteTar write tar archive of files into w.
+//
+// files can be directory, entries are named relative to the parent of each file.
+func WriteTar(w io.Writer, files []string, opts ...TarOptFunc) (err error) {
+	opt, err := newTarOption(opts)
+	if err != nil {
+		return err
+	}
+
+	var compressor CompressorItf
+	if opt.compress != "" {
+		codec, _ := GetCompressCodec(opt.compress)
+		if compressor, err = codec.NewCompressor(w); err != nil {
+			return errors.Wrapf(err, "new compressor `%s`", opt.compress)
+		}
+		w = compressor
+	}
+
+	tw := tar.NewWriter(w)
+	for _, file := range files {
+		if err = addFileToTar(tw, filepath.Clean(file), opt); err != nil {
+			return errors.Wrapf(err, "add `%s` to tar", file)
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return errors.Wrap(err, "close tar")
+	}
+	if compressor != nil {
+		if err = compressor.Flush(); err != nil {
+			return errors.Wrap(err, "flush compressor")
+		}
+	}
+
+	return nil
+}
+
+func addFileToTar(tw *tar.Writer, root string, opt *tarOption) error {
+	base := filepath.Base(root)
+	return filepath.Walk(root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return errors.Wrapf(err, "get relative path of `%s`", fpath)
+		}
+		name := filepath.ToSlash(filepath.Join(base, rel))
+		if opt.excluded(name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch opt.symlink {
+			case SymlinkSkip:
+				return nil
+			case SymlinkKeep:
+				if link, err = os.Readlink(fpath); err != nil {
+					return errors.Wrapf(err, "read link `%s`", fpath)
+				}
+			case SymlinkFollow:
+				if info, err = os.Stat(fpath); err != nil {
+					return errors.Wrapf(err, "stat `%s`", fpath)
+				}
+				if info.IsDir() {
+					Logger.Debug("skip symlink to dir", zap.String("path", fpath))
+					return nil
+				}
+			}
+		}
+
+		if !opt.match(name) {
+			return nil
+		}
+
+		switch {
+		case info.IsDir(), info.Mode().IsRegular(), info.Mode()&os.ModeSymlink != 0:
+		default:
+			Logger.Debug("skip special file", zap.String("path", fpath))
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return errors.Wrapf(err, "get header of `%s`", fpath)
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header of `%s`", fpath)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		fp, err := os.Open(fpath)
+		if err != nil {
+			return errors.Wrapf(err, "open file `%s`", fpath)
+		}
+		defer fp.Close()
+
+		if _, err = io.Copy(tw, fp); err != nil {
+			return errors.Wrapf(err, "copy file `%s`", fpath)
+		}
+
+		Logger.Debug("add file to tar", zap.String("file", fpath))
+		return nil
+	})
+}
+
+// Untar extract tar archive (optionally compressed) into dest, return extracted paths
+func Untar(src, dest string, opts ...TarOptFunc) (filenames []string, err error) {
+	fp, err := os.Open(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file `%s`", src)
+	}
+	defer fp.Close()
+
+	return ExtractTar(fp, dest, opts...)
+}
+
+type tarExtractedDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+// ExtractTar extract tar archive from r into dest, return extracted paths.
+//
+// compression is detected automatically.
+// permissions and mtimes are preserved,
+// entries or symlinks point to outside of dest are rejected.
+func ExtractTar(r io.Reader, dest string, opts ...TarOptFunc) (filenames []string, err error) {
+	opt, err := newTarOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dr, err := NewDecompressReader(r,
+		WithDecompressPassthrough(),
+		WithDecompressMaxSizeByte(opt.maxSizeByte),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress")
+	}
+	defer dr.Close()
+
+	dest = filepath.Clean(dest)
+	var dirs []tarExtractedDir
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return filenames, errors.Wrap(err, "read tar")
+		}
+
+		if !opt.match(hdr.Name) {
+			continue
+		}
+
+		fpath := filepath.Join(dest, hdr.Name)
+		if !isPathInDir(fpath, dest) {
+			return filenames, errors.Errorf("illegal file path: %s", fpath)
+		}
+		// do not write through extracted symlinks, they may point to outside
+		if err = checkNoSymlinkInPath(dest, filepath.Dir(fpath)); err != nil {
+			return filenames, err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// chmod and chtimes follow symlink
+			if st, err := os.Lstat(fpath); err == nil && st.Mode()&os.ModeSymlink != 0 {
+				return filenames, errors.Errorf("illegal dir path through symlink: %s", fpath)
+			}
+			if err = os.MkdirAll(fpath, os.ModePerm); err != nil {
+				return filenames, errors.Wrapf(err, "create dir `%s`", fpath)
+			}
+			// set permission and mtime after all files extracted
+			dirs = append(dirs, tarExtractedDir{fpath, hdr})
+		case tar.TypeReg, tar.TypeRegA:
+			if err = extractTarFile(tr, fpath, hdr); err != nil {
+				return filenames, err
+			}
+		case tar.TypeSymlink:
+			if opt.symlink == SymlinkSkip {
+				continue
+			}
+
+			if err = checkSymlinkTarget(dest, fpath, hdr.Linkname); err != nil {
+				return filenames, err
+			}
+			if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+				return filenames, errors.Wrapf(err, "create dir `%s`", fpath)
+			}
+			_ = os.Remove(fpath)
+			if err = os.Symlink(hdr.Linkname, fpath); err != nil {
+				return filenames, errors.Wrapf(err, "create symlink `%s`", fpath)
+			}
+		case tar.TypeLink:
+			target := filepath.Join(dest, hdr.Linkname)
+			if !isPathInDir(target, dest) {
+				return filenames, errors.Errorf("illegal link: %s -> %s", fpath, hdr.Linkname)
+			}
+			if err = checkNoSymlinkInPath(dest, target); err != nil {
+				return filenames, err
+			}
+			_ = os.Remove(fpath)
+			if err = os.Link(target, fpath); err != nil {
+				return filenames, errors.Wrapf(err, "create link `%s`", fpath)
+			}
+		default:
+			Logger.Debug("skip unsupported tar entry",
+				zap.String("name", hdr.Name),
+				zap.ByteString("type", []byte{hdr.Typeflag}))
+			continue
+		}
+
+		filenames = append(filenames, fpath)
+	}
+
+	// children first, so parent's mtime will not be changed by children
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err = os.Chmod(d.path, os.FileMode(d.hdr.Mode).Perm()); err != nil {
+			return filenames, errors.Wrapf(err, "chmod `%s`", d.path)
+		}
+		if err = os.Chtimes(d.path, d.hdr.ModTime, d.hdr.ModTime); err != nil {
+			return filenames, errors.Wrapf(err, "chtimes `%s`", d.path)
+		}
+	}
+
+	return filenames, nil
+}
+
+// isPathInDir is cleaned fpath inside dir (or is dir)
+func isPathInDir(fpath, dir string) bool {
+	fpath = filepath.Clean(fpath)
+	return fpath == dir || strings.HasPrefix(fpath, dir+string(os.PathSeparator))
+}
+
+// checkNoSymlinkInPath return error if any existing component of fpath under dir is symlink
+func checkNoSymlinkInPath(dir, fpath string) error {
+	rel, err := filepath.Rel(dir, fpath)
+	if err != nil {
+		return errors.Wrapf(err, "get relative path of `%s`", fpath)
+	}
+	if rel == "." {
+		return nil
+	}
+
+	cur := dir
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		cur = filepath.Join(cur, part)
+		st, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "stat `%s`", cur)
+		}
+
+		if st.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("illegal file path through symlink: %s", cur)
+		}
+	}
+
+	return nil
+}
+
+// checkSymlinkTarget return error if target of symlink fpath is outside dir,
+// or resolved through extracted symlinks
+func checkSymlinkTarget(dir, fpath, linkname string) error {
+	if filepath.IsAbs(linkname) {
+		return errors.Errorf("illegal link: %s -> %s", fpath, linkname)
+	}
+
+	cur := filepath.Dir(fpath)
+	parts := strings.Split(filepath.ToSlash(linkname), "/")
+	for i, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+		default:
+			cur = filepath.Join(cur, part)
+		}
+		if !isPathInDir(cur, dir) {
+			return errors.Errorf("illegal link: %s -> %s", fpath, linkname)
+		}
+		if i == len(parts)-1 {
+			break
+		}
+
+		// `..` after symlink is resolved physically, not lexically
+		if st, err := os.Lstat(cur); err == nil && st.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("illegal link through symlink: %s -> %s", fpath, linkname)
+		}
+	}
+
+	return nil
+}
+
+func extractTarFile(r io.Reader, fpath string, hdr *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+		return errors.Wrapf(err, "create dir `%s`", fpath)
+	}
+
+	// do not write through existing symlink or hard link
+	if st, err := os.Lstat(fpath); err == nil && !st.IsDir() {
+		if err = os.Remove(fpath); err != nil {
+			return errors.Wrapf(err, "remove `%s`", fpath)
+		}
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+	fp, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return errors.Wrapf(err, "open file to write: %s", fpath)
+	}
+	if _, err = io.Copy(fp, r); err != nil {
+		_ = fp.Close()
+		return errors.Wrapf(err, "write file `%s`", fpath)
+	}
+	if err = fp.Close(); err != nil {
+		return errors.Wrapf(err, "close file `%s`", fpath)
+	}
+
+	// file may already exist, or mode masked by umask
+	if err = os.Chmod(fpath, mode); err != nil {
+		return errors.Wrapf(err, "chmod `%s`", fpath)
+	}
+
+	Logger.Debug("extract file", zap.String("path", fpath))
+	return errors.Wrapf(os.Chtimes(fpath, hdr.ModTime, hdr.ModTime), "chtimes `%s`", fpath)
+}
@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func prepareTarTestDir(t *testing.T, dir string) (root string, mtime time.Time) {
+	root = filepath.Join(dir, "root")
+	mtime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, content := range map[string]string{
+		"a.txt":     "a",
+		"sub/b.log": "b",
+		"sub/c.txt": "c",
+	} {
+		fpath := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err := ioutil.WriteFile(fpath, []byte(content), 0640); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err := os.Chtimes(fpath, mtime, mtime); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := os.Symlink("a.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	return root, mtime
+}
+
+func TestTarFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTarFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, mtime := prepareTarTestDir(t, dir)
+
+	for _, ext := range []string{".tar", ".tar.gz", ".tar.zst"} {
+		archive := filepath.Join(dir, "test"+ext)
+		if err = TarFiles(archive, []string{root}, WithTarExcludes("*.log")); err != nil {
+			t.Fatalf("%s: %+v", ext, err)
+		}
+
+		dest := filepath.Join(dir, "dest"+ext)
+		files, err := Untar(archive, dest)
+		if err != nil {
+			t.Fatalf("%s: %+v", ext, err)
+		}
+		if len(files) != 5 {
+			t.Fatalf("%s: got %v", ext, files)
+		}
+
+		fpath := filepath.Join(dest, "root", "sub", "c.txt")
+		st, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatalf("%s: %+v", ext, err)
+		}
+		if st.Mode().Perm() != 0640 || !st.ModTime().Equal(mtime) {
+			t.Fatalf("%s: got %v, %v", ext, st.Mode(), st.ModTime())
+		}
+		if _, err = os.Stat(filepath.Join(dest, "root", "sub", "b.log")); !os.IsNotExist(err) {
+			t.Fatalf("%s: b.log should be excluded", ext)
+		}
+		if link, err := os.Readlink(filepath.Join(dest, "root", "link")); err != nil || link != "a.txt" {
+			t.Fatalf("%s: got %s, %+v", ext, link, err)
+		}
+	}
+
+	// streaming with includes and follow symlink
+	buf := &bytes.Buffer{}
+	if err = WriteTar(buf, []string{root},
+		WithTarCompress("lz4"),
+		WithTarIncludes("*.txt", "link"),
+		WithTarSymlinkPolicy(SymlinkFollow),
+	); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	dest := filepath.Join(dir, "dest-stream")
+	files, err := ExtractTar(buf, dest)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	sort.Strings(files)
+	expect := []string{
+		filepath.Join(dest, "root", "a.txt"),
+		filepath.Join(dest, "root", "link"),
+		filepath.Join(dest, "root", "sub", "c.txt"),
+	}
+	if len(files) != len(expect) {
+		t.Fatalf("got %v", files)
+	}
+	for i := range expect {
+		if files[i] != expect[i] {
+			t.Fatalf("got %v", files)
+		}
+	}
+	if st, err := os.Lstat(filepath.Join(dest, "root", "link")); err != nil || !st.Mode().IsRegular() {
+		t.Fatalf("link should be regular file, got %+v", err)
+	}
+
+	if err = WriteTar(buf, []string{root}, WithTarCompress("notexists")); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestExtractTarIllegal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExtractTarIllegal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, hdrs := range map[string][]*tar.Header{
+		"zip slip": {
+			{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"abs symlink": {
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		},
+		"escape symlink": {
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		},
+		"through symlink": {
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "l/x", Typeflag: tar.TypeSymlink, Linkname: "../evil"},
+		},
+	} {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, hdr := range hdrs {
+			if err = tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("%s: %+v", name, err)
+			}
+		}
+		if err = tw.Close(); err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+
+		if _, err = ExtractTar(buf, filepath.Join(dir, "dest")); err == nil {
+			t.Fatalf("%s: should error", name)
+		}
+		if _, err = os.Lstat(filepath.Join(dir, "evil")); !os.IsNotExist(err) {
+			t.Fatalf("%s: escaped", name)
+		}
+	}
+}
+
+func TestExtractTarLinkChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExtractTarLinkChain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	victim := filepath.Join(dir, "victim")
+	if err = ioutil.WriteFile(victim, []byte("safe"), 0644); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err = os.MkdirAll(dest, 0755); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	newTar := func(hdrs ...*tar.Header) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, hdr := range hdrs {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if hdr.Size > 0 {
+				if _, err := tw.Write([]byte("PWNED")); err != nil {
+					t.Fatalf("%+v", err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		return buf
+	}
+	checkVictim := func() {
+		cnt, err := ioutil.ReadFile(victim)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if string(cnt) != "safe" {
+			t.Fatalf("got %s", cnt)
+		}
+	}
+
+	// x/l -> dest, y -> x/l/.. -> dir, h -> y/victim -> dir/victim
+	if _, err = ExtractTar(newTar(
+		&tar.Header{Name: "x/l", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		&tar.Header{Name: "y", Typeflag: tar.TypeSymlink, Linkname: "x/l/.."},
+		&tar.Header{Name: "h", Typeflag: tar.TypeLink, Linkname: "y/victim"},
+		&tar.Header{Name: "h", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	), dest); err == nil {
+		t.Fatal("should error")
+	}
+	checkVictim()
+
+	// do not write through existing hard link
+	if err = os.Link(victim, filepath.Join(dest, "h2")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = ExtractTar(newTar(
+		&tar.Header{Name: "h2", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	), dest); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkVictim()
+	if cnt, err := ioutil.ReadFile(filepath.Join(dest, "h2")); err != nil || string(cnt) != "PWNED" {
+		t.Fatalf("got %s, %+v", cnt, err)
+	}
+}
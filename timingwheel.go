@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	timingWheelSlotBits = 6
+	timingWheelSlots    = 1 << timingWheelSlotBits
+	timingWheelMask     = timingWheelSlots - 1
+	timingWheelLevels   = 4
+)
+
+type timingWheelEntry struct {
+	key interface{}
+	// tick when entry should expire
+	tick int64
+}
+
+// timingWheelExpireFunc called when key expired.
+//
+// return next time and true to reschedule key,
+// the key is removed from wheel if return false.
+type timingWheelExpireFunc func(key interface{}) (next time.Time, reschedule bool)
+
+// timingWheel hierarchical timing wheel,
+// cost of each tick is proportional to the number of expiring keys.
+//
+// each level has 64 slots, slot of level n spans 64^n ticks.
+// keys expire later than the span of the highest level
+// will be clamped, then rescheduled when fired.
+type timingWheel struct {
+	mu       sync.Mutex
+	tick     int64
+	cur      int64
+	levels   [timingWheelLevels][timingWheelSlots][]timingWheelEntry
+	onExpire timingWheelExpireFunc
+}
+
+// newTimingWheel new timingWheel driven by `Clock`, stop when ctx done
+func newTimingWheel(ctx context.Context, tick time.Duration, onExpire timingWheelExpireFunc) *timingWheel {
+	w := &timingWheel{
+		tick:     int64(tick),
+		onExpire: onExpire,
+	}
+	w.cur = Clock.GetUTCNow().UnixNano() / w.tick
+
+	go w.run(ctx, tick)
+	return w
+}
+
+func (w *timingWheel) run(ctx context.Context, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var expired []timingWheelEntry
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		expired = w.advance(Clock.GetUTCNow(), expired[:0])
+		for _, e := range expired {
+			if next, ok := w.onExpire(e.key); ok {
+				w.Add(e.key, next)
+			}
+		}
+	}
+}
+
+// Add schedule key to expire at `at`
+func (w *timingWheel) Add(key interface{}, at time.Time) {
+	e := timingWheelEntry{
+		key:  key,
+		tick: at.UnixNano() / w.tick,
+	}
+
+	w.mu.Lock()
+	if e.tick <= w.cur {
+		// fire at next tick
+		e.tick = w.cur + 1
+	}
+	w.addLocked(e)
+	w.mu.Unlock()
+}
+
+// addLocked put entry into slot, return false if entry is already due
+func (w *timingWheel) addLocked(e timingWheelEntry) bool {
+	delta := e.tick - w.cur
+	if delta <= 0 {
+		return false
+	}
+
+	for lv := 0; lv < timingWheelLevels; lv++ {
+		if delta < 1<<(uint(lv+1)*timingWheelSlotBits) {
+			idx := (e.tick >> (uint(lv) * timingWheelSlotBits)) & timingWheelMask
+			w.levels[lv][idx] = append(w.levels[lv][idx], e)
+			return true
+		}
+	}
+
+	// too far, clamp to the last slot of the highest level
+	e.tick = w.cur + 1<<(timingWheelLevels*timingWheelSlotBits) - 1
+	return w.addLocked(e)
+}
+
+// advance move wheel to now, append expired entries into expired
+func (w *timingWheel) advance(now time.Time, expired []timingWheelEntry) []timingWheelEntry {
+	target := now.UnixNano() / w.tick
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.cur < target {
+		w.cur++
+
+		// cascade higher levels first,
+		// their entries may fall into lower levels' current slot
+		maxLv := 0
+		for lv := 1; lv < timingWheelLevels; lv++ {
+			if w.cur&(1<<(uint(lv)*timingWheelSlotBits)-1) != 0 {
+				break
+			}
+			maxLv = lv
+		}
+		for lv := maxLv; lv > 0; lv-- {
+			idx := (w.cur >> (uint(lv) * timingWheelSlotBits)) & timingWheelMask
+			entries := w.levels[lv][idx]
+			w.levels[lv][idx] = nil
+			for _, e := range entries {
+				if !w.addLocked(e) {
+					expired = append(expired, e)
+				}
+			}
+		}
+
+		idx := w.cur & timingWheelMask
+		expired = append(expired, w.levels[0][idx]...)
+		w.levels[0][idx] = nil
+	}
+
+	return expired
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimingWheelAdvance(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	w := &timingWheel{tick: int64(time.Millisecond)}
+
+	// cover all levels and the clamped range
+	delays := []int64{1, 2, 63, 64, 65, 4095, 4096, 5000, 300000, 1 << 26}
+	for _, d := range delays {
+		w.Add(d, start.Add(time.Duration(d)*time.Millisecond))
+	}
+
+	fired := map[int64]int64{}
+	var (
+		expired []timingWheelEntry
+		step    int64 = 1
+	)
+	for now := int64(1); len(fired) < len(delays); now += step {
+		if now > 10000 {
+			step = 1000
+		}
+
+		expired = w.advance(start.Add(time.Duration(now)*time.Millisecond), expired[:0])
+		for _, e := range expired {
+			fired[e.key.(int64)] = now
+		}
+	}
+
+	for _, d := range delays {
+		at := fired[d]
+		switch {
+		case d >= 1<<24:
+			// clamped
+			if at < 1<<24-1 || at >= 1<<24-1+step {
+				t.Fatalf("%d fired at %d", d, at)
+			}
+		case d > 10000:
+			if at < d || at >= d+step {
+				t.Fatalf("%d fired at %d", d, at)
+			}
+		default:
+			if at != d {
+				t.Fatalf("%d fired at %d", d, at)
+			}
+		}
+	}
+
+	// already due
+	w.Add("due", start)
+	if expired = w.advance(start.Add(time.Duration(w.cur+1)*time.Millisecond), expired[:0]); len(expired) != 1 {
+		t.Fatalf("got %+v", expired)
+	}
+}
+
+func TestTimingWheelReschedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu    sync.Mutex
+		nFire int
+		done  = make(chan struct{})
+	)
+	var w *timingWheel
+	w = newTimingWheel(ctx, 10*time.Millisecond, func(key interface{}) (time.Time, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		nFire++
+		if nFire == 3 {
+			close(done)
+			return time.Time{}, false
+		}
+
+		return Clock.GetUTCNow().Add(20 * time.Millisecond), true
+	})
+	w.Add("k", Clock.GetUTCNow().Add(20*time.Millisecond))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -538,12 +538,68 @@ func (c *SimpleExpCache) GetUintSlice() (data []uint, ok bool) {
 	return itf.([]uint), true
 }
 
+const expCacheShards = 32
+
+// shardIdxOfKey return the shard index of key
+func shardIdxOfKey(key interface{}, nShards int) int {
+	var h uint64
+	switch k := key.(type) {
+	case string:
+		// fnv-1a
+		h = 14695981039346656037
+		for i := 0; i < len(k); i++ {
+			h ^= uint64(k[i])
+			h *= 1099511628211
+		}
+	case int:
+		h = uint64(k)
+	case int64:
+		h = uint64(k)
+	case int32:
+		h = uint64(k)
+	case uint:
+		h = uint64(k)
+	case uint64:
+		h = k
+	case uint32:
+		h = uint64(k)
+	default:
+		v := reflect.ValueOf(key)
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+			h = uint64(v.Pointer())
+		default:
+			return shardIdxOfKey(fmt.Sprint(key), nShards)
+		}
+	}
+
+	return int(h % uint64(nShards))
+}
+
+// expTick return tick interval of timing wheel for ttl
+func expTick(ttl time.Duration) time.Duration {
+	tick := ttl / 8
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+
+	return tick
+}
+
 // ExpCache cache with expires
 //
-// can Store/Load like map
+// can Store/Load like map.
+// keys are sharded, expired keys are removed by timing wheel,
+// so the cost of cleaning is proportional to the number of expiring keys.
 type ExpCache struct {
-	data sync.Map
-	ttl  time.Duration
+	shards [expCacheShards]expCacheShard
+	ttl    time.Duration
+	wheel  *timingWheel
+}
+
+type expCacheShard struct {
+	sync.RWMutex
+	m map[interface{}]*expCacheItem
 }
 
 type expCacheItem struct {
@@ -556,76 +612,97 @@ func NewExpCache(ctx context.Context, ttl time.Duration) *ExpCache {
 	c := &ExpCache{
 		ttl: ttl,
 	}
-	go c.runClean(ctx)
+	for i := range c.shards {
+		c.shards[i].m = map[interface{}]*expCacheItem{}
+	}
+
+	c.wheel = newTimingWheel(ctx, expTick(ttl), c.onExpire)
 	return c
 }
 
-func (c *ExpCache) runClean(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-
-		c.data.Range(func(k, v interface{}) bool {
-			if v.(*expCacheItem).exp.After(Clock.GetUTCNow()) {
-				// expired
-				//
-				// if new expCacheItem stored just before delete,
-				// may delete item that not expired.
-				// but this condition is rare, so may just add a little cose.
-				c.data.Delete(k)
-			}
+func (c *ExpCache) shard(key interface{}) *expCacheShard {
+	return &c.shards[shardIdxOfKey(key, expCacheShards)]
+}
 
-			return true
-		})
+// onExpire delete key if expired, or reschedule if key is stored again
+func (c *ExpCache) onExpire(key interface{}) (next time.Time, reschedule bool) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
 
-		time.Sleep(c.ttl)
+	item, ok := s.m[key]
+	if !ok {
+		return
 	}
+	if item.exp.After(Clock.GetUTCNow()) {
+		return item.exp, true
+	}
+
+	delete(s.m, key)
+	return
 }
 
 // Store store new key and val into cache
 func (c *ExpCache) Store(key, val interface{}) {
-	c.data.Store(key, &expCacheItem{
+	exp := Clock.GetUTCNow().Add(c.ttl)
+	s := c.shard(key)
+	s.Lock()
+	if item, ok := s.m[key]; ok {
+		// already scheduled in wheel
+		item.exp = exp
+		item.data = val
+		s.Unlock()
+		return
+	}
+
+	s.m[key] = &expCacheItem{
 		data: val,
-		exp:  Clock.GetUTCNow().Add(c.ttl),
-	})
+		exp:  exp,
+	}
+	s.Unlock()
+	c.wheel.Add(key, exp)
 }
 
 // Load load val from cache
 func (c *ExpCache) Load(key interface{}) (data interface{}, ok bool) {
-	if data, ok = c.data.Load(key); ok && Clock.GetUTCNow().Before(data.(*expCacheItem).exp) {
-		return data.(*expCacheItem).data, ok
-	} else if ok {
-		// delete expired
-		c.data.Delete(key)
+	s := c.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	if item, ok := s.m[key]; ok && Clock.GetUTCNow().Before(item.exp) {
+		return item.data, true
 	}
 
 	return nil, false
 }
 
 type expiredMapItem struct {
-	sync.RWMutex
 	data interface{}
-	t    *int64
+	// t last access time in unix nano
+	t int64
 }
 
 func (e *expiredMapItem) getTime() time.Time {
-	return ParseUnix2UTC(atomic.LoadInt64(e.t))
+	return time.Unix(0, atomic.LoadInt64(&e.t)).UTC()
 }
 
 func (e *expiredMapItem) refreshTime() {
-	atomic.StoreInt64(e.t, Clock.GetUTCNow().Unix())
+	atomic.StoreInt64(&e.t, Clock.GetUTCNow().UnixNano())
+}
+
+type expiredMapShard struct {
+	sync.RWMutex
+	m map[string]*expiredMapItem
 }
 
 // ExpiredMap map with expire time, auto delete expired item.
 //
 // `Get` will auto refresh item's expires.
 type ExpiredMap struct {
-	m   sync.Map
-	ttl time.Duration
-	new func() interface{}
+	shards [expCacheShards]expiredMapShard
+	ttl    time.Duration
+	new    func() interface{}
+	wheel  *timingWheel
 }
 
 // NewExpiredMap new ExpiredMap
@@ -634,58 +711,65 @@ func NewExpiredMap(ctx context.Context, ttl time.Duration, new func() interface{
 		ttl: ttl,
 		new: new,
 	}
+	for i := range el.shards {
+		el.shards[i].m = map[string]*expiredMapItem{}
+	}
 
-	go el.clean(ctx)
+	el.wheel = newTimingWheel(ctx, expTick(ttl), el.onExpire)
 	return el, nil
 }
 
-func (e *ExpiredMap) clean(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-
-		e.m.Range(func(k, v interface{}) bool {
-			if v.(*expiredMapItem).getTime().Add(e.ttl).After(Clock.GetUTCNow()) {
-				return true
-			}
-
-			// lock is expired
-			v.(*expiredMapItem).Lock()
-			defer v.(*expiredMapItem).Unlock()
-
-			if v.(*expiredMapItem).getTime().Add(e.ttl).Before(Clock.GetUTCNow()) {
-				// lock still expired
-				e.m.Delete(k)
-			}
+func (e *ExpiredMap) shard(key string) *expiredMapShard {
+	return &e.shards[shardIdxOfKey(key, expCacheShards)]
+}
 
-			return true
-		})
+// onExpire delete key if not accessed during ttl, or reschedule
+func (e *ExpiredMap) onExpire(k interface{}) (next time.Time, reschedule bool) {
+	key := k.(string)
+	s := e.shard(key)
+	s.Lock()
+	defer s.Unlock()
 
-		time.Sleep(e.ttl / 2)
+	item, ok := s.m[key]
+	if !ok {
+		return
 	}
+	if exp := item.getTime().Add(e.ttl); exp.After(Clock.GetUTCNow()) {
+		return exp, true
+	}
+
+	delete(s.m, key)
+	return
 }
 
 // Get get item
 //
 // will auto refresh key's ttl
 func (e *ExpiredMap) Get(key string) interface{} {
-	l, _ := e.m.Load(key)
-	if l == nil {
-		t := Clock.GetUTCNow().Unix()
-		l, _ = e.m.LoadOrStore(key, &expiredMapItem{
-			t:    &t,
-			data: e.new(),
-		})
-	} else {
-		ol := l.(*expiredMapItem)
-		ol.RLock()
-		ol.refreshTime()
-		l, _ = e.m.LoadOrStore(key, ol)
-		ol.RUnlock()
-	}
-
-	return l.(*expiredMapItem).data
+	s := e.shard(key)
+	s.RLock()
+	if item, ok := s.m[key]; ok {
+		item.refreshTime()
+		s.RUnlock()
+		return item.data
+	}
+	s.RUnlock()
+
+	s.Lock()
+	item, ok := s.m[key]
+	if ok {
+		item.refreshTime()
+		s.Unlock()
+		return item.data
+	}
+
+	item = &expiredMapItem{
+		data: e.new(),
+	}
+	item.refreshTime()
+	s.m[key] = item
+	s.Unlock()
+
+	e.wheel.Add(key, item.getTime().Add(e.ttl))
+	return item.data
 }
@@ -8,6 +8,7 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"sync"
 	"testing"
 	"time"
 
@@ -632,6 +633,132 @@ func TestExpCache_Store(t *testing.T) {
 	}
 }
 
+func TestExpCacheClean(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := NewExpCache(ctx, 50*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		cm.Store(i, i)
+	}
+	cm.Store("a", "a")
+
+	// keep refreshing "a"
+	for i := 0; i < 10; i++ {
+		time.Sleep(20 * time.Millisecond)
+		cm.Store("a", "b")
+	}
+	if v, ok := cm.Load("a"); !ok || v.(string) != "b" {
+		t.Fatalf("got %v", v)
+	}
+
+	n := 0
+	for i := range cm.shards {
+		cm.shards[i].RLock()
+		n += len(cm.shards[i].m)
+		cm.shards[i].RUnlock()
+	}
+	if n != 1 {
+		t.Fatalf("expired keys should be cleaned, got %d", n)
+	}
+}
+
+// syncMapExpCache the previous implementation of ExpCache,
+// scan all keys on every clean
+type syncMapExpCache struct {
+	data sync.Map
+	ttl  time.Duration
+}
+
+func (c *syncMapExpCache) clean() {
+	now := Clock.GetUTCNow()
+	c.data.Range(func(k, v interface{}) bool {
+		if !v.(*expCacheItem).exp.After(now) {
+			c.data.Delete(k)
+		}
+
+		return true
+	})
+}
+
+func (c *syncMapExpCache) Store(key, val interface{}) {
+	c.data.Store(key, &expCacheItem{
+		data: val,
+		exp:  Clock.GetUTCNow().Add(c.ttl),
+	})
+}
+
+func (c *syncMapExpCache) Load(key interface{}) (data interface{}, ok bool) {
+	if data, ok = c.data.Load(key); ok && Clock.GetUTCNow().Before(data.(*expCacheItem).exp) {
+		return data.(*expCacheItem).data, ok
+	}
+
+	return nil, false
+}
+
+func BenchmarkExpCache(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const nKeys = 100000
+	old := &syncMapExpCache{ttl: time.Hour}
+	cm := NewExpCache(ctx, time.Hour)
+	for i := 0; i < nKeys; i++ {
+		old.Store(i, i)
+		cm.Store(i, i)
+	}
+
+	b.Run("sync.Map store/load", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.Int()
+			for pb.Next() {
+				i++
+				if i%4 == 0 {
+					old.Store(i%nKeys, i)
+				} else {
+					old.Load(i % nKeys)
+				}
+			}
+		})
+	})
+	b.Run("sharded store/load", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.Int()
+			for pb.Next() {
+				i++
+				if i%4 == 0 {
+					cm.Store(i%nKeys, i)
+				} else {
+					cm.Load(i % nKeys)
+				}
+			}
+		})
+	})
+
+	// cost of one clean round when nothing expires
+	b.Run("sync.Map clean", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			old.clean()
+		}
+	})
+	b.Run("timing wheel clean", func(b *testing.B) {
+		now := Clock.GetUTCNow()
+		w := &timingWheel{
+			tick: int64(time.Millisecond),
+			cur:  now.UnixNano() / int64(time.Millisecond),
+		}
+		for i := 0; i < nKeys; i++ {
+			w.Add(i, now.Add(time.Hour))
+		}
+
+		var expired []timingWheelEntry
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			expired = w.advance(now.Add(time.Duration(i)*time.Millisecond), expired[:0])
+		}
+	})
+}
+
 // goos: linux
 // goarch: amd64
 // pkg: github.com/Laisky/go-utils
@@ -0,0 +1,632 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultFSWatcherDebounce     = 100 * time.Millisecond
+	defaultFSWatcherPollInterval = time.Second
+	defaultFSWatcherBufferSize   = 100
+)
+
+// FSEventOp operations of file event, can be combined after debouncing
+type FSEventOp uint32
+
+const (
+	// FSEventCreate file or dir created
+	FSEventCreate FSEventOp = 1 << iota
+	// FSEventWrite file content changed
+	FSEventWrite
+	// FSEventRemove file or dir removed
+	FSEventRemove
+	// FSEventRename file or dir renamed (moved away),
+	// the new name is reported as FSEventCreate
+	FSEventRename
+)
+
+// Has whether op contains target
+func (op FSEventOp) Has(target FSEventOp) bool {
+	return op&target != 0
+}
+
+func (op FSEventOp) String() string {
+	var names []string
+	for _, o := range []struct {
+		op   FSEventOp
+		name string
+	}{
+		{FSEventCreate, "CREATE"},
+		{FSEventWrite, "WRITE"},
+		{FSEventRemove, "REMOVE"},
+		{FSEventRename, "RENAME"},
+	} {
+		if op.Has(o.op) {
+			names = append(names, o.name)
+		}
+	}
+
+	return strings.Join(names, "|")
+}
+
+const (
+	// FSWatcherMetaPath meta key of file path in events published to EventEngine
+	FSWatcherMetaPath MetaKey = "path"
+	// FSWatcherMetaOp meta key of FSEventOp in events published to EventEngine
+	FSWatcherMetaOp MetaKey = "op"
+	// FSWatcherMetaTime meta key of time of the last operation in events published to EventEngine,
+	// `Event.Time` is the time of publishing
+	FSWatcherMetaTime MetaKey = "time"
+)
+
+// FSEvent file event
+type FSEvent struct {
+	// Path path of file
+	Path string
+	// Op operations happened during debounce window
+	Op FSEventOp
+	// Time of the last operation
+	Time time.Time
+}
+
+type fsWatcherOption struct {
+	pathMatcher
+	debounce     time.Duration
+	pollInterval time.Duration
+	forcePoll    bool
+	bufSize      int
+	logger       *LoggerType
+	engine       *EventEngine
+	topic        EventTopic
+}
+
+// FSWatcherOptFunc options for FSWatcher
+type FSWatcherOptFunc func(*fsWatcherOption) error
+
+// WithFSWatcherDebounce set debounce window,
+// events of the same path within window are merged into one event.
+// 0 means no debouncing, default is 100ms.
+func WithFSWatcherDebounce(debounce time.Duration) FSWatcherOptFunc {
+	return func(opt *fsWatcherOption) error {
+		if debounce < 0 {
+			return errors.Errorf("debounce must >= 0")
+		}
+
+		opt.debounce = debounce
+		return nil
+	}
+}
+
+// WithFSWatcherPolling force to watch by polling with interval,
+// default is to use inotify (or the equivalent of os),
+// and fallback to polling with 1s interval if not available.
+func WithFSWatcherPolling(interval time.Duration) FSWatcherOptFunc {
+	return func(opt *fsWatcherOption) error {
+		if interval <= 0 {
+			return errors.Errorf("interval must > 0")
+		}
+
+		opt.forcePoll = true
+		opt.pollInterval = interval
+		return nil
+	}
+}
+
+// WithFSWatcherIncludes only report paths match any of glob patterns
+func WithFSWatcherIncludes(patterns ...string) FSWatcherOptFunc {
+	return func(opt *fsWatcherOption) error {
+		if err := validateGlobs(patterns); err != nil {
+			return err
+		}
+
+		opt.includes = append(opt.includes, patterns...)
+		return nil
+	}
+}
+
+// WithFSWatcherExcludes ignore paths and dirs match any of glob patterns
+func WithFSWatcherExcludes(patterns ...string) FSWatcherOptFunc {
+	return func(opt *fsWatcherOption) error {
+		if err := validateGlobs(patterns); err != nil {
+			return err
+		}
+
+		opt.excludes = append(opt.excludes, patterns...)
+		return nil
+	}
+}
+
+// WithFSWatcherBufferSize set buffer size of events channel, default is 100
+func WithFSWatcherBufferSize(size int) FSWatcherOptFunc {
+	return func(opt *fsWatcherOption) error {
+		if size < 0 {
+			return errors.Errorf("size must >= 0")
+		}
+
+		opt.bufSize = size
+		return nil
+	}
+}
+
+// WithFSWatcherLogger set logger
+func WithFSWatcherLogger(logger *LoggerType) FSWatcherOptFunc {
+	return func(opt *fsWatcherOption) error {
+		if logger == nil {
+			return errors.Errorf("logger is nil")
+		}
+
+		opt.logger = logger
+		return nil
+	}
+}
+
+// WithFSWatcherEventEngine publish events into engine with topic instead of `Events()`,
+// path, op and time are set in meta with key `FSWatcherMetaPath`, `FSWatcherMetaOp`
+// and `FSWatcherMetaTime`.
+func WithFSWatcherEventEngine(engine *EventEngine, topic EventTopic) FSWatcherOptFunc {
+	return func(opt *fsWatcherOption) error {
+		if engine == nil {
+			return errors.Errorf("engine is nil")
+		}
+		if topic == "" || topic.IsPattern() {
+			return errors.Errorf("invalid topic `%s`", topic)
+		}
+
+		opt.engine = engine
+		opt.topic = topic
+		return nil
+	}
+}
+
+// fsWatchRoot path to watch
+type fsWatchRoot struct {
+	path  string
+	isDir bool
+}
+
+// FSWatcher watch files or directory trees.
+//
+// dirs are watched recursively, new sub dirs are watched automatically.
+// polling can not detect rename, renaming is reported as remove and create.
+type FSWatcher struct {
+	*fsWatcherOption
+	roots  []*fsWatchRoot
+	raw    chan *FSEvent
+	events chan *FSEvent
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// notify is nil when polling
+	notify *fsnotify.Watcher
+}
+
+// NewFSWatcher create and start watcher on paths, paths must exist.
+//
+// watcher is stopped when ctx done or `Close` is called.
+func NewFSWatcher(ctx context.Context, paths []string, opts ...FSWatcherOptFunc) (w *FSWatcher, err error) {
+	opt := &fsWatcherOption{
+		debounce:     defaultFSWatcherDebounce,
+		pollInterval: defaultFSWatcherPollInterval,
+		bufSize:      defaultFSWatcherBufferSize,
+		logger:       Logger.Named("fs_watcher"),
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.Errorf("paths should not be empty")
+	}
+
+	w = &FSWatcher{
+		fsWatcherOption: opt,
+		raw:             make(chan *FSEvent, opt.bufSize),
+		events:          make(chan *FSEvent, opt.bufSize),
+	}
+	for _, fpath := range paths {
+		if fpath, err = filepath.Abs(fpath); err != nil {
+			return nil, errors.Wrapf(err, "get abs path of `%s`", fpath)
+		}
+		st, err := os.Stat(fpath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "stat `%s`", fpath)
+		}
+
+		w.roots = append(w.roots, &fsWatchRoot{path: fpath, isDir: st.IsDir()})
+	}
+
+	ctx, w.cancel = context.WithCancel(ctx)
+	if !opt.forcePoll {
+		if err = w.setupNotify(); err != nil {
+			w.logger.Warn("fallback to polling", zap.Error(err))
+			w.notify = nil
+		}
+	}
+
+	w.wg.Add(2)
+	if w.notify != nil {
+		go w.runNotify(ctx)
+	} else {
+		snap, err := w.scan()
+		if err != nil {
+			w.cancel()
+			return nil, err
+		}
+
+		go w.runPoll(ctx, snap)
+	}
+	go w.runDebounce(ctx)
+
+	go func() {
+		w.wg.Wait()
+		close(w.events)
+	}()
+
+	return w, nil
+}
+
+// Events return channel of events,
+// closed after watcher stopped.
+// events are not sent to channel if `WithFSWatcherEventEngine` is set.
+func (w *FSWatcher) Events() <-chan *FSEvent {
+	return w.events
+}
+
+// Close stop watcher
+func (w *FSWatcher) Close() {
+	w.cancel()
+}
+
+// rootOf return the watched root contains fpath
+func (w *FSWatcher) rootOf(fpath string) *fsWatchRoot {
+	for _, root := range w.roots {
+		if fpath == root.path || (root.isDir && isPathInDir(fpath, root.path)) {
+			return root
+		}
+	}
+
+	return nil
+}
+
+// isExcluded whether dir or file should not be watched
+func (w *FSWatcher) isExcluded(fpath string) bool {
+	root := w.rootOf(fpath)
+	if root == nil {
+		return true
+	}
+	if !root.isDir || fpath == root.path {
+		return false
+	}
+
+	rel, err := filepath.Rel(root.path, fpath)
+	if err != nil {
+		return true
+	}
+
+	return w.excluded(filepath.ToSlash(rel))
+}
+
+// isWanted whether event of fpath should be reported
+func (w *FSWatcher) isWanted(fpath string) bool {
+	root := w.rootOf(fpath)
+	if root == nil {
+		return false
+	}
+	if !root.isDir || fpath == root.path {
+		return true
+	}
+
+	rel, err := filepath.Rel(root.path, fpath)
+	if err != nil {
+		return false
+	}
+
+	return w.match(filepath.ToSlash(rel))
+}
+
+func (w *FSWatcher) report(ctx context.Context, fpath string, op FSEventOp) {
+	if !w.isWanted(fpath) {
+		return
+	}
+
+	select {
+	case w.raw <- &FSEvent{Path: fpath, Op: op, Time: Clock.GetUTCNow()}:
+	case <-ctx.Done():
+	}
+}
+
+// setupNotify watch all roots by fsnotify.
+//
+// single file is watched by its parent dir,
+// so the file could be replaced by rename.
+func (w *FSWatcher) setupNotify() (err error) {
+	if w.notify, err = fsnotify.NewWatcher(); err != nil {
+		return errors.Wrap(err, "new fsnotify watcher")
+	}
+
+	for _, root := range w.roots {
+		if !root.isDir {
+			err = w.notify.Add(filepath.Dir(root.path))
+		} else {
+			err = w.addNotifyTree(nil, root.path)
+		}
+		if err != nil {
+			_ = w.notify.Close()
+			return errors.Wrapf(err, "watch `%s`", root.path)
+		}
+	}
+
+	return nil
+}
+
+// addNotifyTree watch dir and all its sub dirs,
+// call found for files and dirs in tree except dir itself
+func (w *FSWatcher) addNotifyTree(found func(fpath string), dir string) error {
+	return filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return errors.Wrapf(err, "walk `%s`", fpath)
+		}
+		if w.isExcluded(fpath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+		if found != nil && fpath != dir {
+			found(fpath)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		if err = w.notify.Add(fpath); err != nil {
+			return errors.Wrapf(err, "watch `%s`", fpath)
+		}
+
+		w.logger.Debug("watch dir", zap.String("dir", fpath))
+		return nil
+	})
+}
+
+func (w *FSWatcher) runNotify(ctx context.Context) {
+	defer w.wg.Done()
+	defer w.notify.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-w.notify.Errors:
+			if !ok {
+				return
+			}
+
+			w.logger.Error("watch error", zap.Error(err))
+		case evt, ok := <-w.notify.Events:
+			if !ok {
+				return
+			}
+
+			w.handleNotify(ctx, evt)
+		}
+	}
+}
+
+func (w *FSWatcher) handleNotify(ctx context.Context, evt fsnotify.Event) {
+	fpath := filepath.Clean(evt.Name)
+	if w.isExcluded(fpath) {
+		return
+	}
+
+	var op FSEventOp
+	if evt.Op&fsnotify.Create != 0 {
+		op |= FSEventCreate
+		root := w.rootOf(fpath)
+		if st, err := os.Lstat(fpath); err == nil && st.IsDir() && root.isDir {
+			// files could be created before the new dir is watched
+			if err = w.addNotifyTree(func(sub string) {
+				w.report(ctx, sub, FSEventCreate)
+			}, fpath); err != nil {
+				w.logger.Error("watch new dir", zap.String("dir", fpath), zap.Error(err))
+			}
+		}
+	}
+	if evt.Op&fsnotify.Write != 0 {
+		op |= FSEventWrite
+	}
+	if evt.Op&fsnotify.Remove != 0 {
+		op |= FSEventRemove
+	}
+	if evt.Op&fsnotify.Rename != 0 {
+		op |= FSEventRename
+	}
+	if op == 0 {
+		return
+	}
+
+	w.report(ctx, fpath, op)
+}
+
+// fsPollState state of file used to detect changes by polling
+type fsPollState struct {
+	size  int64
+	mtime time.Time
+	isDir bool
+}
+
+// scan all files and dirs in roots
+func (w *FSWatcher) scan() (snap map[string]fsPollState, err error) {
+	snap = map[string]fsPollState{}
+	for _, root := range w.roots {
+		if err = filepath.Walk(root.path, func(fpath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+
+				return errors.Wrapf(err, "walk `%s`", fpath)
+			}
+			if w.isExcluded(fpath) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			snap[fpath] = fsPollState{
+				size:  info.Size(),
+				mtime: info.ModTime(),
+				isDir: info.IsDir(),
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return snap, nil
+}
+
+func (w *FSWatcher) runPoll(ctx context.Context, snap map[string]fsPollState) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cur, err := w.scan()
+		if err != nil {
+			w.logger.Error("scan files", zap.Error(err))
+			continue
+		}
+
+		for fpath, st := range cur {
+			old, ok := snap[fpath]
+			switch {
+			case !ok:
+				w.report(ctx, fpath, FSEventCreate)
+			case old.isDir != st.isDir:
+				w.report(ctx, fpath, FSEventRemove|FSEventCreate)
+			case !st.isDir && (old.size != st.size || !old.mtime.Equal(st.mtime)):
+				w.report(ctx, fpath, FSEventWrite)
+			}
+		}
+		for fpath := range snap {
+			if _, ok := cur[fpath]; !ok {
+				w.report(ctx, fpath, FSEventRemove)
+			}
+		}
+
+		snap = cur
+	}
+}
+
+// runDebounce merge events of the same path within debounce window
+func (w *FSWatcher) runDebounce(ctx context.Context) {
+	defer w.wg.Done()
+
+	var (
+		pending = map[string]*FSEvent{}
+		timer   = time.NewTimer(w.debounce)
+		timerOn = true
+	)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt := <-w.raw:
+			if w.debounce == 0 {
+				w.emit(ctx, evt)
+				continue
+			}
+
+			if p, ok := pending[evt.Path]; ok {
+				p.Op |= evt.Op
+				p.Time = evt.Time
+			} else {
+				pending[evt.Path] = evt
+			}
+			if !timerOn {
+				timer.Reset(w.debounce)
+				timerOn = true
+			}
+		case <-timer.C:
+			timerOn = false
+			now := Clock.GetUTCNow()
+			var (
+				ready []*FSEvent
+				wait  = w.debounce
+			)
+			for fpath, evt := range pending {
+				if d := w.debounce - now.Sub(evt.Time); d > 0 {
+					if d < wait {
+						wait = d
+					}
+
+					continue
+				}
+
+				ready = append(ready, evt)
+				delete(pending, fpath)
+			}
+
+			sort.Slice(ready, func(i, j int) bool {
+				return ready[i].Time.Before(ready[j].Time)
+			})
+			for _, evt := range ready {
+				w.emit(ctx, evt)
+			}
+			if len(pending) != 0 {
+				timer.Reset(wait)
+				timerOn = true
+			}
+		}
+	}
+}
+
+func (w *FSWatcher) emit(ctx context.Context, evt *FSEvent) {
+	w.logger.Debug("file event", zap.String("path", evt.Path), zap.String("op", evt.Op.String()))
+	if w.engine == nil {
+		select {
+		case w.events <- evt:
+		case <-ctx.Done():
+		}
+
+		return
+	}
+
+	if err := w.engine.PublishCtx(ctx, &Event{
+		Topic: w.topic,
+		Meta: EventMeta{
+			FSWatcherMetaPath: evt.Path,
+			FSWatcherMetaOp:   evt.Op,
+			FSWatcherMetaTime: evt.Time,
+		},
+	}); err != nil {
+		w.logger.Error("publish event", zap.String("path", evt.Path), zap.Error(err))
+	}
+}
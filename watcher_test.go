@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// collectFSEvents read events until no event in idle, return merged ops by path
+func collectFSEvents(events <-chan *FSEvent, idle time.Duration) map[string]FSEventOp {
+	got := map[string]FSEventOp{}
+	for {
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				return got
+			}
+
+			got[evt.Path] |= evt.Op
+		case <-time.After(idle):
+			return got
+		}
+	}
+}
+
+func TestFSWatcher(t *testing.T) {
+	for name, opts := range map[string][]FSWatcherOptFunc{
+		"notify": nil,
+		"poll":   {WithFSWatcherPolling(50 * time.Millisecond)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			dir, err := ioutil.TempDir("", "TestFSWatcher")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err = ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			w, err := NewFSWatcher(ctx, []string{dir}, append(opts,
+				WithFSWatcherDebounce(100*time.Millisecond),
+				WithFSWatcherIncludes("*.txt"),
+				WithFSWatcherExcludes("skip"),
+			)...)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			sub := filepath.Join(dir, "sub")
+			if err = os.MkdirAll(filepath.Join(dir, "skip"), 0755); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if err = os.MkdirAll(sub, 0755); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			for _, fpath := range []string{
+				filepath.Join(sub, "b.txt"),
+				filepath.Join(sub, "c.log"),
+				filepath.Join(dir, "skip", "d.txt"),
+			} {
+				if err = ioutil.WriteFile(fpath, []byte("b"), 0644); err != nil {
+					t.Fatalf("%+v", err)
+				}
+			}
+			if err = os.Remove(filepath.Join(dir, "a.txt")); err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			got := collectFSEvents(w.Events(), time.Second)
+			if len(got) != 2 {
+				t.Fatalf("got %v", got)
+			}
+			if !got[filepath.Join(sub, "b.txt")].Has(FSEventCreate) ||
+				got[filepath.Join(dir, "a.txt")] != FSEventRemove {
+				t.Fatalf("got %v", got)
+			}
+
+			// writes are debounced
+			for i := 0; i < 5; i++ {
+				if err = ioutil.WriteFile(filepath.Join(sub, "b.txt"), []byte(time.Now().String()), 0644); err != nil {
+					t.Fatalf("%+v", err)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			var n int
+			for evt := range w.Events() {
+				n++
+				if evt.Path != filepath.Join(sub, "b.txt") || !evt.Op.Has(FSEventWrite) {
+					t.Fatalf("got %+v", evt)
+				}
+
+				w.Close()
+			}
+			if n != 1 {
+				t.Fatalf("got %d", n)
+			}
+		})
+	}
+}
+
+func TestFSWatcherFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "TestFSWatcherFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "config.yml")
+	if err = ioutil.WriteFile(fpath, []byte("a"), 0644); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	engine, err := NewEventEngine(ctx)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	events := make(chan *Event, 10)
+	engine.Register("fs.config", "test", func(evt *Event) {
+		events <- evt
+	})
+
+	if _, err = NewFSWatcher(ctx, []string{fpath},
+		WithFSWatcherDebounce(50*time.Millisecond),
+		WithFSWatcherEventEngine(engine, "fs.config"),
+	); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// siblings are ignored, file replaced by rename is detected
+	if err = ioutil.WriteFile(filepath.Join(dir, "other"), []byte("a"), 0644); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = WriteFileAtomic(fpath, []byte("b"), 0644); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	select {
+	case evt := <-events:
+		if evt.Meta[FSWatcherMetaPath].(string) != fpath ||
+			!evt.Meta[FSWatcherMetaOp].(FSEventOp).Has(FSEventCreate) ||
+			!evt.Meta[FSWatcherMetaTime].(time.Time).Before(evt.Time) {
+			t.Fatalf("got %+v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case evt := <-events:
+		t.Fatalf("got %+v", evt)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if _, err = NewFSWatcher(ctx, []string{filepath.Join(dir, "notexists")}); err == nil {
+		t.Fatal("should error")
+	}
+}
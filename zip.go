@@ -0,0 +1,521 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/Laisky/zap"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+	"github.com/pkg/errors"
+)
+
+// defaultZipSpillSizeByte compressed entry larger than it is spilled to temp file
+const defaultZipSpillSizeByte = 4 * 1024 * 1024
+
+// ZipProgress progress of one zip entry
+type ZipProgress struct {
+	// Name name of entry in archive
+	Name string
+	// Path path on disk
+	Path string
+	// Size uncompressed size
+	Size int64
+	// CompressedSize compressed size in archive
+	CompressedSize int64
+}
+
+// ZipProgressFunc called after each entry is written or extracted,
+// never called concurrently
+type ZipProgressFunc func(p *ZipProgress)
+
+type zipOption struct {
+	level        int
+	nWorkers     int
+	maxOpenFiles int
+	onProgress   ZipProgressFunc
+	// spillSizeByte max size of compressed entry buffered in memory
+	spillSizeByte int
+}
+
+// ZipOptFunc options for zip
+type ZipOptFunc func(*zipOption) error
+
+// WithZipWorkers set the number of workers to compress or extract entries in parallel,
+// default is the number of CPUs
+func WithZipWorkers(n int) ZipOptFunc {
+	return func(opt *zipOption) error {
+		if n <= 0 {
+			return errors.Errorf("workers must > 0")
+		}
+
+		opt.nWorkers = n
+		return nil
+	}
+}
+
+// WithZipMaxOpenFiles set the max number of files opened at the same time,
+// default is unlimited (bounded by workers)
+func WithZipMaxOpenFiles(n int) ZipOptFunc {
+	return func(opt *zipOption) error {
+		if n <= 0 {
+			return errors.Errorf("max open files must > 0")
+		}
+
+		opt.maxOpenFiles = n
+		return nil
+	}
+}
+
+// WithZipCompressLevel set deflate level
+func WithZipCompressLevel(level int) ZipOptFunc {
+	return func(opt *zipOption) error {
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return errors.Errorf("invalid level %d", level)
+		}
+
+		opt.level = level
+		return nil
+	}
+}
+
+// WithZipProgress set callback called after each entry is done
+func WithZipProgress(f ZipProgressFunc) ZipOptFunc {
+	return func(opt *zipOption) error {
+		opt.onProgress = f
+		return nil
+	}
+}
+
+func newZipOption(opts []ZipOptFunc) (*zipOption, error) {
+	opt := &zipOption{
+		level:         flate.DefaultCompression,
+		nWorkers:      runtime.NumCPU(),
+		spillSizeByte: defaultZipSpillSizeByte,
+	}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, errors.Wrap(err, "set option")
+		}
+	}
+
+	return opt, nil
+}
+
+// newOpenFilesLimiter return semaphore bounds concurrently opened files
+func (o *zipOption) newOpenFilesLimiter() chan struct{} {
+	n := o.nWorkers
+	if o.maxOpenFiles > 0 && o.maxOpenFiles < n {
+		n = o.maxOpenFiles
+	}
+
+	return make(chan struct{}, n)
+}
+
+type zipJob struct {
+	path, name string
+	result     chan *zipJobResult
+}
+
+type zipJobResult struct {
+	hdr  *zip.FileHeader
+	data *zipSpillBuffer
+	err  error
+}
+
+// close release temp file of result
+func (r *zipJobResult) close() {
+	if r.data != nil {
+		if err := r.data.Close(); err != nil {
+			Logger.Warn("remove zip temp file", zap.Error(err))
+		}
+	}
+}
+
+// zipSpillBuffer buffer data in memory,
+// spill to temp file once size exceeds limit
+type zipSpillBuffer struct {
+	limit int
+	size  int64
+	buf   bytes.Buffer
+	fp    *os.File
+}
+
+// Write write p into memory or temp file
+func (b *zipSpillBuffer) Write(p []byte) (n int, err error) {
+	if b.fp == nil && b.buf.Len()+len(p) > b.limit {
+		if b.fp, err = ioutil.TempFile("", "zip-entry-"); err != nil {
+			return 0, errors.Wrap(err, "create temp file")
+		}
+		if _, err = b.buf.WriteTo(b.fp); err != nil {
+			return 0, errors.Wrapf(err, "write temp file `%s`", b.fp.Name())
+		}
+	}
+
+	if b.fp != nil {
+		n, err = b.fp.Write(p)
+	} else {
+		n, err = b.buf.Write(p)
+	}
+
+	b.size += int64(n)
+	return n, err
+}
+
+// WriteTo write all buffered data into w
+func (b *zipSpillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.fp == nil {
+		return b.buf.WriteTo(w)
+	}
+
+	if _, err := b.fp.Seek(0, io.SeekStart); err != nil {
+		return 0, errors.Wrapf(err, "seek temp file `%s`", b.fp.Name())
+	}
+
+	return io.Copy(w, b.fp)
+}
+
+// Close remove temp file
+func (b *zipSpillBuffer) Close() error {
+	if b.fp == nil {
+		return nil
+	}
+
+	_ = b.fp.Close()
+	return os.Remove(b.fp.Name())
+}
+
+// WriteZip write zip archive of files into w, entries are compressed in parallel.
+//
+// files can be directory, entries are named relative to the parent of each file,
+// and are written in the order of walking.
+// compressed entries are buffered until written, at most `workers` entries
+// are buffered at the same time. entries larger than 4MB after compression
+// are buffered in temp files instead of memory.
+func WriteZip(w io.Writer, files []string, opts ...ZipOptFunc) (err error) {
+	return WriteZipFS(OSFS{}, w, files, opts...)
+}
+
+// WriteZipFS write zip archive of files in fsys into w, see `WriteZip`
+func WriteZipFS(fsys FS, w io.Writer, files []string, opts ...ZipOptFunc) (err error) {
+	opt, err := newZipOption(opts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		jobs    = make(chan *zipJob)
+		ordered = make(chan *zipJob, opt.nWorkers)
+		walkErr error
+		limiter = opt.newOpenFilesLimiter()
+	)
+	defer func() {
+		// stop walking and remove temp files of unwritten entries
+		cancel()
+		for job := range ordered {
+			res := <-job.result
+			res.close()
+		}
+	}()
+	go func() {
+		defer close(jobs)
+		defer close(ordered)
+		for _, file := range files {
+			if walkErr = walkZipFiles(ctx, fsys, file, func(fpath, name string) bool {
+				job := &zipJob{
+					path:   fpath,
+					name:   name,
+					result: make(chan *zipJobResult, 1),
+				}
+				select {
+				case ordered <- job:
+				case <-ctx.Done():
+					return false
+				}
+				select {
+				case jobs <- job:
+				case <-ctx.Done():
+					// job in ordered should always get result
+					job.result <- &zipJobResult{err: ctx.Err()}
+					return false
+				}
+
+				return true
+			}); walkErr != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < opt.nWorkers; i++ {
+		go func() {
+			for job := range jobs {
+				limiter <- struct{}{}
+				job.result <- compressZipEntry(fsys, job, opt.level, opt.spillSizeByte)
+				<-limiter
+			}
+		}()
+	}
+
+	zw := zip.NewWriter(w)
+	for job := range ordered {
+		res := <-job.result
+		if res.err != nil {
+			res.close()
+			return res.err
+		}
+
+		writer, err := zw.CreateHeaderRaw(res.hdr)
+		if err != nil {
+			res.close()
+			return errors.Wrapf(err, "create header `%s`", job.name)
+		}
+		_, err = res.data.WriteTo(writer)
+		res.close()
+		if err != nil {
+			return errors.Wrapf(err, "write `%s`", job.name)
+		}
+
+		Logger.Debug("add file to zip", zap.String("file", job.path))
+		if opt.onProgress != nil {
+			opt.onProgress(&ZipProgress{
+				Name:           job.name,
+				Path:           job.path,
+				Size:           int64(res.hdr.UncompressedSize64),
+				CompressedSize: int64(res.hdr.CompressedSize64),
+			})
+		}
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+
+	return errors.Wrap(zw.Close(), "close zip")
+}
+
+// walkZipFiles walk root, call add for each regular file.
+//
+// symlinks to files are followed, symlinks to dirs are skipped.
+func walkZipFiles(ctx context.Context, fsys FS, root string, add func(fpath, name string) bool) error {
+	root = filepath.Clean(root)
+	base := filepath.Base(root)
+	return WalkFS(fsys, root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "walk `%s`", fpath)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = fsys.Stat(fpath); err != nil {
+				return errors.Wrapf(err, "get file stat: %s", fpath)
+			}
+			if info.IsDir() {
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return errors.Wrapf(err, "get relative path of `%s`", fpath)
+		}
+		name := base
+		if rel != "." {
+			name = filepath.ToSlash(filepath.Join(base, rel))
+		}
+
+		if !add(fpath, name) {
+			return ctx.Err()
+		}
+
+		return nil
+	})
+}
+
+// compressZipEntry compress file into memory,
+// or temp file if compressed data exceeds spillSizeByte
+func compressZipEntry(fsys FS, job *zipJob, level, spillSizeByte int) *zipJobResult {
+	res := &zipJobResult{data: &zipSpillBuffer{limit: spillSizeByte}}
+	fp, err := fsys.Open(job.path)
+	if err != nil {
+		res.err = errors.Wrapf(err, "open file: %s", job.path)
+		return res
+	}
+	defer fp.Close()
+
+	finfo, err := fp.Stat()
+	if err != nil {
+		res.err = errors.Wrapf(err, "get file stat: %s", job.path)
+		return res
+	}
+	if res.hdr, err = zip.FileInfoHeader(finfo); err != nil {
+		res.err = errors.Wrap(err, "get file header")
+		return res
+	}
+	res.hdr.Name = job.name
+	res.hdr.Method = zip.Deflate
+
+	fw, err := flate.NewWriter(res.data, level)
+	if err != nil {
+		res.err = errors.Wrap(err, "new flate writer")
+		return res
+	}
+
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(fw, crc), fp)
+	if err != nil {
+		res.err = errors.Wrapf(err, "compress `%s`", job.path)
+		return res
+	}
+	if err = fw.Close(); err != nil {
+		res.err = errors.Wrapf(err, "compress `%s`", job.path)
+		return res
+	}
+
+	res.hdr.CRC32 = crc.Sum32()
+	res.hdr.UncompressedSize64 = uint64(n)
+	res.hdr.CompressedSize64 = uint64(res.data.size)
+	return res
+}
+
+// ExtractZip extract zip archive from r into dest in parallel, return extracted paths.
+//
+// paths are returned in the order of entries in archive.
+// if entries have the same path, the last one wins.
+// on error, paths of entries may have been written are returned with error,
+// so caller can clean them up.
+func ExtractZip(r io.ReaderAt, size int64, dest string, opts ...ZipOptFunc) (filenames []string, err error) {
+	return ExtractZipFS(OSFS{}, r, size, dest, opts...)
+}
+
+// ExtractZipFS extract zip archive from r into dest in fsys, see `ExtractZip`
+func ExtractZipFS(fsys FS, r io.ReaderAt, size int64, dest string, opts ...ZipOptFunc) (filenames []string, err error) {
+	opt, err := newZipOption(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "open zip")
+	}
+
+	dest = filepath.Clean(dest)
+	// only extract the last entry of the same path,
+	// entries write the same file concurrently would corrupt it
+	lastEntry := map[string]*zip.File{}
+	for _, f := range zr.File {
+		lastEntry[filepath.Join(dest, f.Name)] = f
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		limiter  = opt.newOpenFilesLimiter()
+	)
+	setErr := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+	hasErr := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	for _, f := range zr.File {
+		// Store filename/path for returning and using later on
+		fpath := filepath.Join(dest, f.Name)
+
+		// Check for ZipSlip. More Info: https://snyk.io/research/zip-slip-vulnerability#go
+		if !isPathInDir(fpath, dest) || fpath == dest {
+			setErr(errors.Errorf("illegal file path: %s", fpath))
+			break
+		}
+		filenames = append(filenames, fpath)
+		if lastEntry[fpath] != f {
+			continue
+		}
+
+		if f.FileInfo().IsDir() {
+			if err = fsys.MkdirAll(fpath, os.ModePerm); err != nil {
+				setErr(errors.Wrapf(err, "create basedir: %s", fpath))
+				break
+			}
+
+			Logger.Debug("create basedir", zap.String("path", fpath))
+			continue
+		}
+
+		// workers are bounded by limiter
+		limiter <- struct{}{}
+		if hasErr() {
+			<-limiter
+			break
+		}
+
+		wg.Add(1)
+		go func(f *zip.File, fpath string) {
+			defer wg.Done()
+			defer func() { <-limiter }()
+
+			if err := extractZipFile(fsys, f, fpath); err != nil {
+				setErr(err)
+				return
+			}
+
+			if opt.onProgress != nil {
+				mu.Lock()
+				opt.onProgress(&ZipProgress{
+					Name:           f.Name,
+					Path:           fpath,
+					Size:           int64(f.UncompressedSize64),
+					CompressedSize: int64(f.CompressedSize64),
+				})
+				mu.Unlock()
+			}
+		}(f, fpath)
+	}
+
+	wg.Wait()
+	return filenames, firstErr
+}
+
+func extractZipFile(fsys FS, f *zip.File, fpath string) error {
+	if err := fsys.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+		return errors.Wrapf(err, "mkdir: %s", fpath)
+	}
+
+	outFile, err := fsys.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	if err != nil {
+		return errors.Wrapf(err, "open file to write: %s", fpath)
+	}
+	defer outFile.Close()
+
+	rc, err := f.Open()
+	if err != nil {
+		return errors.Wrapf(err, "read src file to write: %s", f.Name)
+	}
+	defer rc.Close()
+
+	if _, err = io.Copy(outFile, rc); err != nil {
+		return errors.Wrap(err, "copy src to dest")
+	}
+
+	Logger.Debug("create file", zap.String("path", fpath))
+	return errors.Wrapf(outFile.Close(), "close file: %s", fpath)
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWriteZipAndExtractZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWriteZipAndExtractZip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	contents := map[string]string{}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("src/%d/%d.txt", i%5, i)
+		contents[name] = strings.Repeat(fmt.Sprint(i), 1000+i)
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = ioutil.WriteFile(fpath, []byte(contents[name]), 0644); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	var nProgress int32
+	buf := &bytes.Buffer{}
+	if err = WriteZip(buf, []string{src},
+		WithZipWorkers(4),
+		WithZipProgress(func(p *ZipProgress) {
+			atomic.AddInt32(&nProgress, 1)
+			if p.CompressedSize >= p.Size {
+				t.Errorf("not compressed: %+v", p)
+			}
+		}),
+	); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if nProgress != 50 {
+		t.Fatalf("got %d", nProgress)
+	}
+
+	// readable by stdlib, entries are in walking order
+	zr, err := stdzip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(zr.File) != 50 {
+		t.Fatalf("got %d", len(zr.File))
+	}
+	for i := 1; i < len(zr.File); i++ {
+		if zr.File[i-1].Name >= zr.File[i].Name {
+			t.Fatalf("not ordered: %s, %s", zr.File[i-1].Name, zr.File[i].Name)
+		}
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(got) != contents[f.Name] {
+			t.Fatalf("%s: %+v", f.Name, err)
+		}
+	}
+
+	nProgress = 0
+	dest := filepath.Join(dir, "dest")
+	files, err := ExtractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dest,
+		WithZipWorkers(8),
+		WithZipMaxOpenFiles(2),
+		WithZipProgress(func(p *ZipProgress) {
+			nProgress++
+		}),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(files) != 50 || nProgress != 50 {
+		t.Fatalf("got %d, %d", len(files), nProgress)
+	}
+	for name, content := range contents {
+		got, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil || string(got) != content {
+			t.Fatalf("%s: %+v", name, err)
+		}
+	}
+
+	if err = WriteZip(buf, []string{filepath.Join(dir, "notexists")}); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestExtractZipSlip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExtractZipSlip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	zw := stdzip.NewWriter(buf)
+	for _, name := range []string{"ok", "../evil"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err = w.Write([]byte(name)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	files, err := ExtractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), filepath.Join(dir, "dest"))
+	if err == nil {
+		t.Fatal("should error")
+	}
+	// entries extracted before error are returned
+	if len(files) != 1 || files[0] != filepath.Join(dir, "dest", "ok") {
+		t.Fatalf("got %v", files)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "evil")); !os.IsNotExist(err) {
+		t.Fatal("escaped")
+	}
+}
+
+func TestWriteZipSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWriteZipSpill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 100*1024)
+	for i := range content {
+		content[i] = byte(i * i % 251)
+	}
+	for i := 0; i < 3; i++ {
+		if err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.bin", i)), content, 0644); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	spilled, err := filepath.Glob(filepath.Join(os.TempDir(), "zip-entry-*"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err = WriteZip(buf, []string{dir}, func(opt *zipOption) error {
+		opt.spillSizeByte = 1024
+		return nil
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if left, err := filepath.Glob(filepath.Join(os.TempDir(), "zip-entry-*")); err != nil || len(left) != len(spilled) {
+		t.Fatalf("temp files not removed: %v, %+v", left, err)
+	}
+
+	zr, err := stdzip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(zr.File) != 3 {
+		t.Fatalf("got %d", len(zr.File))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("%s: %+v", f.Name, err)
+		}
+	}
+}
+
+func TestExtractZipDuplicate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExtractZipDuplicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	zw := stdzip.NewWriter(buf)
+	for i := 0; i < 20; i++ {
+		w, err := zw.Create("a.txt")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err = w.Write([]byte(strings.Repeat(fmt.Sprint(i), 10000-i))); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	dest := filepath.Join(dir, "dest")
+	files, err := ExtractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dest, WithZipWorkers(8))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(files) != 20 {
+		t.Fatalf("got %d", len(files))
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dest, "a.txt"))
+	if err != nil || string(got) != strings.Repeat("19", 10000-19) {
+		t.Fatalf("got %d bytes, %+v", len(got), err)
+	}
+}